@@ -0,0 +1,159 @@
+package pts
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+const (
+	// PayloadEncodingBinary marks a payload of opaque bytes that was received in a binary frame or a chunked transfer.
+	PayloadEncodingBinary = "binary"
+	// PayloadEncodingBase64 marks a payload of opaque bytes that is sent as a base64 encoded JSON string.
+	PayloadEncodingBase64 = "base64"
+)
+
+// binaryEnvelopeVersion is the first byte of every binary frame.
+//
+// A binary frame consists of:
+//
+//	version   byte
+//	type      byte, one of binaryTypes or 0 followed by the type as a string
+//	channel   string
+//	metadata  string, a JSON object with the optional fields of the Message, empty if there are none
+//	payload   all remaining bytes
+//
+// Strings are prefixed with their length as an unsigned varint.
+const binaryEnvelopeVersion = 1
+
+// binaryTypes are the message types with a one byte code in binary frames, the index is the code.
+var binaryTypes = [...]string{
+	1: MessageTypeSubscribe,
+	2: MessageTypeUnsubscribe,
+	3: MessageTypeChannelMessage,
+	4: MessageTypeError,
+	5: MessageTypeAck,
+	6: MessageTypeCancel,
+}
+
+// envelopeMetadata are the optional fields of a Message, that are encoded as JSON in binary frames.
+type envelopeMetadata struct {
+	Id             string            `json:"id,omitempty"`
+	ExpiresAt      int64             `json:"expiresAt,omitempty"`
+	IdempotencyKey string            `json:"idempotencyKey,omitempty"`
+	Timestamp      int64             `json:"timestamp,omitempty"`
+	Sender         string            `json:"sender,omitempty"`
+	Headers        map[string]string `json:"headers,omitempty"`
+	Chunk          *Chunk            `json:"chunk,omitempty"`
+}
+
+var errInvalidBinaryMessage = errors.New("invalid binary message")
+
+// Bytes returns the payload as bytes. Binary and base64 encoded payloads are decoded, JSON payloads are returned as they are.
+func (m *Message) Bytes() ([]byte, error) {
+	switch m.Encoding {
+	case "", PayloadEncodingBinary:
+		return m.Payload, nil
+	case PayloadEncodingBase64:
+		var data []byte
+		if err := json.Unmarshal(m.Payload, &data); err != nil {
+			return nil, err
+		}
+		return data, nil
+	}
+	return nil, fmt.Errorf("unknown payload encoding '%s'", m.Encoding)
+}
+
+// SendBinary sends opaque bytes to the client, in a binary frame if its connection supports them and base64 encoded otherwise.
+func (context *Context) SendBinary(data []byte) *Error {
+	return context.SendWithOptions(data, &SendOptions{Binary: true})
+}
+
+// encodeBinaryMessage encodes the message as a binary frame, its payload is written as it is.
+func encodeBinaryMessage(message *Message) ([]byte, error) {
+	metadata, err := json.Marshal(envelopeMetadata{
+		Id:             message.Id,
+		ExpiresAt:      message.ExpiresAt,
+		IdempotencyKey: message.IdempotencyKey,
+		Timestamp:      message.Timestamp,
+		Sender:         message.Sender,
+		Headers:        message.Headers,
+		Chunk:          message.Chunk,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if string(metadata) == "{}" {
+		metadata = nil
+	}
+
+	data := make([]byte, 0, 2+3*binary.MaxVarintLen64+len(message.Type)+len(message.Channel)+len(metadata)+len(message.Payload))
+	data = append(data, binaryEnvelopeVersion, 0)
+	for code, messageType := range binaryTypes {
+		if code > 0 && messageType == message.Type {
+			data[1] = byte(code)
+			break
+		}
+	}
+	if data[1] == 0 {
+		data = appendBinaryString(data, []byte(message.Type))
+	}
+	data = appendBinaryString(data, []byte(message.Channel))
+	data = appendBinaryString(data, metadata)
+	return append(data, message.Payload...), nil
+}
+
+// decodeBinaryMessage decodes a binary frame into message, the Payload of the message is a slice of data.
+func decodeBinaryMessage(data []byte, message *Message, maxDepth int) error {
+	if len(data) < 2 || data[0] != binaryEnvelopeVersion {
+		return fmt.Errorf("%w: unsupported version", errInvalidBinaryMessage)
+	}
+	code, rest := int(data[1]), data[2:]
+	var messageType, channel, metadata []byte
+	var err error
+	if code == 0 {
+		if messageType, rest, err = readBinaryString(rest); err != nil {
+			return err
+		}
+	} else if code >= len(binaryTypes) {
+		return fmt.Errorf("%w: unknown type %d", errInvalidBinaryMessage, code)
+	}
+	if channel, rest, err = readBinaryString(rest); err != nil {
+		return err
+	}
+	if metadata, rest, err = readBinaryString(rest); err != nil {
+		return err
+	}
+
+	if len(metadata) > 0 {
+		if err := parseMessage(metadata, message, maxDepth); err != nil {
+			return err
+		}
+	}
+	if code == 0 {
+		message.Type = internMessageType(messageType)
+	} else {
+		message.Type = binaryTypes[code]
+	}
+	message.Channel = string(channel)
+	message.Payload = rest
+	message.Encoding = PayloadEncodingBinary
+	return nil
+}
+
+func appendBinaryString(data []byte, value []byte) []byte {
+	var length [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(length[:], uint64(len(value)))
+	data = append(data, length[:n]...)
+	return append(data, value...)
+}
+
+func readBinaryString(data []byte) (value []byte, rest []byte, err error) {
+	length, n := binary.Uvarint(data)
+	if n <= 0 || length > uint64(len(data)-n) {
+		return nil, nil, fmt.Errorf("%w: truncated string", errInvalidBinaryMessage)
+	}
+	end := n + int(length)
+	return data[n:end], data[end:], nil
+}
@@ -0,0 +1,202 @@
+package pts
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+// binaryWorker is a client whose connection supports binary frames, it records the frames it receives.
+type binaryWorker struct {
+	client *Client
+	mutex  sync.Mutex
+	frames []Message
+	texts  int
+}
+
+func newBinaryWorker(connector *Connector) *binaryWorker {
+	worker := &binaryWorker{}
+	worker.client = connector.JoinWithOptions(func(data []byte) error {
+		worker.mutex.Lock()
+		defer worker.mutex.Unlock()
+		worker.texts++
+		return nil
+	}, nil, &JoinOptions{SendBinary: func(data []byte) error {
+		var message Message
+		if err := decodeBinaryMessage(append([]byte{}, data...), &message, defaultMaxDepth); err != nil {
+			return err
+		}
+		worker.mutex.Lock()
+		defer worker.mutex.Unlock()
+		worker.frames = append(worker.frames, message)
+		return nil
+	}})
+	return worker
+}
+
+func (w *binaryWorker) received() ([]Message, int) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return append([]Message{}, w.frames...), w.texts
+}
+
+func TestBinaryEnvelope(t *testing.T) {
+	t.Run("Round trip", func(t *testing.T) {
+		messages := []Message{
+			{Type: MessageTypeChannelMessage, Channel: "telemetry/1", Payload: []byte{0, 1, 0xff, '{'}},
+			{Type: MessageTypeSubscribe, Channel: "a", Payload: []byte(`{"group":"g"}`)},
+			{Type: "custom", Channel: "", Payload: []byte{}},
+			{Type: MessageTypeAck, Channel: "b", Payload: []byte{1}, Id: "7", ExpiresAt: 2, IdempotencyKey: "k",
+				Timestamp: 3, Sender: "c1", Headers: map[string]string{"trace": "t1"}},
+		}
+		for _, message := range messages {
+			data, err := encodeBinaryMessage(&message)
+			if err != nil {
+				t.Fatalf("encodeBinaryMessage(%+v) = %v, want nil", message, err)
+			}
+			var got Message
+			if err := decodeBinaryMessage(data, &got, defaultMaxDepth); err != nil {
+				t.Fatalf("decodeBinaryMessage(%+v) = %v, want nil", message, err)
+			}
+			if !bytes.Equal(got.Payload, message.Payload) || got.Encoding != PayloadEncodingBinary {
+				t.Errorf("payload = %v (%s), want %v (binary)", got.Payload, got.Encoding, message.Payload)
+			}
+			got.Payload, got.Encoding, message.Payload = nil, "", nil
+			if !reflect.DeepEqual(got, message) {
+				t.Errorf("decodeBinaryMessage(...) = %+v, want %+v", got, message)
+			}
+		}
+	})
+
+	t.Run("Compact header without metadata", func(t *testing.T) {
+		data, _ := encodeBinaryMessage(&Message{Type: MessageTypeChannelMessage, Channel: "a/b", Payload: []byte{9}})
+		if want := []byte{binaryEnvelopeVersion, 3, 3, 'a', '/', 'b', 0, 9}; !bytes.Equal(data, want) {
+			t.Errorf("encodeBinaryMessage(...) = %v, want %v", data, want)
+		}
+	})
+
+	t.Run("Invalid frames", func(t *testing.T) {
+		frames := [][]byte{
+			{},
+			{binaryEnvelopeVersion},
+			{2, 3, 0, 0},
+			{binaryEnvelopeVersion, 200, 0, 0},
+			{binaryEnvelopeVersion, 3, 5, 'a'},
+			{binaryEnvelopeVersion, 3, 0},
+			{binaryEnvelopeVersion, 0, 0x80},
+		}
+		for _, frame := range frames {
+			var message Message
+			if err := decodeBinaryMessage(frame, &message, defaultMaxDepth); !errors.Is(err, errInvalidBinaryMessage) {
+				t.Errorf("decodeBinaryMessage(%v) = %v, want errInvalidBinaryMessage", frame, err)
+			}
+		}
+		var message Message
+		if err := decodeBinaryMessage([]byte{binaryEnvelopeVersion, 3, 0, 1, '{'}, &message, defaultMaxDepth); err == nil {
+			t.Errorf("decodeBinaryMessage(invalid metadata) = nil, want error")
+		}
+	})
+}
+
+func TestBinaryPayloads(t *testing.T) {
+	t.Run("Binary frames and base64 fallback", func(t *testing.T) {
+		connector := NewConnector(nil, nil)
+		tubeSystem := New(connector)
+		channel := tubeSystem.RegisterChannel("images", ChannelHandlers{})
+		image := []byte{0x89, 'P', 'N', 'G', 0, 0xff}
+
+		binaryClient := newBinaryWorker(connector)
+		jsonClient := newGroupWorker(connector)
+		connector.Message(binaryClient.client.Id, SubMessage("images"))
+		connector.Message(jsonClient.client.Id, SubMessage("images"))
+
+		channel.Broadcast("images", image, &ChannelBroadcastOptions{SendOptions: SendOptions{Binary: true, Id: "i1"}})
+		context, _ := channel.subscribers.GetContext(binaryClient.client.Id, "images")
+		if err := context.SendBinary(image[:2]); err != nil {
+			t.Fatalf("SendBinary(...) = %v, want nil", err)
+		}
+		context.Send([]byte(`"text"`))
+
+		frames, texts := binaryClient.received()
+		if len(frames) != 2 || texts != 1 {
+			t.Fatalf("binary client received %d frames and %d texts, want 2 and 1", len(frames), texts)
+		}
+		if data, _ := frames[0].Bytes(); !bytes.Equal(data, image) || frames[0].Id != "i1" || frames[0].Channel != "images" {
+			t.Errorf("frames[0] = %+v, want the image", frames[0])
+		}
+		if data, _ := frames[1].Bytes(); !bytes.Equal(data, image[:2]) {
+			t.Errorf("frames[1] = %v, want %v", data, image[:2])
+		}
+
+		received := jsonClient.received()
+		if len(received) != 1 || received[0].Encoding != PayloadEncodingBase64 {
+			t.Fatalf("json client received %+v, want one base64 message", received)
+		}
+		if data, err := received[0].Bytes(); err != nil || !bytes.Equal(data, image) {
+			t.Errorf("Bytes() = %v, %v, want %v", data, err, image)
+		}
+	})
+
+	t.Run("Binary frames are queued", func(t *testing.T) {
+		connector := NewConnector(nil, nil)
+		tubeSystem := New(connector)
+		tubeSystem.SetQueueOptions(QueueOptions{MaxMessages: 10})
+		channel := tubeSystem.RegisterChannel("images", ChannelHandlers{})
+		worker := newBinaryWorker(connector)
+		connector.Message(worker.client.Id, SubMessage("images"))
+
+		channel.Broadcast("images", []byte{1, 2}, &ChannelBroadcastOptions{SendOptions: SendOptions{Binary: true}})
+		waitForMessages(t, func() []string {
+			var payloads []string
+			frames, _ := worker.received()
+			for _, frame := range frames {
+				payloads = append(payloads, string(frame.Payload))
+			}
+			return payloads
+		}, 1)
+		connector.Leave(worker.client.Id)
+	})
+
+	t.Run("Inbound binary frames", func(t *testing.T) {
+		connector := NewConnector(nil, nil)
+		tubeSystem := New(connector)
+		var payloads [][]byte
+		tubeSystem.RegisterChannel("telemetry", ChannelHandlers{
+			OnMessage: func(s *Context, message *Message) {
+				data, err := message.Bytes()
+				if err != nil {
+					t.Errorf("Bytes() = %v, want nil", err)
+				}
+				payloads = append(payloads, append([]byte{}, data...))
+			},
+		})
+		worker := newBinaryWorker(connector)
+		subscribe, _ := encodeBinaryMessage(&Message{Type: MessageTypeSubscribe, Channel: "telemetry"})
+		connector.MessageBinary(worker.client.Id, subscribe)
+		message, _ := encodeBinaryMessage(&Message{Type: MessageTypeChannelMessage, Channel: "telemetry", Payload: []byte{0, 42}})
+		connector.MessageBinary(worker.client.Id, message)
+		connector.Message(worker.client.Id, []byte(`{"type":"message","channel":"telemetry","payload":"AAE=","encoding":"base64"}`))
+		connector.MessageBinary(worker.client.Id, []byte{0})
+
+		if len(payloads) != 2 || !bytes.Equal(payloads[0], []byte{0, 42}) || !bytes.Equal(payloads[1], []byte{0, 1}) {
+			t.Errorf("payloads = %v, want [[0 42] [0 1]]", payloads)
+		}
+	})
+
+	t.Run("Bytes", func(t *testing.T) {
+		message := Message{Payload: []byte(`{"a":1}`)}
+		if data, err := message.Bytes(); err != nil || string(data) != `{"a":1}` {
+			t.Errorf("Bytes() = %s, %v, want the JSON payload", data, err)
+		}
+		message = Message{Payload: []byte(`"!"`), Encoding: PayloadEncodingBase64}
+		if _, err := message.Bytes(); err == nil {
+			t.Errorf("Bytes() of invalid base64 = nil error, want error")
+		}
+		message = Message{Payload: []byte(`1`), Encoding: "gzip"}
+		if _, err := message.Bytes(); err == nil {
+			t.Errorf("Bytes() of unknown encoding = nil error, want error")
+		}
+	})
+}
@@ -0,0 +1,251 @@
+package pts
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type ChannelBroadcastOptions struct {
+	SendOptions
+	SkipClientIds []string
+	// OnResult receives the result of each recipient instead of collecting them in ChannelBroadcastResult.Results.
+	// With ChannelOptions.BroadcastWorkers it is called concurrently from multiple goroutines.
+	OnResult func(result BroadcastSendResult)
+}
+
+func (o *ChannelBroadcastOptions) shouldSkip(id string) bool {
+	for _, clientId := range o.SkipClientIds {
+		if clientId == id {
+			return true
+		}
+	}
+	return false
+}
+
+// skipFunc returns a function that reports whether a client is skipped, it uses a set for long skip lists.
+func (o *ChannelBroadcastOptions) skipFunc() func(id string) bool {
+	if o == nil || len(o.SkipClientIds) == 0 {
+		return func(string) bool { return false }
+	}
+	if len(o.SkipClientIds) <= 8 {
+		return o.shouldSkip
+	}
+	skip := make(map[string]struct{}, len(o.SkipClientIds))
+	for _, clientId := range o.SkipClientIds {
+		skip[clientId] = struct{}{}
+	}
+	return func(id string) bool {
+		_, found := skip[id]
+		return found
+	}
+}
+
+type ChannelBroadcastResult struct {
+	HasErrors bool
+	// Results contains the result of each recipient, it is empty if ChannelBroadcastOptions.OnResult is set.
+	Results []*BroadcastSendResult
+	Sent    int
+	Failed  int
+	Skipped int
+	// Expired is the number of recipients that did not receive the message, because it expired during the broadcast.
+	Expired int
+	// Coalesced is true if the payload was deferred, it is broadcast later, possibly merged with later payloads.
+	Coalesced bool
+}
+
+type BroadcastSendResult struct {
+	Skipped bool
+	Expired bool
+	Context *Context
+	Err     *Error
+}
+
+// Broadcast sends the payload to all subscribers of the path.
+// The message envelope, or the fragments of a large payload, is encoded once for all recipients with the same kind of
+// connection unless outbound interceptors are installed.
+// If the Channel coalesces publishes, the payload may be deferred, which is reported by ChannelBroadcastResult.Coalesced.
+func (c *Channel) Broadcast(fullPath string, payload []byte, options *ChannelBroadcastOptions) *ChannelBroadcastResult {
+	if c.options.Coalesce != nil {
+		if options != nil {
+			// the expiry starts with the publish, not with the deferred broadcast
+			resolved := *options
+			resolved.SendOptions = options.SendOptions.absolute(time.Now())
+			options = &resolved
+		}
+		if res := c.publish(fullPath, payload, options); res != nil {
+			return res
+		}
+		return &ChannelBroadcastResult{Coalesced: true}
+	}
+	return c.broadcast(fullPath, payload, options)
+}
+
+func (c *Channel) broadcast(fullPath string, payload []byte, options *ChannelBroadcastOptions) *ChannelBroadcastResult {
+	res := &ChannelBroadcastResult{}
+	var onResult func(result BroadcastSendResult)
+	var sendOptions *SendOptions
+	if options != nil {
+		onResult = options.OnResult
+		absolute := options.SendOptions.absolute(time.Now())
+		sendOptions = &absolute
+	}
+	// all recipients get the same id and timestamp
+	sendOptions = c.stampOutbound(sendOptions, time.Now())
+	expiresAt := sendOptions.expiresAt(time.Now())
+	skip := options.skipFunc()
+	contexts, jobs := c.assignGroups(fullPath, c.GetSubscribers(fullPath), payload, sendOptions, skip)
+
+	var results []BroadcastSendResult
+	if onResult == nil {
+		results = make([]BroadcastSendResult, len(contexts))
+		res.Results = make([]*BroadcastSendResult, len(contexts))
+		for i := range results {
+			res.Results[i] = &results[i]
+		}
+	}
+
+	var shared map[bool]*sharedMessage
+	if !c.hasInterceptors() {
+		// if encoding fails, each recipient falls back to Context.Send, which reports the error
+		envelope := channelEnvelope(fullPath, payload, "", sendOptions, expiresAt)
+		shared = c.encodeShared(envelope, contexts, sendOptions, expiresAt)
+	}
+
+	var sent, failed, skipped, expiredCount int64
+	c.fanout(len(contexts), func(i int) {
+		context := contexts[i]
+		result := BroadcastSendResult{Context: context}
+		id, job := jobs[context]
+		message := shared[context.Client.supportsBinary()]
+		switch {
+		case skip(context.Client.Id):
+			result.Skipped = true
+			atomic.AddInt64(&skipped, 1)
+		case expired(expiresAt, time.Now()):
+			result.Expired = true
+			atomic.AddInt64(&expiredCount, 1)
+		case id != "" || (job && message == nil):
+			result.Err = context.send(payload, id, job, sendOptions)
+		case message != nil && message.transfer != nil:
+			result.Err = context.sendTransfer(message.transfer)
+		case message != nil:
+			result.Err = context.deliver(outbound{data: message.data, binary: message.binary, payload: payload,
+				priority: sendOptions.priority(), expiresAt: expiresAt, job: job})
+		default:
+			result.Err = context.SendWithOptions(payload, sendOptions)
+		}
+		if !result.Skipped && !result.Expired {
+			if result.Err != nil {
+				atomic.AddInt64(&failed, 1)
+			} else {
+				atomic.AddInt64(&sent, 1)
+			}
+		}
+
+		if onResult != nil {
+			onResult(result)
+		} else {
+			results[i] = result
+		}
+	})
+
+	res.Sent, res.Failed, res.Skipped, res.Expired = int(sent), int(failed), int(skipped), int(expiredCount)
+	res.HasErrors = failed > 0
+	return res
+}
+
+// sharedMessage is a broadcast message, that is encoded once for all recipients with the same kind of connection.
+// Large payloads are encoded as a chunked transfer.
+type sharedMessage struct {
+	data     []byte
+	binary   bool
+	transfer *outboundTransfer
+}
+
+// encodeShared encodes the envelope for each kind of connection among the recipients, keyed by the support of
+// binary frames. Kinds that fail to encode are missing.
+func (c *Channel) encodeShared(envelope Message, contexts []*Context, options *SendOptions, expiresAt time.Time) map[bool]*sharedMessage {
+	shared := map[bool]*sharedMessage{}
+	for _, context := range contexts {
+		frame := context.Client.supportsBinary()
+		if _, found := shared[frame]; found {
+			continue
+		}
+		shared[frame] = nil
+		if size := c.chunkSize(envelope.Payload, options.binary(), frame); size > 0 {
+			if transfer, err := encodeTransfer(envelope, size, frame, options, expiresAt); err == nil {
+				shared[frame] = &sharedMessage{transfer: transfer}
+			}
+			continue
+		}
+		binary := options.binary() && frame
+		if data, err := encodeChannelMessage(&envelope, options.binary(), binary); err == nil {
+			shared[frame] = &sharedMessage{data: data, binary: binary}
+		}
+	}
+	return shared
+}
+
+// fanout calls send for each index in [0, count), spread over ChannelOptions.BroadcastWorkers goroutines.
+func (c *Channel) fanout(count int, send func(i int)) {
+	workers := c.options.BroadcastWorkers
+	if workers > count {
+		workers = count
+	}
+	if workers <= 1 {
+		for i := 0; i < count; i++ {
+			send(i)
+		}
+		return
+	}
+
+	next := int64(-1)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for {
+				i := int(atomic.AddInt64(&next, 1))
+				if i >= count {
+					return
+				}
+				send(i)
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// hasInterceptors returns true if a payload may be rewritten per recipient.
+func (c *Channel) hasInterceptors() bool {
+	return len(c.options.OutboundInterceptors) > 0 || !c.store.getInterceptors().empty()
+}
+
+// BroadcastFuture is the pending result of Channel.BroadcastAsync.
+type BroadcastFuture struct {
+	done   chan struct{}
+	result *ChannelBroadcastResult
+}
+
+// Done returns a channel that is closed as soon as the broadcast finished.
+func (f *BroadcastFuture) Done() <-chan struct{} {
+	return f.done
+}
+
+// Wait blocks until the broadcast finished and returns its result.
+func (f *BroadcastFuture) Wait() *ChannelBroadcastResult {
+	<-f.done
+	return f.result
+}
+
+// BroadcastAsync works like Broadcast, but returns immediately.
+func (c *Channel) BroadcastAsync(fullPath string, payload []byte, options *ChannelBroadcastOptions) *BroadcastFuture {
+	future := &BroadcastFuture{done: make(chan struct{})}
+	go func() {
+		defer close(future.done)
+		future.result = c.Broadcast(fullPath, payload, options)
+	}()
+	return future
+}
@@ -0,0 +1,147 @@
+package pts
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func newBroadcastTestChannel(t *testing.T, options ChannelOptions, clients int, failEvery int) (*Channel, *int64) {
+	store := ChannelStore{}
+	store.init(func(err *Error) {})
+	channel := store.Register("scores/:match", ChannelHandlers{}, options)
+
+	var delivered int64
+	for i := 0; i < clients; i++ {
+		fail := failEvery > 0 && i%failEvery == 0
+		store.Subscribe(&Client{Id: strconv.Itoa(i), sendMessage: func(message []byte) error {
+			if fail {
+				return errors.New("failed to send message")
+			}
+			atomic.AddInt64(&delivered, 1)
+			return nil
+		}}, "scores/1")
+	}
+	return channel, &delivered
+}
+
+func TestBroadcast(t *testing.T) {
+	t.Run("Parallel workers deliver to every subscriber", func(t *testing.T) {
+		channel, delivered := newBroadcastTestChannel(t, ChannelOptions{BroadcastWorkers: 4}, 100, 10)
+
+		result := channel.Broadcast("scores/1", []byte(`{"home":1}`), &ChannelBroadcastOptions{SkipClientIds: []string{"1", "2"}})
+
+		if result.Sent != 88 || result.Failed != 10 || result.Skipped != 2 {
+			t.Errorf("result = (sent %d, failed %d, skipped %d), want (88, 10, 2)", result.Sent, result.Failed, result.Skipped)
+		}
+		if *delivered != 88 {
+			t.Errorf("delivered = %d, want 88", *delivered)
+		}
+		if !result.HasErrors {
+			t.Errorf("result.HasErrors = false, want true")
+		}
+		if len(result.Results) != 100 {
+			t.Errorf("len(result.Results) = %d, want 100", len(result.Results))
+		}
+	})
+
+	t.Run("OnResult replaces collected results", func(t *testing.T) {
+		channel, _ := newBroadcastTestChannel(t, ChannelOptions{BroadcastWorkers: 4}, 20, 0)
+
+		var mutex sync.Mutex
+		seen := map[string]bool{}
+		result := channel.Broadcast("scores/1", []byte(`{"home":1}`), &ChannelBroadcastOptions{
+			OnResult: func(result BroadcastSendResult) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				seen[result.Context.Client.Id] = true
+			},
+		})
+
+		if len(seen) != 20 {
+			t.Errorf("OnResult was called for %d clients, want 20", len(seen))
+		}
+		if result.Results != nil {
+			t.Errorf("result.Results = %v, want nil", result.Results)
+		}
+		if result.Sent != 20 {
+			t.Errorf("result.Sent = %d, want 20", result.Sent)
+		}
+	})
+
+	t.Run("Recipients share the encoded envelope", func(t *testing.T) {
+		store := ChannelStore{}
+		store.init(func(err *Error) {})
+		channel := store.Register("scores/:match", ChannelHandlers{})
+
+		var messages [][]byte
+		for i := 0; i < 2; i++ {
+			store.Subscribe(&Client{Id: strconv.Itoa(i), sendMessage: func(message []byte) error {
+				messages = append(messages, message)
+				return nil
+			}}, "scores/1")
+		}
+
+		channel.Broadcast("scores/1", []byte(`{"home":1}`), nil)
+
+		if len(messages) != 2 {
+			t.Fatalf("len(messages) = %d, want 2", len(messages))
+		}
+		if &messages[0][0] != &messages[1][0] {
+			t.Errorf("envelope was encoded per recipient, want once")
+		}
+		if want := `{"type":"message","channel":"scores/1","payload":{"home":1}}`; string(messages[0]) != want {
+			t.Errorf("message = %s, want %s", messages[0], want)
+		}
+	})
+
+	t.Run("BroadcastAsync", func(t *testing.T) {
+		channel, delivered := newBroadcastTestChannel(t, ChannelOptions{}, 10, 0)
+
+		future := channel.BroadcastAsync("scores/1", []byte(`{"home":2}`), nil)
+		<-future.Done()
+
+		if result := future.Wait(); result.Sent != 10 {
+			t.Errorf("result.Sent = %d, want 10", result.Sent)
+		}
+		if *delivered != 10 {
+			t.Errorf("delivered = %d, want 10", *delivered)
+		}
+	})
+
+	t.Run("Expiry", func(t *testing.T) {
+		store := ChannelStore{}
+		store.init(func(err *Error) {})
+		channel := store.Register("sensors/:id", ChannelHandlers{})
+
+		var messages []Message
+		store.Subscribe(&Client{Id: "1", sendMessage: func(data []byte) error {
+			var message Message
+			_ = json.Unmarshal(data, &message)
+			messages = append(messages, message)
+			return nil
+		}}, "sensors/1")
+
+		expiresAt := time.Now().Add(time.Minute)
+		channel.Broadcast("sensors/1", []byte(`21.5`), &ChannelBroadcastOptions{SendOptions: SendOptions{ExpiresAt: expiresAt}})
+		res := channel.Broadcast("sensors/1", []byte(`21.6`), &ChannelBroadcastOptions{SendOptions: SendOptions{ExpiresAt: time.Now().Add(-time.Second)}})
+		if res.Sent != 0 || res.Expired != 1 || !res.Results[0].Expired {
+			t.Errorf("Broadcast(...) = {Sent: %d, Expired: %d}, want the expired message not to count as sent", res.Sent, res.Expired)
+		}
+		channel.Broadcast("sensors/1", []byte(`21.7`), &ChannelBroadcastOptions{SendOptions: SendOptions{TTL: time.Minute}})
+
+		if len(messages) != 2 {
+			t.Fatalf("received %d messages, want 2", len(messages))
+		}
+		if messages[0].ExpiresAt != expiresAt.UnixMilli() {
+			t.Errorf("messages[0].ExpiresAt = %d, want %d", messages[0].ExpiresAt, expiresAt.UnixMilli())
+		}
+		if messages[1].ExpiresAt < time.Now().Add(59*time.Second).UnixMilli() {
+			t.Errorf("messages[1].ExpiresAt = %d, want about a minute from now", messages[1].ExpiresAt)
+		}
+	})
+}
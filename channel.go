@@ -1,7 +1,11 @@
 package pts
 
 import (
+	stdcontext "context"
+	"fmt"
+	"runtime/debug"
 	"strings"
+	"time"
 )
 
 // channelPathSep describes the separator of paths in a channel name. e.g 'stream/123' is separated by channelPathSep
@@ -17,20 +21,105 @@ type EventHandlerFunc func(s *Context)
 // MessageHandlerFunc is a function that executes when a message is sent to the Channel.
 type MessageHandlerFunc func(s *Context, message *Message)
 
+// EventHandlerErrFunc is a variant of EventHandlerFunc that can fail.
+// OnSubscribeE is executed after the client was subscribed, a returned error does not end the subscription.
+// Use a SubscriptionMiddleware to reject subscriptions.
+type EventHandlerErrFunc func(s *Context) error
+
+// MessageHandlerErrFunc is a variant of MessageHandlerFunc that can fail.
+type MessageHandlerErrFunc func(s *Context, message *Message) error
+
+// EventHandlerCtxFunc is a variant of EventHandlerErrFunc, that receives the context of the handler call.
+// The context is cancelled when the handler returns, the subscription ends or the HandlerTimeout of the Channel expires.
+type EventHandlerCtxFunc func(ctx stdcontext.Context, s *Context) error
+
+// MessageHandlerCtxFunc is a variant of MessageHandlerErrFunc, that receives the context of the handler call.
+type MessageHandlerCtxFunc func(ctx stdcontext.Context, s *Context, message *Message) error
+
+// SendErrorHandlerFunc is a function that is executed when sending to a subscriber of the Channel failed.
+type SendErrorHandlerFunc func(s *Context, err *Error)
+
 // ChannelHandlers contains all handler functions for various events in the Channel.
+// Errors returned by the error returning variants are passed to the ErrorHandlerFunc and reported to the client.
+// If several variants of a handler are set, all of them are executed.
 type ChannelHandlers struct {
 	OnSubscribe             EventHandlerFunc
+	OnSubscribeE            EventHandlerErrFunc
+	OnSubscribeCtx          EventHandlerCtxFunc
 	OnUnsubscribe           EventHandlerFunc
+	OnUnsubscribeE          EventHandlerErrFunc
+	OnUnsubscribeCtx        EventHandlerCtxFunc
 	OnMessage               MessageHandlerFunc
+	OnMessageE              MessageHandlerErrFunc
+	OnMessageCtx            MessageHandlerCtxFunc
 	SubscriptionMiddlewares []SubscriptionMiddleware
+	OnSendError             SendErrorHandlerFunc
+}
+
+// PanicPolicy describes how a panic in a handler or middleware is treated after it was recovered.
+// The recovered panic is always passed to the ErrorHandlerFunc as an Error with code ErrorHandlerPanic.
+type PanicPolicy struct {
+	// ReportToClient sends a generic ErrorHandlerPanic error to the client of the affected Context.
+	ReportToClient bool
+	// DisconnectClient disconnects the client of the affected Context.
+	DisconnectClient bool
+	// OnPanic is called for every recovered panic, e.g. to increment a metric.
+	OnPanic func(err *Error)
+}
+
+// ChannelOptions contains optional configuration of a Channel.
+type ChannelOptions struct {
+	// HandlerTimeout limits the lifetime of the context passed to the handler variants with a context, e.g.
+	// OnMessageCtx. Zero means no timeout.
+	HandlerTimeout time.Duration
+	// OutboundInterceptors are executed for every payload sent to a subscriber, after the interceptors of the TubeSystem.
+	OutboundInterceptors []OutboundInterceptor
+	// InheritClientProperties makes Context.Get fall back to the properties of the Client.
+	InheritClientProperties bool
+	// SubscriberShards splits the subscriptions by path into shards with separate locks, which reduces lock contention
+	// for channels with many concurrently used paths. Zero means a single shard.
+	SubscriberShards int
+	// DeliveryPolicy is the default DeliveryPolicy of all subscriptions.
+	DeliveryPolicy *DeliveryPolicy
+	// AllowClientDeliveryPolicy lets clients request a DeliveryPolicy in the payload of their subscribe message,
+	// e.g. {"delivery": {"conflationKey": "symbol", "maxRate": 10}}.
+	AllowClientDeliveryPolicy bool
+	// Coalesce coalesces publishes to each concrete path, e.g. to debounce updates.
+	Coalesce *CoalesceOptions
+	// SendFailurePolicy retries failed sends and removes subscribers that keep failing.
+	SendFailurePolicy *SendFailurePolicy
+	// QueueGroups lets clients join queue groups with the payload of their subscribe message, e.g. {"group": "workers"}.
+	// Subscriptions can always join groups with Context.JoinGroup.
+	QueueGroups *QueueGroupOptions
+	// Deduplication drops inbound messages whose IdempotencyKey was already seen.
+	Deduplication *DeduplicationOptions
+	// AssignMetadata lets the server assign the metadata of messages. Inbound messages get an id if they have
+	// none and the receive time as Timestamp. Outbound messages get an id and the send time as Timestamp, unless
+	// the SendOptions set them. The Sender of inbound messages is always the id of their client.
+	AssignMetadata bool
+	// Chunking splits large payloads of Context.Send and Broadcast into fragments, which clients reassemble.
+	Chunking *ChunkOptions
+	// BroadcastWorkers is the number of goroutines a broadcast fans out to. Zero or one sends serially in the
+	// goroutine of the caller.
+	BroadcastWorkers int
 }
 
 // Channel describes a room, websocket users can subscribe and sent messages to.
 type Channel struct {
 	path        []string
 	handlers    ChannelHandlers
+	options     ChannelOptions
 	subscribers ChannelSubscribers
 	onError     ErrorHandlerFunc
+	store       *ChannelStore
+	coalescer   coalescer
+	groups      queueGroups
+	dedup       deduplicator
+}
+
+// Path returns the path the Channel was registered with.
+func (c *Channel) Path() string {
+	return strings.Join(c.path, channelPathSep)
 }
 
 // PathMatches returns true and the params of the channel subscription if the path matches the path of the Channel.
@@ -55,33 +144,206 @@ func (c *Channel) PathMatches(path string) (bool, map[string]string) {
 	return true, params
 }
 
+// call executes a handler for the given Context and recovers it from panics.
+// It returns the recovered panic as Error, after it has been handled according to the PanicPolicy.
+func (c *Channel) call(context *Context, handler func()) *Error {
+	return c.callCtx(context, func(stdcontext.Context) {
+		handler()
+	})
+}
+
+// callCtx executes a handler like call and passes it the context of the handler call.
+func (c *Channel) callCtx(context *Context, handler func(ctx stdcontext.Context)) (panicErr *Error) {
+	ctx, end := context.handlerContext(c.options.HandlerTimeout)
+	defer end()
+	defer func() {
+		if r := recover(); r != nil {
+			panicErr = c.recovered(context, r, debug.Stack())
+		}
+	}()
+	handler(ctx)
+	return nil
+}
+
+// recovered converts a recovered panic into an Error and applies the PanicPolicy.
+func (c *Channel) recovered(context *Context, r interface{}, stack []byte) *Error {
+	raw, _ := r.(error)
+	err := NewError(context, ErrorHandlerPanic, fmt.Sprintf("recovered panic in handler: %v", r), raw)
+	err.Stack = stack
+
+	policy := c.store.getPanicPolicy()
+
+	if policy.OnPanic != nil {
+		policy.OnPanic(err)
+	}
+	c.error(err)
+	if policy.ReportToClient {
+		if err := context.SendError(NewError(context, ErrorHandlerPanic, "internal error", nil)); err != nil {
+			c.error(err)
+		}
+	}
+	if policy.DisconnectClient && context.Client != nil {
+		if err := context.Client.Disconnect(); err != nil {
+			c.error(NewError(context, ErrorDisconnectFailed, "failed to disconnect client after panic", err))
+		}
+	}
+	return err
+}
+
+// plugins returns the plugins installed in the TubeSystem of the Channel.
+func (c *Channel) plugins() *plugins {
+	if c == nil {
+		return nil
+	}
+	return c.store.getPlugins()
+}
+
+// intercept executes the outbound interceptors of the TubeSystem and the Channel for a payload sent to target.
+func (c *Channel) intercept(target *Context, payload []byte) ([]byte, bool) {
+	if c == nil {
+		return payload, true
+	}
+	payload, deliver := c.store.getInterceptors().apply(target, payload)
+	if !deliver {
+		return nil, false
+	}
+	return applyInterceptors(c.options.OutboundInterceptors, target, payload)
+}
+
+// error passes an Error to the ErrorHandlerFunc of the Channel.
+func (c *Channel) error(err *Error) {
+	if c.onError != nil {
+		c.onError(err)
+	}
+}
+
+// reportError passes an Error to the ErrorHandlerFunc and sends it to the client of the Context.
+func (c *Channel) reportError(context *Context, err *Error) {
+	c.error(err)
+	if err := context.SendError(err); err != nil {
+		c.error(err)
+	}
+}
+
+// callE executes an error returning handler and reports a returned error.
+func (c *Channel) callE(context *Context, handler func(ctx stdcontext.Context) error) {
+	var err error
+	if panicErr := c.callCtx(context, func(ctx stdcontext.Context) {
+		err = handler(ctx)
+	}); panicErr != nil || err == nil {
+		return
+	}
+
+	if context.Client != nil && context.Client.Err() != nil {
+		c.error(AsError(context, err))
+		return
+	}
+	c.reportError(context, AsError(context, err))
+}
+
 // Subscribe executes the Channels middlewares and(if successful) adds the user to the Channel and executes the channels OnSubscribe handler.
 func (c *Channel) Subscribe(context *Context) {
+	c.subscribe(context)
+}
+
+// subscribe subscribes the client like Subscribe and reports whether it was subscribed. A client that is already
+// subscribed to the path keeps its subscription, and a client that left in the meantime is not subscribed.
+func (c *Channel) subscribe(context *Context) bool {
+	context.open()
+	if c.subscribers.IsSubscribed(context.Client.Id, context.FullPath) {
+		context.close()
+		return false
+	}
+
 	for _, middleware := range c.handlers.SubscriptionMiddlewares {
-		if err := middleware(context); err != nil {
-			c.onError(err)
-			if err := context.SendError(err); err != nil {
-				c.onError(err)
-			}
-			return
+		var err *Error
+		if panicErr := c.call(context, func() {
+			err = middleware(context)
+		}); panicErr != nil {
+			context.close()
+			return false
+		}
+		if err != nil {
+			c.reportError(context, err)
+			context.close()
+			return false
 		}
 	}
 
-	c.subscribers.Add(context)
+	var pluginErr *Error
+	if panicErr := c.call(context, func() {
+		pluginErr = c.plugins().onSubscribe(context)
+	}); panicErr != nil {
+		context.close()
+		return false
+	}
+	if pluginErr != nil {
+		c.reportError(context, pluginErr)
+		context.close()
+		return false
+	}
+
+	if !c.subscribers.add(context) {
+		// a concurrent subscribe of the client won
+		context.close()
+		return false
+	}
+	if context.Err() != nil {
+		// the client left while the subscription was set up, after its subscriptions were removed
+		c.subscribers.removeContext(context)
+		context.close()
+		return false
+	}
 
 	if c.handlers.OnSubscribe != nil {
-		c.handlers.OnSubscribe(context)
+		c.call(context, func() {
+			c.handlers.OnSubscribe(context)
+		})
+	}
+	if c.handlers.OnSubscribeE != nil {
+		c.callE(context, func(stdcontext.Context) error {
+			return c.handlers.OnSubscribeE(context)
+		})
 	}
+	if c.handlers.OnSubscribeCtx != nil {
+		c.callE(context, func(ctx stdcontext.Context) error {
+			return c.handlers.OnSubscribeCtx(ctx, context)
+		})
+	}
+	return true
 }
 
-// HandleMessage executes the channels OnMessage method if it exists.
+// HandleMessage executes the channels OnMessage methods if they exist.
 func (c *Channel) HandleMessage(client *Client, message *Message) {
-	if c.handlers.OnMessage == nil {
+	if c.handlers.OnMessage == nil && c.handlers.OnMessageE == nil && c.handlers.OnMessageCtx == nil && c.options.Deduplication == nil {
 		return
 	}
 
-	if context, ok := c.subscribers.GetContext(client.Id, message.Channel); ok {
-		c.handlers.OnMessage(context, message)
+	context, ok := c.subscribers.GetContext(client.Id, message.Channel)
+	if !ok {
+		return
+	}
+	c.stampInbound(client, message, time.Now())
+	if !c.deduplicate(context, message) {
+		c.acknowledge(context, message)
+		return
+	}
+	defer c.acknowledge(context, message)
+
+	if c.handlers.OnMessage != nil {
+		c.call(context, func() {
+			c.handlers.OnMessage(context, message)
+		})
+	}
+	if c.handlers.OnMessageE != nil {
+		c.callE(context, func(stdcontext.Context) error {
+			return c.handlers.OnMessageE(context, message)
+		})
+	}
+	if c.handlers.OnMessageCtx != nil {
+		c.callE(context, func(ctx stdcontext.Context) error {
+			return c.handlers.OnMessageCtx(ctx, context, message)
+		})
 	}
 }
 
@@ -90,11 +352,26 @@ func (c *Channel) GetAllSubscribers() []*Context {
 	return c.subscribers.GetAll()
 }
 
+// RangeSubscribers calls fn for each subscriber of a snapshot of the subscribers until fn returns false
+func (c *Channel) RangeSubscribers(fn func(context *Context) bool) {
+	c.subscribers.Range(fn)
+}
+
 // GetSubscribers returns subscribers for the given path
 func (c *Channel) GetSubscribers(path string) []*Context {
 	return c.subscribers.GetAllForPath(path)
 }
 
+// SubscriberCount returns the number of subscribers for the given path
+func (c *Channel) SubscriberCount(path string) int {
+	return c.subscribers.Count(path)
+}
+
+// Paths returns all paths of the channel that have at least one subscriber
+func (c *Channel) Paths() []string {
+	return c.subscribers.Paths()
+}
+
 // IsSubscribed returns true if the client is connected to the channel
 func (c *Channel) IsSubscribed(clientId string, path string) bool {
 	return c.subscribers.IsSubscribed(clientId, path)
@@ -104,87 +381,69 @@ func (c *Channel) FindContext(clientId string, path string) (*Context, bool) {
 	return c.subscribers.GetContext(clientId, path)
 }
 
-// Unsubscribe removes the client from the channel and executes the OnUnsubscribe handler
+// Unsubscribe removes the client from the channel and executes the OnUnsubscribe handler with UnsubscribeReasonServerKick
 func (c *Channel) Unsubscribe(clientId string, path string) bool {
-	context, isSubscriber := c.subscribers.GetContext(clientId, path)
-	if !isSubscriber {
+	return c.UnsubscribeWithReason(clientId, path, UnsubscribeReasonServerKick)
+}
+
+// UnsubscribeWithReason removes the client from the channel and executes the OnUnsubscribe handler with the given reason
+func (c *Channel) UnsubscribeWithReason(clientId string, path string, reason UnsubscribeReason) bool {
+	// only the caller that removed the subscription executes the handlers, concurrent calls return false
+	context := c.subscribers.Remove(clientId, path)
+	if context == nil {
 		return false
 	}
 
-	c.subscribers.Remove(clientId, path)
-	if c.handlers.OnUnsubscribe != nil {
-		c.handlers.OnUnsubscribe(context)
-	}
+	c.unsubscribed(context, reason)
 
 	return true
 }
 
-// UnsubscribeAllPaths unsubscribes a client from all paths of the channel they are connected to.
+// UnsubscribeAllPaths unsubscribes a client from all paths of the channel they are connected to with UnsubscribeReasonServerKick.
 func (c *Channel) UnsubscribeAllPaths(clientId string) bool {
+	return c.UnsubscribeAllPathsWithReason(clientId, UnsubscribeReasonServerKick)
+}
+
+// UnsubscribeAllPathsWithReason unsubscribes a client from all paths of the channel they are connected to with the given reason.
+func (c *Channel) UnsubscribeAllPathsWithReason(clientId string, reason UnsubscribeReason) bool {
 	removed := c.subscribers.RemoveAllPaths(clientId)
 
-	if c.handlers.OnUnsubscribe != nil {
-		for _, context := range removed {
-			c.handlers.OnUnsubscribe(context)
-		}
+	for _, context := range removed {
+		c.unsubscribed(context, reason)
 	}
 
 	return true
 }
 
-type ChannelBroadcastOptions struct {
-	SkipClientIds []string
-}
-
-func (o *ChannelBroadcastOptions) shouldSkip(id string) bool {
-	for _, clientId := range o.SkipClientIds {
-		if clientId == id {
-			return true
-		}
+// unsubscribeAll unsubscribes all clients from all paths of the channel.
+func (c *Channel) unsubscribeAll(reason UnsubscribeReason) {
+	for _, context := range c.GetAllSubscribers() {
+		c.UnsubscribeWithReason(context.Client.Id, context.FullPath, reason)
 	}
-	return false
 }
 
-type ChannelBroadcastResult struct {
-	HasErrors bool
-	Results   []*BroadcastSendResult
-}
-
-type BroadcastSendResult struct {
-	Skipped bool
-	Context *Context
-	Err     *Error
-}
-
-func (c *Channel) Broadcast(fullPath string, payload []byte, options *ChannelBroadcastOptions) *ChannelBroadcastResult {
-	res := &ChannelBroadcastResult{
-		HasErrors: false,
-		Results:   []*BroadcastSendResult{},
+// unsubscribed executes the OnUnsubscribe handler for a removed Context and cancels its context afterwards.
+func (c *Channel) unsubscribed(context *Context, reason UnsubscribeReason) {
+	context.setUnsubscribeReason(reason)
+	if c.handlers.OnUnsubscribe != nil {
+		c.call(context, func() {
+			c.handlers.OnUnsubscribe(context)
+		})
 	}
-
-	for _, context := range c.GetSubscribers(fullPath) {
-		if options != nil && options.shouldSkip(context.Client.Id) {
-			res.Results = append(res.Results, &BroadcastSendResult{
-				Context: context,
-				Skipped: true,
-			})
-			continue
-		}
-
-		if err := context.Send(payload); err != nil {
-			res.Results = append(res.Results, &BroadcastSendResult{
-				Context: context,
-				Err:     err,
-				Skipped: false,
-			})
-			res.HasErrors = true
-		} else {
-			res.Results = append(res.Results, &BroadcastSendResult{
-				Context: context,
-				Skipped: false,
-			})
-		}
+	if c.handlers.OnUnsubscribeE != nil {
+		c.callE(context, func(stdcontext.Context) error {
+			return c.handlers.OnUnsubscribeE(context)
+		})
 	}
-
-	return res
+	if c.handlers.OnUnsubscribeCtx != nil {
+		c.callE(context, func(ctx stdcontext.Context) error {
+			return c.handlers.OnUnsubscribeCtx(ctx, context)
+		})
+	}
+	c.call(context, func() {
+		c.plugins().onUnsubscribe(context, reason)
+	})
+	context.close()
+	c.leaveGroup(context)
+	c.store.getScheduler().unsubscribed(context, c.SubscriberCount(context.FullPath) == 0)
 }
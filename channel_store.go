@@ -1,13 +1,20 @@
 package pts
 
 import (
+	"encoding/json"
 	"strings"
+	"sync"
 )
 
-// ChannelStore stores pointers to all Channels
+// ChannelStore stores pointers to all Channels, it is safe for concurrent use.
 type ChannelStore struct {
 	channels     map[string]*Channel
 	errorHandler ErrorHandlerFunc
+	panicPolicy  PanicPolicy
+	plugins      *plugins
+	interceptors outboundInterceptors
+	scheduler    scheduler
+	mutex        sync.RWMutex
 }
 
 func (s *ChannelStore) init(errorHandler ErrorHandlerFunc) {
@@ -15,21 +22,68 @@ func (s *ChannelStore) init(errorHandler ErrorHandlerFunc) {
 	s.errorHandler = errorHandler
 }
 
-func (s *ChannelStore) Register(path string, handlers ChannelHandlers) *Channel {
+func (s *ChannelStore) setPanicPolicy(policy PanicPolicy) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.panicPolicy = policy
+}
+
+func (s *ChannelStore) getPanicPolicy() PanicPolicy {
+	if s == nil {
+		return PanicPolicy{}
+	}
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return s.panicPolicy
+}
+
+func (s *ChannelStore) getPlugins() *plugins {
+	if s == nil {
+		return nil
+	}
+	return s.plugins
+}
+
+func (s *ChannelStore) getInterceptors() *outboundInterceptors {
+	if s == nil {
+		return nil
+	}
+	return &s.interceptors
+}
+
+func (s *ChannelStore) getScheduler() *scheduler {
+	if s == nil {
+		return nil
+	}
+	return &s.scheduler
+}
+
+// Register adds a new Channel to the store, only the first ChannelOptions are applied.
+func (s *ChannelStore) Register(path string, handlers ChannelHandlers, options ...ChannelOptions) *Channel {
 	channel := Channel{
 		path:        strings.Split(path, channelPathSep),
 		handlers:    handlers,
 		subscribers: ChannelSubscribers{},
 		onError:     s.errorHandler,
+		store:       s,
+	}
+	if len(options) > 0 {
+		channel.options = options[0]
 	}
-	channel.subscribers.init()
+	channel.subscribers.initShards(channel.options.SubscriberShards)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	s.channels[path] = &channel
 	return &channel
 }
 
 // Get finds a channel with a matching path.
 func (s *ChannelStore) Get(path string) (bool, *Channel, map[string]string) {
-	if found, channel := s.GetByExactPath(path); found {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if channel, found := s.channels[path]; found {
 		return true, channel, map[string]string{}
 	}
 
@@ -44,10 +98,32 @@ func (s *ChannelStore) Get(path string) (bool, *Channel, map[string]string) {
 
 // GetByExactPath finds a channel by its exact path name.
 func (s *ChannelStore) GetByExactPath(path string) (bool, *Channel) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
 	channel, found := s.channels[path]
 	return found, channel
 }
 
+// All returns a snapshot of all channels.
+func (s *ChannelStore) All() []*Channel {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	channels := make([]*Channel, 0, len(s.channels))
+	for _, channel := range s.channels {
+		channels = append(channels, channel)
+	}
+	return channels
+}
+
+// Range calls fn for each channel of a snapshot of the store until fn returns false.
+func (s *ChannelStore) Range(fn func(channel *Channel) bool) {
+	for _, channel := range s.All() {
+		if !fn(channel) {
+			return
+		}
+	}
+}
+
 func (s *ChannelStore) OnMessage(client *Client, message *Message) {
 	if ok, channel, _ := s.Get(message.Channel); ok {
 		channel.HandleMessage(client, message)
@@ -57,28 +133,80 @@ func (s *ChannelStore) OnMessage(client *Client, message *Message) {
 }
 
 func (s *ChannelStore) Subscribe(client *Client, channelPath string) bool {
-	if found, channel, params := s.Get(channelPath); found {
-		channel.Subscribe(&Context{
-			Client:     client,
-			FullPath:   channelPath,
-			Channel:    channel,
-			params:     params,
-			properties: map[string]interface{}{},
-		})
+	return s.subscribe(client, channelPath, nil)
+}
+
+// subscribe subscribes the client with the payload of its subscribe message.
+func (s *ChannelStore) subscribe(client *Client, channelPath string, payload json.RawMessage) bool {
+	found, channel, params := s.Get(channelPath)
+	if !found {
+		return false
+	}
+	context := &Context{
+		Client:     client,
+		FullPath:   channelPath,
+		Channel:    channel,
+		params:     params,
+		properties: map[string]interface{}{},
+	}
+	request := &subscribeRequest{}
+	if channel.options.AllowClientDeliveryPolicy || channel.options.QueueGroups != nil {
+		var err error
+		if request, err = parseSubscribeRequest(payload); err != nil {
+			channel.reportError(context, NewError(context, ErrorInvalidMessage, "invalid subscribe request", err))
+			return false
+		}
+	}
+	if request.Delivery != nil && channel.options.AllowClientDeliveryPolicy {
+		context.SetDeliveryPolicy(request.Delivery.clientPolicy())
+	}
+	if !channel.subscribe(context) {
 		return true
 	}
-	return false
+	if request.Group != "" && channel.options.QueueGroups != nil {
+		context.JoinGroup(request.Group)
+	}
+	return true
 }
 
+// Ack acknowledges a message that was sent to a member of a queue group.
+func (s *ChannelStore) Ack(client *Client, message *Message) {
+	found, channel, _ := s.Get(message.Channel)
+	if !found {
+		s.errorHandler(NewError(nil, ErrorUnknownChannel, "unknown channel on websocket ack: '"+message.Channel+"'", nil))
+		return
+	}
+	if context, subscribed := channel.subscribers.GetContext(client.Id, message.Channel); subscribed {
+		channel.ack(context, message.Id)
+	}
+}
+
+// Unsubscribe unsubscribes the client on its own request.
 func (s *ChannelStore) Unsubscribe(clientId string, channelPath string) bool {
 	if found, channel, _ := s.Get(channelPath); found {
-		return channel.Unsubscribe(clientId, channelPath)
+		return channel.UnsubscribeWithReason(clientId, channelPath, UnsubscribeReasonClientRequest)
 	}
 	return false
 }
 
-func (s *ChannelStore) UnsubscribeAll(clientId string) {
-	for _, channel := range s.channels {
-		channel.UnsubscribeAllPaths(clientId)
+func (s *ChannelStore) UnsubscribeAll(clientId string, reason UnsubscribeReason) {
+	for _, channel := range s.All() {
+		channel.UnsubscribeAllPathsWithReason(clientId, reason)
+	}
+}
+
+// Unregister removes the Channel with the exact path and unsubscribes all of its subscribers.
+func (s *ChannelStore) Unregister(path string) bool {
+	s.mutex.Lock()
+	channel, found := s.channels[path]
+	delete(s.channels, path)
+	s.mutex.Unlock()
+
+	if !found {
+		return false
 	}
+	channel.coalescer.stop()
+	channel.unsubscribeAll(UnsubscribeReasonChannelUnregistered)
+	s.scheduler.unregistered(channel)
+	return true
 }
@@ -1,7 +1,9 @@
 package pts
 
 import (
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -75,3 +77,62 @@ func TestChannelSubscribe(t *testing.T) {
 		}
 	})
 }
+
+func TestChannelStoreConcurrency(t *testing.T) {
+	t.Run("Register while subscribing", func(t *testing.T) {
+		store := ChannelStore{}
+		store.init(func(err *Error) {})
+		store.Register("example/:id", ChannelHandlers{})
+
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(2)
+			go func(i int) {
+				defer wg.Done()
+				store.Register("lazy/"+strconv.Itoa(i), ChannelHandlers{})
+			}(i)
+			go func(i int) {
+				defer wg.Done()
+				client := &Client{Id: strconv.Itoa(i)}
+				store.Subscribe(client, "example/"+strconv.Itoa(i))
+				store.Range(func(channel *Channel) bool {
+					channel.RangeSubscribers(func(context *Context) bool {
+						return true
+					})
+					return true
+				})
+				store.UnsubscribeAll(client.Id, UnsubscribeReasonClientDisconnect)
+			}(i)
+		}
+		wg.Wait()
+
+		if len(store.All()) != 9 {
+			t.Errorf("len(store.All()) = %d, want 9", len(store.All()))
+		}
+	})
+
+	t.Run("Range stops when fn returns false", func(t *testing.T) {
+		store := ChannelStore{}
+		store.init(func(err *Error) {})
+		store.Register("example/a", ChannelHandlers{})
+		store.Register("example/b", ChannelHandlers{})
+
+		calls := 0
+		store.Range(func(channel *Channel) bool {
+			calls++
+			return false
+		})
+		if calls != 1 {
+			t.Errorf("fn was called %d times, want 1", calls)
+		}
+
+		paths := map[string]bool{}
+		store.Range(func(channel *Channel) bool {
+			paths[channel.Path()] = true
+			return true
+		})
+		if !paths["example/a"] || !paths["example/b"] {
+			t.Errorf("Range visited %v, want example/a and example/b", paths)
+		}
+	})
+}
@@ -1,10 +1,14 @@
 package pts
 
 import (
+	stdcontext "context"
 	"encoding/json"
 	"errors"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func contains(s []*Context, e *Context) bool {
@@ -101,7 +105,7 @@ func TestChannelPathMatch(t *testing.T) {
 	t.Run("Subscribe Middleware throws error", func(t *testing.T) {
 		simplePath := []string{"example", "path", "simple"}
 		testId := "ABC123"
-		testErrCode := 999
+		testErrCode := ErrorCode(999)
 		testErrDescription := "Unauthorized"
 
 		var onErrResult *Error
@@ -146,14 +150,14 @@ func TestChannelPathMatch(t *testing.T) {
 
 		if errMessage == nil {
 			t.Errorf("sendMessage was not called, want sendMessage to be called")
-		} else if errMessage["type"] != MessageTypeChannelMessage || errMessage["channel"] != testContext.FullPath {
-			t.Errorf("sendMessage was called with {type: %s, channel: %s}, want {type: %s, channel: %s}", errMessage["type"], errMessage["channel"], MessageTypeChannelMessage, testContext.FullPath)
+		} else if errMessage["type"] != MessageTypeError || errMessage["channel"] != testContext.FullPath {
+			t.Errorf("sendMessage was called with {type: %s, channel: %s}, want {type: %s, channel: %s}", errMessage["type"], errMessage["channel"], MessageTypeError, testContext.FullPath)
 		} else if errMessage["payload"] == nil {
 			t.Errorf("sendMessage was called with message.payload = nil, want message.payload != nil")
 		}
 
 		errPayload := errMessage["payload"].(map[string]interface{})
-		if int(errPayload["code"].(float64)) != testErrCode || errPayload["description"] != testErrDescription {
+		if ErrorCode(errPayload["code"].(float64)) != testErrCode || errPayload["description"] != testErrDescription {
 			t.Errorf("sendMessage was called with {payload: {code: %d, description: %s}}, want {payload: {code: %d, description: %s}}", errPayload["code"], errPayload["description"], testErrCode, testErrDescription)
 		}
 	})
@@ -161,7 +165,7 @@ func TestChannelPathMatch(t *testing.T) {
 	t.Run("Subscribe Middleware & client throws error", func(t *testing.T) {
 		simplePath := []string{"example", "path", "simple"}
 		testId := "ABC123"
-		testErrCode := 999
+		testErrCode := ErrorCode(999)
 		testErrDescription := "Unauthorized"
 
 		var onErrResults []*Error
@@ -209,6 +213,291 @@ func TestChannelPathMatch(t *testing.T) {
 		}
 	})
 
+	t.Run("Handler context respects HandlerTimeout", func(t *testing.T) {
+		testPath := "example/path"
+		var handlerErr error
+		var deadlineSet bool
+
+		channel := Channel{
+			path: strings.Split(testPath, channelPathSep),
+			handlers: ChannelHandlers{
+				OnSubscribeCtx: func(ctx stdcontext.Context, s *Context) error {
+					_, deadlineSet = ctx.Deadline()
+					<-ctx.Done()
+					handlerErr = ctx.Err()
+					return nil
+				},
+			},
+			options:     ChannelOptions{HandlerTimeout: 10 * time.Millisecond},
+			subscribers: ChannelSubscribers{},
+		}
+		channel.subscribers.init()
+
+		context := &Context{FullPath: testPath, Client: &Client{Id: "ABC123"}}
+		channel.Subscribe(context)
+
+		if !deadlineSet {
+			t.Errorf("ctx.Deadline() returned no deadline, want deadline")
+		}
+		if handlerErr == nil {
+			t.Errorf("ctx.Err() = nil, want deadline exceeded")
+		}
+		if context.Err() != nil {
+			t.Errorf("context.Err() = %v, want nil", context.Err())
+		}
+	})
+
+	t.Run("Concurrent handler calls have their own handler context", func(t *testing.T) {
+		testPath := "example/path"
+		started := make(chan stdcontext.Context)
+		release := make(chan struct{})
+		var handled []*Context
+
+		channel := Channel{
+			path: strings.Split(testPath, channelPathSep),
+			handlers: ChannelHandlers{
+				OnMessageCtx: func(ctx stdcontext.Context, s *Context, message *Message) error {
+					handled = append(handled, s)
+					if string(message.Payload) == "slow" {
+						started <- ctx
+						<-release
+					}
+					return nil
+				},
+			},
+			subscribers: ChannelSubscribers{},
+		}
+		channel.subscribers.init()
+
+		client := &Client{Id: "ABC123"}
+		context := &Context{FullPath: testPath, Client: client}
+		channel.Subscribe(context)
+
+		done := make(chan struct{})
+		go func() {
+			channel.HandleMessage(client, &Message{Channel: testPath, Payload: []byte("slow")})
+			close(done)
+		}()
+		slow := <-started
+		channel.HandleMessage(client, &Message{Channel: testPath, Payload: []byte("fast")})
+
+		if err := slow.Err(); err != nil {
+			t.Errorf("ctx.Err() of the running call = %v, want nil", err)
+		}
+		close(release)
+		<-done
+
+		if err := slow.Err(); err == nil {
+			t.Errorf("ctx.Err() of the returned call = nil, want canceled")
+		}
+		if context.Err() != nil {
+			t.Errorf("context.Err() = %v, want nil", context.Err())
+		}
+		if len(handled) != 2 || handled[0] != context || handled[1] != context {
+			t.Errorf("handlers were called with %v, want the Context of the subscription", handled)
+		}
+	})
+
+	t.Run("Panicking handlers are recovered", func(t *testing.T) {
+		testPath := "example/path"
+		var onErrResults []*Error
+
+		channel := Channel{
+			path: strings.Split(testPath, channelPathSep),
+			handlers: ChannelHandlers{
+				OnMessage: func(s *Context, message *Message) {
+					s.MustGet("missing")
+				},
+			},
+			subscribers: ChannelSubscribers{},
+			onError: func(e *Error) {
+				onErrResults = append(onErrResults, e)
+			},
+		}
+		channel.subscribers.init()
+
+		testClient := &Client{Id: "ABC123"}
+		channel.Subscribe(&Context{FullPath: testPath, Client: testClient})
+		channel.HandleMessage(testClient, &Message{Type: MessageTypeChannelMessage, Channel: testPath})
+
+		if len(onErrResults) != 1 {
+			t.Errorf("onErr was called %d times, want 1", len(onErrResults))
+			return
+		}
+		if onErrResults[0].Code != ErrorHandlerPanic {
+			t.Errorf("onErr was called with Error{Code=%d}, want Error{Code=%d}", onErrResults[0].Code, ErrorHandlerPanic)
+		}
+		if len(onErrResults[0].Stack) == 0 {
+			t.Errorf("onErr was called with an Error without stack, want stack")
+		}
+	})
+
+	t.Run("Panicking middleware prevents subscription", func(t *testing.T) {
+		testPath := "example/path"
+		var onErrResult *Error
+
+		channel := Channel{
+			path: strings.Split(testPath, channelPathSep),
+			handlers: ChannelHandlers{
+				SubscriptionMiddlewares: []SubscriptionMiddleware{
+					func(s *Context) *Error {
+						var client *Client
+						return NewError(s, 999, client.Id, nil)
+					},
+				},
+			},
+			subscribers: ChannelSubscribers{},
+			onError: func(e *Error) {
+				onErrResult = e
+			},
+		}
+		channel.subscribers.init()
+
+		context := &Context{FullPath: testPath, Client: &Client{Id: "ABC123"}}
+		channel.Subscribe(context)
+
+		if channel.IsSubscribed("ABC123", testPath) {
+			t.Errorf("channel.IsSubscribed(%s, %s) = true, want false", "ABC123", testPath)
+		}
+		if onErrResult == nil || onErrResult.Code != ErrorHandlerPanic {
+			t.Errorf("onErr was called with %v, want Error{Code=%d}", onErrResult, ErrorHandlerPanic)
+		}
+		if context.Err() == nil {
+			t.Errorf("context.Err() = nil, want context to be cancelled")
+		}
+	})
+
+	t.Run("Errors of error returning handlers are reported", func(t *testing.T) {
+		testPath := "example/path"
+		testErrCode := ErrorCode(999)
+		var onErrResults []*Error
+		var errMessages []map[string]interface{}
+
+		channel := Channel{
+			path: strings.Split(testPath, channelPathSep),
+			handlers: ChannelHandlers{
+				OnSubscribeE: func(s *Context) error {
+					return NewError(s, testErrCode, "Not allowed", nil)
+				},
+				OnMessageE: func(s *Context, message *Message) error {
+					return errors.New("database unavailable")
+				},
+			},
+			subscribers: ChannelSubscribers{},
+			onError: func(e *Error) {
+				onErrResults = append(onErrResults, e)
+			},
+		}
+		channel.subscribers.init()
+
+		testClient := &Client{Id: "ABC123", sendMessage: func(message []byte) error {
+			var errMessage map[string]interface{}
+			_ = json.Unmarshal(message, &errMessage)
+			errMessages = append(errMessages, errMessage)
+			return nil
+		}}
+		channel.Subscribe(&Context{FullPath: testPath, Client: testClient})
+		channel.HandleMessage(testClient, &Message{Type: MessageTypeChannelMessage, Channel: testPath})
+
+		if len(onErrResults) != 2 || len(errMessages) != 2 {
+			t.Errorf("onErr was called %d times and %d messages were sent, want 2 each", len(onErrResults), len(errMessages))
+			return
+		}
+
+		wantCodes := []ErrorCode{testErrCode, ErrorHandlerFailed}
+		for i, want := range wantCodes {
+			if onErrResults[i].Code != want {
+				t.Errorf("onErr was called with Error{Code=%d}, want Error{Code=%d}", onErrResults[i].Code, want)
+			}
+			if errMessages[i]["type"] != MessageTypeError || errMessages[i]["channel"] != testPath {
+				t.Errorf("sendMessage was called with {type: %s, channel: %s}, want {type: %s, channel: %s}", errMessages[i]["type"], errMessages[i]["channel"], MessageTypeError, testPath)
+			}
+			payload := errMessages[i]["payload"].(map[string]interface{})
+			if ErrorCode(payload["code"].(float64)) != want {
+				t.Errorf("sendMessage was called with {payload: {code: %v}}, want {payload: {code: %d}}", payload["code"], want)
+			}
+		}
+		if payload := errMessages[1]["payload"].(map[string]interface{}); payload["description"] != ErrHandlerFailed.Description {
+			t.Errorf("sendMessage was called with {payload: {description: %v}}, want the generic description", payload["description"])
+		}
+		if !channel.IsSubscribed(testClient.Id, testPath) {
+			t.Errorf("channel.IsSubscribed(%s, %s) = false, want an OnSubscribeE error to keep the subscription", testClient.Id, testPath)
+		}
+	})
+
+	t.Run("Concurrent unsubscribes execute OnUnsubscribe once", func(t *testing.T) {
+		testPath := "example/path"
+		var unsubscribeCount int32
+
+		channel := Channel{
+			path: strings.Split(testPath, channelPathSep),
+			handlers: ChannelHandlers{
+				OnUnsubscribe: func(s *Context) {
+					atomic.AddInt32(&unsubscribeCount, 1)
+				},
+			},
+			subscribers: ChannelSubscribers{},
+		}
+		channel.subscribers.init()
+		channel.Subscribe(&Context{FullPath: testPath, Client: &Client{Id: "ABC123"}})
+
+		var removed int32
+		var wg sync.WaitGroup
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if channel.Unsubscribe("ABC123", testPath) {
+					atomic.AddInt32(&removed, 1)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if removed != 1 || unsubscribeCount != 1 {
+			t.Errorf("Unsubscribe returned true %d times and OnUnsubscribe was called %d times, want 1", removed, unsubscribeCount)
+		}
+	})
+
+	t.Run("Duplicate subscribes keep the first subscription", func(t *testing.T) {
+		testPath := "example/path"
+		subscribeCount := 0
+
+		channel := Channel{
+			path: strings.Split(testPath, channelPathSep),
+			handlers: ChannelHandlers{
+				OnSubscribe: func(s *Context) {
+					subscribeCount++
+				},
+			},
+			subscribers: ChannelSubscribers{},
+		}
+		channel.subscribers.init()
+
+		client := &Client{Id: "ABC123"}
+		first := &Context{FullPath: testPath, Client: client}
+		second := &Context{FullPath: testPath, Client: client}
+		channel.Subscribe(first)
+		channel.Subscribe(second)
+		if context, _ := channel.subscribers.GetContext(client.Id, testPath); context != first || subscribeCount != 1 {
+			t.Errorf("OnSubscribe was called %d times, want 1 and the first Context to stay subscribed", subscribeCount)
+		}
+		if second.Err() == nil {
+			t.Errorf("second.Err() = nil, want the duplicate Context to be closed")
+		}
+		channel.Unsubscribe(client.Id, testPath)
+		if first.Err() == nil {
+			t.Errorf("first.Err() = nil after Unsubscribe, want canceled")
+		}
+
+		left := &Client{Id: "DEF456"}
+		left.close()
+		channel.Subscribe(&Context{FullPath: testPath, Client: left})
+		if channel.IsSubscribed(left.Id, testPath) || subscribeCount != 1 {
+			t.Errorf("channel.IsSubscribed(%s, %s) = true, want clients that left not to be subscribed", left.Id, testPath)
+		}
+	})
+
 	t.Run("Unsubscribe all", func(t *testing.T) {
 		testPath := []string{"example", "path", ":var"}
 		testParams := []string{"foo", "bar", "var"}
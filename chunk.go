@@ -0,0 +1,372 @@
+package pts
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Chunk identifies a fragment of a chunked transfer, a payload that was split into several messages.
+type Chunk struct {
+	TransferId string `json:"transferId"`
+	Index      int    `json:"index"`
+	Total      int    `json:"total"`
+	// Size is the size of the reassembled payload in bytes.
+	Size int `json:"size"`
+	// Binary is set if the reassembled payload is opaque bytes instead of JSON.
+	Binary bool `json:"binary,omitempty"`
+}
+
+// ChunkOptions configures the fragmentation of large payloads.
+// Fragments are sent in binary frames if the connection supports them, JSON payloads included, and base64 encoded
+// otherwise. They are written directly to the client and bypass the DeliveryPolicy of the subscription.
+type ChunkOptions struct {
+	// MaxSize is the maximum size of the encoded payload of a message in bytes, larger payloads are split into
+	// fragments. On connections without binary frames, binary payloads and fragments are measured base64 encoded.
+	// If the outbound queue drops a fragment, the whole transfer is dropped and the client is told to discard it.
+	MaxSize int
+}
+
+// TransferProgress describes the state of a chunked transfer after a fragment was received.
+type TransferProgress struct {
+	TransferId string
+	Channel    string
+	Received   int // Received is the number of received fragments.
+	Total      int
+	Bytes      int // Bytes is the number of received payload bytes.
+	Size       int
+}
+
+// Done reports whether all fragments of the transfer were received.
+func (p TransferProgress) Done() bool {
+	return p.Received == p.Total
+}
+
+var errInvalidChunk = errors.New("invalid chunk")
+
+// Reassembler reassembles the fragments of chunked transfers, it is safe for concurrent use.
+type Reassembler struct {
+	// MaxSize is the maximum size of a reassembled payload in bytes. Zero means no limit.
+	MaxSize int
+	// MaxTransfers is the maximum number of incomplete transfers. Zero means no limit.
+	MaxTransfers int
+	// MaxFragments is the maximum number of fragments of a transfer. Zero means no limit.
+	MaxFragments int
+	// Timeout discards incomplete transfers that did not receive a fragment for the given duration. Zero means no timeout.
+	Timeout time.Duration
+	// OnProgress is called after each received fragment.
+	OnProgress func(progress TransferProgress)
+	transfers  map[string]*transfer
+	mutex      sync.Mutex
+}
+
+// reassemblyLimits are the limits a fragment is added with.
+type reassemblyLimits struct {
+	maxSize      int
+	maxTransfers int
+	maxFragments int
+	timeout      time.Duration
+}
+
+type transfer struct {
+	envelope Message
+	chunk    Chunk
+	pieces   map[int][]byte
+	bytes    int
+	updated  time.Time
+}
+
+// Add adds a message to its transfer. It returns the reassembled message once all fragments were added and nil
+// before. Messages that are not fragments are returned as they are. Retransmitted fragments are ignored.
+func (r *Reassembler) Add(message *Message) (*Message, error) {
+	limits := reassemblyLimits{maxSize: r.MaxSize, maxTransfers: r.MaxTransfers, maxFragments: r.MaxFragments, timeout: r.Timeout}
+	return r.add(message, limits, r.OnProgress)
+}
+
+// add adds a message to its transfer like Add, but with the given limits and progress callback instead of the fields.
+func (r *Reassembler) add(message *Message, limits reassemblyLimits, onProgress func(progress TransferProgress)) (*Message, error) {
+	chunk := message.Chunk
+	if chunk == nil {
+		return message, nil
+	}
+	if chunk.TransferId == "" || chunk.Total < 1 || chunk.Index < 0 || chunk.Index >= chunk.Total || chunk.Size < 0 ||
+		(chunk.Total > chunk.Size && chunk.Total > 1) {
+		return nil, fmt.Errorf("%w: fragment %d of %d with size %d", errInvalidChunk, chunk.Index, chunk.Total, chunk.Size)
+	}
+	if limits.maxSize > 0 && chunk.Size > limits.maxSize {
+		r.Cancel(chunk.TransferId)
+		return nil, fmt.Errorf("%w: transfer exceeds max size", errInvalidChunk)
+	}
+	if limits.maxFragments > 0 && chunk.Total > limits.maxFragments {
+		r.Cancel(chunk.TransferId)
+		return nil, fmt.Errorf("%w: transfer exceeds max fragments", errInvalidChunk)
+	}
+	piece, err := message.Bytes()
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	r.mutex.Lock()
+	r.expire(now, limits.timeout)
+	t, found := r.transfers[chunk.TransferId]
+	if !found {
+		if limits.maxTransfers > 0 && len(r.transfers) >= limits.maxTransfers {
+			r.mutex.Unlock()
+			return nil, fmt.Errorf("%w: too many transfers", errInvalidChunk)
+		}
+		t = &transfer{envelope: *message, chunk: *chunk, pieces: map[int][]byte{}}
+		t.envelope.Payload, t.envelope.Chunk, t.envelope.Encoding = nil, nil, ""
+		if r.transfers == nil {
+			r.transfers = map[string]*transfer{}
+		}
+		r.transfers[chunk.TransferId] = t
+	}
+	if _, duplicate := t.pieces[chunk.Index]; duplicate {
+		r.mutex.Unlock()
+		return nil, nil
+	}
+	if t.chunk.Total != chunk.Total || t.chunk.Size != chunk.Size || t.bytes+len(piece) > chunk.Size {
+		delete(r.transfers, chunk.TransferId)
+		r.mutex.Unlock()
+		return nil, fmt.Errorf("%w: fragment %d does not match its transfer", errInvalidChunk, chunk.Index)
+	}
+	t.pieces[chunk.Index] = append([]byte{}, piece...)
+	t.bytes += len(piece)
+	t.updated = now
+	progress := TransferProgress{
+		TransferId: chunk.TransferId,
+		Channel:    t.envelope.Channel,
+		Received:   len(t.pieces),
+		Total:      chunk.Total,
+		Bytes:      t.bytes,
+		Size:       chunk.Size,
+	}
+	var reassembled *Message
+	if progress.Done() {
+		delete(r.transfers, chunk.TransferId)
+		if t.bytes != chunk.Size {
+			r.mutex.Unlock()
+			return nil, fmt.Errorf("%w: fragments do not add up to the size of the transfer", errInvalidChunk)
+		}
+		reassembled = t.reassemble()
+	}
+	r.mutex.Unlock()
+
+	if onProgress != nil {
+		onProgress(progress)
+	}
+	return reassembled, nil
+}
+
+// Cancel discards an incomplete transfer, it reports whether the transfer was found.
+func (r *Reassembler) Cancel(transferId string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	_, found := r.transfers[transferId]
+	delete(r.transfers, transferId)
+	return found
+}
+
+// expire discards transfers that did not receive a fragment for the timeout. The caller must hold the lock.
+func (r *Reassembler) expire(now time.Time, timeout time.Duration) {
+	if timeout <= 0 {
+		return
+	}
+	for id, t := range r.transfers {
+		if now.Sub(t.updated) > timeout {
+			delete(r.transfers, id)
+		}
+	}
+}
+
+// reassemble joins the pieces of a complete transfer.
+func (t *transfer) reassemble() *Message {
+	payload := make([]byte, 0, t.chunk.Size)
+	for i := 0; i < t.chunk.Total; i++ {
+		payload = append(payload, t.pieces[i]...)
+	}
+	message := t.envelope
+	message.Payload = payload
+	if t.chunk.Binary {
+		message.Encoding = PayloadEncodingBinary
+	}
+	return &message
+}
+
+// chunkSize returns the maximum size of a fragment payload for the client, or zero if the payload is not chunked.
+// The payload is chunked if its encoded size exceeds MaxSize, binary payloads are base64 encoded without binary frames.
+func (c *Channel) chunkSize(payload []byte, binary bool, frame bool) int {
+	if c == nil || c.options.Chunking == nil || c.options.Chunking.MaxSize <= 0 {
+		return 0
+	}
+	encoded := len(payload)
+	if binary && !frame {
+		encoded = base64.StdEncoding.EncodedLen(len(payload))
+	}
+	if encoded <= c.options.Chunking.MaxSize {
+		return 0
+	}
+	size := c.options.Chunking.MaxSize
+	if !frame {
+		// base64 encodes 3 bytes as 4 characters
+		size = size / 4 * 3
+	}
+	if size < 1 {
+		size = 1
+	}
+	return size
+}
+
+// outboundTransfer is an encoded chunked transfer, it is shared by all recipients of a broadcast with the same kind
+// of connection.
+type outboundTransfer struct {
+	id        string
+	payload   []byte
+	fragments []outbound
+}
+
+// encodeTransfer splits the payload of the envelope into fragments of the given size and encodes them, in binary
+// frames or base64 encoded.
+func encodeTransfer(envelope Message, size int, frame bool, options *SendOptions, expiresAt time.Time) (*outboundTransfer, error) {
+	payload := envelope.Payload
+	total := (len(payload) + size - 1) / size
+	transfer := &outboundTransfer{id: newMessageId(), payload: payload, fragments: make([]outbound, 0, total)}
+	for index := 0; index < total; index++ {
+		end := (index + 1) * size
+		if end > len(payload) {
+			end = len(payload)
+		}
+		fragment := envelope
+		fragment.Payload = payload[index*size : end]
+		fragment.Chunk = &Chunk{TransferId: transfer.id, Index: index, Total: total, Size: len(payload), Binary: options.binary()}
+		data, err := encodeChannelMessage(&fragment, true, frame)
+		if err != nil {
+			return nil, err
+		}
+		transfer.fragments = append(transfer.fragments, outbound{data: data, binary: frame, payload: fragment.Payload,
+			transfer: transfer.id, priority: options.priority(), expiresAt: expiresAt})
+	}
+	return transfer, nil
+}
+
+// sendChunks splits the payload of the envelope into fragments of the given size and writes them to the client.
+func (context *Context) sendChunks(envelope Message, size int, options *SendOptions, expiresAt time.Time) *Error {
+	transfer, err := encodeTransfer(envelope, size, context.Client.supportsBinary(), options, expiresAt)
+	if err != nil {
+		return NewError(context, ErrorSendingMessageFailed, "failed to send error to client", err)
+	}
+	return context.sendTransfer(transfer)
+}
+
+// sendTransfer writes the fragments of a transfer to the client. If a fragment fails, the transfer is cancelled.
+// It stops early, if the client or its queue cancelled the transfer in the meantime.
+func (context *Context) sendTransfer(transfer *outboundTransfer) *Error {
+	context.Channel.plugins().onOutbound(context, transfer.payload)
+
+	client := context.Client
+	client.beginTransfer(transfer.id)
+	defer client.endTransfer(transfer.id)
+	for index, message := range transfer.fragments {
+		if client.transferCancelled(transfer.id) {
+			return nil
+		}
+		if err := context.transmit(message); err != nil {
+			if index > 0 {
+				client.cancelTransfer(context.FullPath, transfer.id)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// beginTransfer registers an outbound transfer, so that it can be cancelled while its fragments are sent.
+func (client *Client) beginTransfer(transferId string) {
+	client.stateMutex.Lock()
+	defer client.stateMutex.Unlock()
+	if client.sending == nil {
+		client.sending = map[string]bool{}
+	}
+	client.sending[transferId] = false
+}
+
+func (client *Client) endTransfer(transferId string) {
+	client.stateMutex.Lock()
+	defer client.stateMutex.Unlock()
+	delete(client.sending, transferId)
+}
+
+// transferCancelled reports whether the outbound transfer was cancelled while its fragments are sent.
+func (client *Client) transferCancelled(transferId string) bool {
+	client.stateMutex.RLock()
+	defer client.stateMutex.RUnlock()
+	return client.sending[transferId]
+}
+
+// stopTransfer marks an outbound transfer as cancelled, if its fragments are still being sent.
+func (client *Client) stopTransfer(transferId string) {
+	client.stateMutex.Lock()
+	defer client.stateMutex.Unlock()
+	if _, found := client.sending[transferId]; found {
+		client.sending[transferId] = true
+	}
+}
+
+// cancelTransfer drops the queued fragments of an outbound transfer and tells the client to discard the transfer.
+func (client *Client) cancelTransfer(channel string, transferId string) {
+	client.stopTransfer(transferId)
+	if client.queue != nil {
+		client.queue.cancel(transferId)
+	}
+	client.sendCancel(channel, transferId)
+}
+
+// sendCancel tells the client to discard a transfer, whose fragments were not all sent.
+func (client *Client) sendCancel(channel string, transferId string) {
+	if data, err := encodeCancelMessage(channel, transferId); err == nil {
+		_ = client.send(outbound{data: data, priority: PriorityHigh})
+	}
+}
+
+// cancelTransfers cancels the inbound transfer and the outbound transfer with the id, on request of the client.
+func (client *Client) cancelTransfers(transferId string) {
+	client.stateMutex.RLock()
+	transfers := client.transfers
+	client.stateMutex.RUnlock()
+	if transfers != nil {
+		transfers.Cancel(transferId)
+	}
+	client.stopTransfer(transferId)
+	if client.queue != nil {
+		client.queue.cancel(transferId)
+	}
+}
+
+func encodeCancelMessage(channel string, transferId string) ([]byte, error) {
+	return json.Marshal(Message{Type: MessageTypeCancel, Channel: channel, Chunk: &Chunk{TransferId: transferId}})
+}
+
+// reassembler returns the Reassembler of the inbound transfers of the client.
+func (client *Client) reassembler() *Reassembler {
+	client.stateMutex.Lock()
+	defer client.stateMutex.Unlock()
+	if client.transfers == nil {
+		client.transfers = &Reassembler{}
+	}
+	return client.transfers
+}
+
+// reassemble adds an inbound fragment of the client to its transfer, with the limits of the current options.
+func (client *Client) reassemble(message *Message, options InboundOptions) (*Message, error) {
+	var onProgress func(progress TransferProgress)
+	if callback := options.OnTransferProgress; callback != nil {
+		onProgress = func(progress TransferProgress) {
+			callback(client, progress)
+		}
+	}
+	return client.reassembler().add(message, options.reassemblyLimits(), onProgress)
+}
@@ -0,0 +1,326 @@
+package pts
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fragment encodes a fragment of a chunked transfer, as a client would send it.
+func fragment(path string, transferId string, index int, total int, size int, piece string) []byte {
+	data, _ := json.Marshal([]byte(piece))
+	message, _ := json.Marshal(Message{
+		Type:     MessageTypeChannelMessage,
+		Channel:  path,
+		Payload:  data,
+		Encoding: PayloadEncodingBase64,
+		Chunk:    &Chunk{TransferId: transferId, Index: index, Total: total, Size: size},
+	})
+	return message
+}
+
+func TestChunkedTransfer(t *testing.T) {
+	t.Run("Large payloads are split and reassembled", func(t *testing.T) {
+		connector := NewConnector(nil, nil)
+		tubeSystem := New(connector)
+		channel := tubeSystem.RegisterChannel("docs/:id", ChannelHandlers{}, ChannelOptions{Chunking: &ChunkOptions{MaxSize: 8}})
+		jsonClient := newGroupWorker(connector)
+		binaryClient := newBinaryWorker(connector)
+		connector.Message(jsonClient.client.Id, SubMessage("docs/1"))
+		connector.Message(binaryClient.client.Id, SubMessage("docs/1"))
+
+		snapshot := []byte(`{"title":"snapshot","body":"` + strings.Repeat("x", 20) + `"}`)
+		channel.Broadcast("docs/1", snapshot, &ChannelBroadcastOptions{SendOptions: SendOptions{Id: "s1"}})
+		channel.Broadcast("docs/1", []byte(`"small"`), nil)
+
+		var progress []TransferProgress
+		reassembler := Reassembler{OnProgress: func(p TransferProgress) {
+			progress = append(progress, p)
+		}}
+		received := jsonClient.received()
+		if want := (len(snapshot)+5)/6 + 1; len(received) != want {
+			t.Fatalf("json client received %d messages, want %d fragments of 6 bytes and 1 message", len(received), want)
+		}
+		var messages []*Message
+		for i := range received {
+			if len(received[i].Payload) > 8+2 {
+				t.Errorf("fragment payload %s exceeds MaxSize", received[i].Payload)
+			}
+			if message, err := reassembler.Add(&received[i]); err != nil || message != nil {
+				messages = append(messages, message)
+			}
+		}
+		if len(messages) != 2 || !bytes.Equal(messages[0].Payload, snapshot) || messages[0].Encoding != "" || messages[0].Id != "s1" {
+			t.Fatalf("reassembled = %+v, want the snapshot and the small message", messages)
+		}
+		if string(messages[1].Payload) != `"small"` {
+			t.Errorf("messages[1] = %s, want the small message", messages[1].Payload)
+		}
+		if last := progress[len(progress)-1]; len(progress) != len(received)-1 || !last.Done() || last.Bytes != len(snapshot) {
+			t.Errorf("progress = %+v, want one event per fragment", progress)
+		}
+
+		frames, texts := binaryClient.received()
+		if len(frames) != (len(snapshot)+7)/8 || texts != 1 {
+			t.Fatalf("binary client received %d frames and %d texts, want fragments of 8 bytes and 1 text", len(frames), texts)
+		}
+		reassembler = Reassembler{}
+		for i := range frames {
+			if message, err := reassembler.Add(&frames[i]); err != nil || (message != nil) != (i == len(frames)-1) {
+				t.Fatalf("Add(frames[%d]) = %v, %v", i, message, err)
+			} else if message != nil && !bytes.Equal(message.Payload, snapshot) {
+				t.Errorf("reassembled = %s, want %s", message.Payload, snapshot)
+			}
+		}
+	})
+
+	t.Run("Binary payloads", func(t *testing.T) {
+		store := ChannelStore{}
+		store.init(func(err *Error) {})
+		channel := store.Register("files", ChannelHandlers{}, ChannelOptions{Chunking: &ChunkOptions{MaxSize: 4}})
+		worker := newGroupWorker(NewConnector(nil, nil))
+		store.Subscribe(worker.client, "files")
+		context, _ := channel.subscribers.GetContext(worker.client.Id, "files")
+
+		file := []byte{0, 1, 2, 3, 4, 5, 6}
+		if err := context.SendBinary(file); err != nil {
+			t.Fatalf("SendBinary(...) = %v, want nil", err)
+		}
+		reassembler := Reassembler{}
+		var message *Message
+		for _, received := range worker.received() {
+			received := received
+			message, _ = reassembler.Add(&received)
+		}
+		if message == nil || message.Encoding != PayloadEncodingBinary {
+			t.Fatalf("reassembled = %+v, want a binary message", message)
+		}
+		if data, _ := message.Bytes(); !bytes.Equal(data, file) {
+			t.Errorf("Bytes() = %v, want %v", data, file)
+		}
+	})
+
+	t.Run("Inbound transfers are reassembled before OnMessage", func(t *testing.T) {
+		connector := NewConnector(nil, nil)
+		tubeSystem := New(connector)
+		var handled []string
+		tubeSystem.RegisterChannel("docs", ChannelHandlers{
+			OnMessage: func(s *Context, message *Message) {
+				handled = append(handled, string(message.Payload))
+			},
+		})
+		var progress []TransferProgress
+		tubeSystem.SetInboundOptions(InboundOptions{
+			ReassembleTransfers: true,
+			MaxTransferSize:     16,
+			OnTransferProgress: func(client *Client, p TransferProgress) {
+				progress = append(progress, p)
+			},
+		})
+		worker := newGroupWorker(connector)
+		connector.Message(worker.client.Id, SubMessage("docs"))
+
+		connector.Message(worker.client.Id, fragment("docs", "t1", 1, 2, 7, `:1}`))
+		connector.Message(worker.client.Id, fragment("docs", "t1", 1, 2, 7, `:1}`))
+		connector.Message(worker.client.Id, fragment("docs", "t1", 0, 2, 7, `{"a"`))
+
+		connector.Message(worker.client.Id, fragment("docs", "t2", 0, 2, 4, `"a`))
+		connector.Message(worker.client.Id, []byte(`{"type":"cancel","channel":"docs","chunk":{"transferId":"t2"}}`))
+		connector.Message(worker.client.Id, fragment("docs", "t2", 1, 2, 4, `b"`))
+
+		connector.Message(worker.client.Id, fragment("docs", "t3", 0, 2, 17, strings.Repeat("x", 9)))
+
+		if len(handled) != 1 || handled[0] != `{"a":1}` {
+			t.Errorf("handled = %v, want the reassembled message", handled)
+		}
+		if len(progress) != 4 || !progress[1].Done() || progress[1].Channel != "docs" {
+			t.Errorf("progress = %+v, want 4 events", progress)
+		}
+	})
+
+	t.Run("Inbound reassembly is opt-in and limited", func(t *testing.T) {
+		connector := NewConnector(nil, nil)
+		tubeSystem := New(connector)
+		var handled []string
+		tubeSystem.RegisterChannel("docs", ChannelHandlers{
+			OnMessage: func(s *Context, message *Message) {
+				handled = append(handled, string(message.Payload))
+			},
+		})
+		worker := newGroupWorker(connector)
+		connector.Message(worker.client.Id, SubMessage("docs"))
+
+		connector.Message(worker.client.Id, fragment("docs", "t1", 0, 1, 2, `{}`))
+		if len(handled) != 0 || worker.client.transfers != nil {
+			t.Errorf("handled = %v without ReassembleTransfers, want the fragment to be rejected", handled)
+		}
+
+		tubeSystem.SetInboundOptions(InboundOptions{ReassembleTransfers: true, MaxMessageSize: 256, MaxDepth: 2})
+		connector.Message(worker.client.Id, fragment("docs", "t2", 0, 2, 6, `[[[`))
+		connector.Message(worker.client.Id, fragment("docs", "t2", 1, 2, 6, `]]]`))
+		if len(handled) != 0 {
+			t.Errorf("handled = %v, want the reassembled payload to exceed MaxDepth", handled)
+		}
+
+		// the limits of the current options apply to a client that already reassembled a transfer
+		tubeSystem.SetInboundOptions(InboundOptions{ReassembleTransfers: true, MaxTransferSize: 4})
+		connector.Message(worker.client.Id, fragment("docs", "t3", 0, 2, 6, `"ab`))
+		connector.Message(worker.client.Id, fragment("docs", "t3", 1, 2, 6, `cd"`))
+		if len(handled) != 0 {
+			t.Errorf("handled = %v, want the transfer to exceed MaxTransferSize", handled)
+		}
+
+		want := reassemblyLimits{maxSize: defaultMaxTransferSize, maxTransfers: defaultMaxTransfers,
+			maxFragments: defaultMaxTransferFragments, timeout: defaultTransferTimeout}
+		if limits := (InboundOptions{}).reassemblyLimits(); limits != want {
+			t.Errorf("reassemblyLimits() = %+v, want %+v", limits, want)
+		}
+	})
+
+	t.Run("Cancel drops queued fragments", func(t *testing.T) {
+		connector := NewConnector(nil, nil)
+		tubeSystem := New(connector)
+		tubeSystem.SetQueueOptions(QueueOptions{MaxMessages: 100})
+		channel := tubeSystem.RegisterChannel("docs", ChannelHandlers{}, ChannelOptions{Chunking: &ChunkOptions{MaxSize: 4}})
+		socket := newSlowSocket()
+		client := connector.Join(socket.send, nil)
+		defer connector.Leave(client.Id)
+		connector.Message(client.Id, SubMessage("docs"))
+		fillQueue(t, client)
+
+		channel.Broadcast("docs", []byte(`"`+strings.Repeat("x", 30)+`"`), nil)
+		queued := client.queue.len()
+		var fragment Message
+		client.queue.mutex.Lock()
+		_ = json.Unmarshal(client.queue.lanes[PriorityNormal.lane()][0].data, &fragment)
+		client.queue.mutex.Unlock()
+		connector.Message(client.Id, []byte(`{"type":"cancel","chunk":{"transferId":"`+fragment.Chunk.TransferId+`"}}`))
+
+		if queued < 2 || client.queue.len() != 0 {
+			t.Errorf("queue length = %d before and %d after the cancel, want 0 after", queued, client.queue.len())
+		}
+		socket.release()
+	})
+
+	t.Run("Dropped fragments cancel the transfer", func(t *testing.T) {
+		connector := NewConnector(nil, nil)
+		tubeSystem := New(connector)
+		tubeSystem.SetQueueOptions(QueueOptions{MaxMessages: 4, Policy: SlowConsumerDropOldest})
+		channel := tubeSystem.RegisterChannel("docs", ChannelHandlers{}, ChannelOptions{Chunking: &ChunkOptions{MaxSize: 4}})
+		socket := newSlowSocket()
+		client := connector.Join(socket.send, nil)
+		defer connector.Leave(client.Id)
+		connector.Message(client.Id, SubMessage("docs"))
+		fillQueue(t, client)
+
+		channel.Broadcast("docs", []byte(`"`+strings.Repeat("x", 30)+`"`), nil)
+		if queued := client.queue.len(); queued != 1 {
+			t.Errorf("queue length = %d, want only the cancel message", queued)
+		}
+		socket.release()
+		received := socket.waitFor(t, 2)
+		var cancel Message
+		if err := json.Unmarshal([]byte(received[len(received)-1]), &cancel); err != nil || cancel.Type != MessageTypeCancel ||
+			cancel.Channel != "docs" || cancel.Chunk == nil || cancel.Chunk.TransferId == "" {
+			t.Errorf("received = %v, want a cancel message for the transfer", received)
+		}
+	})
+
+	t.Run("Cancel stops a transfer without a queue", func(t *testing.T) {
+		connector := NewConnector(nil, nil)
+		tubeSystem := New(connector)
+		channel := tubeSystem.RegisterChannel("docs", ChannelHandlers{}, ChannelOptions{Chunking: &ChunkOptions{MaxSize: 4}})
+		var client *Client
+		var fragments int
+		client = connector.Join(func(data []byte) error {
+			var message Message
+			_ = json.Unmarshal(data, &message)
+			if message.Chunk != nil {
+				fragments++
+				connector.Message(client.Id, []byte(`{"type":"cancel","chunk":{"transferId":"`+message.Chunk.TransferId+`"}}`))
+			}
+			return nil
+		}, nil)
+		connector.Message(client.Id, SubMessage("docs"))
+
+		channel.Broadcast("docs", []byte(`"`+strings.Repeat("x", 30)+`"`), nil)
+		if fragments != 1 {
+			t.Errorf("client received %d fragments, want 1 before the cancel", fragments)
+		}
+	})
+
+	t.Run("Broadcast shares the fragments of the encoded payload", func(t *testing.T) {
+		connector := NewConnector(nil, nil)
+		tubeSystem := New(connector)
+		channel := tubeSystem.RegisterChannel("files", ChannelHandlers{}, ChannelOptions{Chunking: &ChunkOptions{MaxSize: 12}})
+		first, second := newGroupWorker(connector), newGroupWorker(connector)
+		binaryClient := newBinaryWorker(connector)
+		for _, client := range []*Client{first.client, second.client, binaryClient.client} {
+			connector.Message(client.Id, SubMessage("files"))
+		}
+
+		file := []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}
+		channel.Broadcast("files", file, &ChannelBroadcastOptions{SendOptions: SendOptions{Binary: true}})
+		a, b := first.received(), second.received()
+		if len(a) < 2 || len(a) != len(b) || a[0].Chunk == nil || b[0].Chunk == nil || a[0].Chunk.TransferId != b[0].Chunk.TransferId {
+			t.Errorf("json clients received %v and %v, want the same fragments of the base64 encoded payload", a, b)
+		}
+		if frames, texts := binaryClient.received(); len(frames) != 1 || frames[0].Chunk != nil || texts != 0 {
+			t.Errorf("binary client received %d frames and %d texts, want 1 unchunked frame", len(frames), texts)
+		}
+	})
+
+	t.Run("Reassembler limits", func(t *testing.T) {
+		fragment := func(id string, index int, total int, size int, piece string) *Message {
+			return &Message{Payload: []byte(piece), Encoding: PayloadEncodingBinary,
+				Chunk: &Chunk{TransferId: id, Index: index, Total: total, Size: size}}
+		}
+		invalid := []*Message{
+			fragment("", 0, 1, 1, "a"),
+			fragment("a", 1, 1, 1, "a"),
+			fragment("a", 0, 0, 0, ""),
+			fragment("a", 0, 5, 2, "a"),
+			fragment("a", 0, 1, 2, "abc"),
+			fragment("a", 0, 1, 2, "a"),
+		}
+		for _, message := range invalid {
+			r := Reassembler{}
+			if _, err := r.Add(message); !errors.Is(err, errInvalidChunk) {
+				t.Errorf("Add(%+v) = %v, want errInvalidChunk", message.Chunk, err)
+			}
+		}
+
+		r := Reassembler{MaxSize: 4, MaxTransfers: 1, MaxFragments: 2, Timeout: time.Hour}
+		if _, err := r.Add(fragment("a", 0, 1, 5, "abcde")); !errors.Is(err, errInvalidChunk) {
+			t.Errorf("Add(size 5) = %v, want errInvalidChunk", err)
+		}
+		if _, err := r.Add(fragment("a", 0, 3, 3, "a")); !errors.Is(err, errInvalidChunk) {
+			t.Errorf("Add(a 0/3) = %v, want errInvalidChunk for too many fragments", err)
+		}
+		if message, err := r.Add(fragment("a", 0, 2, 4, "ab")); message != nil || err != nil {
+			t.Errorf("Add(a 0/2) = %v, %v, want nil, nil", message, err)
+		}
+		if _, err := r.Add(fragment("b", 0, 2, 4, "ab")); !errors.Is(err, errInvalidChunk) {
+			t.Errorf("Add(b 0/2) = %v, want errInvalidChunk for too many transfers", err)
+		}
+		if _, err := r.Add(fragment("a", 1, 3, 4, "cd")); !errors.Is(err, errInvalidChunk) {
+			t.Errorf("Add(a 1/3) = %v, want errInvalidChunk for a mismatched total", err)
+		}
+		if r.Cancel("a") {
+			t.Errorf("Cancel(a) = true, want false, the mismatched fragment discarded the transfer")
+		}
+
+		r.Add(fragment("c", 0, 2, 4, "ab"))
+		r.transfers["c"].updated = time.Now().Add(-2 * time.Hour)
+		if message, err := r.Add(fragment("d", 0, 2, 4, "ab")); message != nil || err != nil {
+			t.Errorf("Add(d 0/2) = %v, %v, want the timed out transfer to be discarded", message, err)
+		}
+		plain := &Message{}
+		if message, err := r.Add(plain); message != plain || err != nil {
+			t.Errorf("Add(message without chunk) = %v, %v, want the message", message, err)
+		}
+	})
+}
@@ -1,25 +1,185 @@
 package pts
 
-import "fmt"
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
 
 type MessageSendFunc func(message []byte) error
 
+// DisconnectFunc closes the underlying connection of a Client.
+type DisconnectFunc func() error
+
 type Client struct {
 	Id          string
 	sendMessage MessageSendFunc
+	sendBinary  MessageSendFunc
+	disconnect  DisconnectFunc
+	queue       *clientQueue
+	transfers   *Reassembler
+	sending     map[string]bool // sending holds the outbound transfers in progress, true if they were cancelled
+	leave       func(reason UnsubscribeReason)
 	properties  map[string]interface{}
+	propsMutex  sync.RWMutex
+	ctx         context.Context
+	cancel      context.CancelFunc
+	ctxOnce     sync.Once
+	leaving     int32
+	reason      UnsubscribeReason
+	rejected    bool
+	stateMutex  sync.RWMutex
 }
 
 func NewClient(sendMessage MessageSendFunc, properties map[string]interface{}) *Client {
-	return &Client{
+	client := &Client{
 		Id:          "",
 		sendMessage: sendMessage,
 		properties:  properties,
 	}
+	client.initContext()
+	return client
+}
+
+func (client *Client) initContext() {
+	client.ctxOnce.Do(func() {
+		client.ctx, client.cancel = context.WithCancel(context.Background())
+	})
+}
+
+// Context returns the context of the client, it is cancelled as soon as the client leaves.
+func (client *Client) Context() context.Context {
+	client.initContext()
+	return client.ctx
+}
+
+// Done returns a channel that is closed as soon as the client leaves.
+func (client *Client) Done() <-chan struct{} {
+	return client.Context().Done()
+}
+
+// Err returns a non nil error if the client already left.
+func (client *Client) Err() error {
+	return client.Context().Err()
+}
+
+// startLeaving marks the client as leaving, it returns false if it already was.
+func (client *Client) startLeaving() bool {
+	return atomic.CompareAndSwapInt32(&client.leaving, 0, 1)
+}
+
+func (client *Client) isLeaving() bool {
+	return atomic.LoadInt32(&client.leaving) == 1
+}
+
+// close cancels the context of the client.
+func (client *Client) close() {
+	client.initContext()
+	client.cancel()
+}
+
+func (client *Client) setDisconnectReason(reason UnsubscribeReason) {
+	client.stateMutex.Lock()
+	defer client.stateMutex.Unlock()
+	client.reason = reason
+}
+
+// DisconnectReason returns why the client left, or UnsubscribeReasonNone if it is still connected.
+func (client *Client) DisconnectReason() UnsubscribeReason {
+	client.stateMutex.RLock()
+	defer client.stateMutex.RUnlock()
+	return client.reason
+}
+
+// Disconnect removes the client from the TubeSystem with UnsubscribeReasonServerKick and closes its connection if the connector supports it.
+func (client *Client) Disconnect() error {
+	return client.DisconnectWithReason(UnsubscribeReasonServerKick)
+}
+
+// DisconnectWithReason removes the client from the TubeSystem with the given reason and closes its connection if the connector supports it.
+// It does nothing if the client is already leaving, e.g. when it is called from a handler executed during the leave.
+func (client *Client) DisconnectWithReason(reason UnsubscribeReason) error {
+	if client.isLeaving() || client.Err() != nil {
+		return nil
+	}
+	if client.leave != nil {
+		client.leave(reason)
+	}
+	if client.disconnect != nil {
+		return client.disconnect()
+	}
+	return nil
 }
 
+// Send sends a message to the client, through its outbound queue if queues are enabled.
 func (client *Client) Send(message []byte) error {
-	return client.sendMessage(message)
+	return client.send(outbound{data: message})
+}
+
+// SendWithOptions sends a message to the client, e.g. with a Priority for its outbound queue.
+func (client *Client) SendWithOptions(message []byte, options *SendOptions) error {
+	return client.send(outbound{data: message, priority: options.priority()})
+}
+
+// send sends an encoded message, a queued message with the same non empty key is replaced instead of queueing both.
+func (client *Client) send(message outbound) error {
+	if client.queue != nil {
+		return client.queue.push(message)
+	}
+	return client.write(message.data, message.binary)
+}
+
+// write writes an encoded message to the connection of the client.
+func (client *Client) write(data []byte, binary bool) error {
+	if binary {
+		return client.sendBinary(data)
+	}
+	return client.sendMessage(data)
+}
+
+// supportsBinary reports whether the connection of the client can send binary frames.
+func (client *Client) supportsBinary() bool {
+	return client != nil && client.sendBinary != nil
+}
+
+// SendError sends an error, that does not belong to a channel, to the client. Errors are sent with PriorityHigh.
+func (client *Client) SendError(error *Error) *Error {
+	return client.sendError(nil, "", error)
+}
+
+func (client *Client) sendError(context *Context, channel string, error *Error) *Error {
+	data, err := json.Marshal(error)
+	if err != nil {
+		return NewError(context, ErrorSendingErrorFailed, "failed to send error to client", err)
+	}
+	message := Message{
+		Type:    MessageTypeError,
+		Channel: channel,
+		Payload: data,
+	}
+	data, err = json.Marshal(message)
+	if err != nil {
+		return NewError(context, ErrorSendingErrorFailed, "failed to send error to client", err)
+	}
+
+	if err = client.send(outbound{data: data, priority: PriorityHigh}); err != nil {
+		return NewError(context, ErrorSendingErrorFailed, "failed to send error to client", err)
+	}
+	return nil
+}
+
+func (client *Client) setRejected() {
+	client.stateMutex.Lock()
+	defer client.stateMutex.Unlock()
+	client.rejected = true
+}
+
+func (client *Client) isRejected() bool {
+	client.stateMutex.RLock()
+	defer client.stateMutex.RUnlock()
+	return client.rejected
 }
 
 func (client *Client) MustGet(key string) interface{} {
@@ -30,6 +190,8 @@ func (client *Client) MustGet(key string) interface{} {
 }
 
 func (client *Client) Get(key string) (value interface{}, exists bool) {
+	client.propsMutex.RLock()
+	defer client.propsMutex.RUnlock()
 	if val, ok := client.properties[key]; ok {
 		return val, ok
 	}
@@ -37,5 +199,10 @@ func (client *Client) Get(key string) (value interface{}, exists bool) {
 }
 
 func (client *Client) Set(key string, value interface{}) {
+	client.propsMutex.Lock()
+	defer client.propsMutex.Unlock()
+	if client.properties == nil {
+		client.properties = map[string]interface{}{}
+	}
 	client.properties[key] = value
 }
@@ -5,6 +5,7 @@ import (
 	"sync"
 )
 
+// ClientStore stores pointers to all connected Clients, it is safe for concurrent use.
 type ClientStore struct {
 	clients map[string]*Client
 	mutex   sync.RWMutex
@@ -14,34 +15,43 @@ func (c *ClientStore) init() {
 	c.clients = map[string]*Client{}
 }
 
+// NextId returns an id that is not used by any client yet.
 func (c *ClientStore) NextId() string {
-	var uuidGen, _ = uuid.NewRandom()
-	uuidString := uuidGen.String()
-	if _, ok := c.clients[uuidString]; ok {
-		return c.NextId()
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	return c.nextId()
+}
+
+// nextId returns an unused id, the caller must hold the mutex.
+func (c *ClientStore) nextId() string {
+	for {
+		var uuidGen, _ = uuid.NewRandom()
+		uuidString := uuidGen.String()
+		if _, ok := c.clients[uuidString]; !ok {
+			return uuidString
+		}
 	}
-	return uuidString
 }
 
 func (c *ClientStore) Join(client *Client) {
 	c.mutex.Lock()
 	defer c.mutex.Unlock()
 	if client.Id == "" {
-		client.Id = c.NextId()
+		client.Id = c.nextId()
 	}
 	c.clients[client.Id] = client
 }
 
 func (c *ClientStore) Exists(id string) bool {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
 	_, exists := c.clients[id]
 	return exists
 }
 
 func (c *ClientStore) Get(id string) *Client {
-	c.mutex.Lock()
-	defer c.mutex.Unlock()
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
 	return c.clients[id]
 }
 
@@ -50,3 +60,23 @@ func (c *ClientStore) Remove(id string) {
 	defer c.mutex.Unlock()
 	delete(c.clients, id)
 }
+
+// All returns a snapshot of all clients.
+func (c *ClientStore) All() []*Client {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+	clients := make([]*Client, 0, len(c.clients))
+	for _, client := range c.clients {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+// Range calls fn for each client of a snapshot of the store until fn returns false.
+func (c *ClientStore) Range(fn func(client *Client) bool) {
+	for _, client := range c.All() {
+		if !fn(client) {
+			return
+		}
+	}
+}
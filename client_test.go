@@ -1,6 +1,8 @@
 package pts
 
 import (
+	"encoding/json"
+	"errors"
 	"testing"
 )
 
@@ -66,4 +68,28 @@ func TestClient(t *testing.T) {
 			t.Errorf("client.Get(\"%s\") = (%s, %s), want (false, nil)", testKey, val, boolStr)
 		}
 	})
+
+	t.Run("Client SendError", func(t *testing.T) {
+		var receivedMessage Message
+		client := NewClient(func(message []byte) error {
+			return json.Unmarshal(message, &receivedMessage)
+		}, map[string]interface{}{})
+
+		if err := client.SendError(NewError(nil, ErrorUnknownType, "unknown type", nil)); err != nil {
+			t.Errorf("client.SendError(...) = %v, want nil", err)
+		}
+
+		var payload Error
+		_ = json.Unmarshal(receivedMessage.Payload, &payload)
+		if receivedMessage.Type != MessageTypeError || receivedMessage.Channel != "" || payload.Code != ErrorUnknownType {
+			t.Errorf("client received {type: %s, channel: %s, code: %d}, want {type: %s, channel: \"\", code: %d}", receivedMessage.Type, receivedMessage.Channel, payload.Code, MessageTypeError, ErrorUnknownType)
+		}
+
+		client = NewClient(func(message []byte) error {
+			return errors.New("disconnected")
+		}, map[string]interface{}{})
+		if err := client.SendError(NewError(nil, ErrorUnknownType, "unknown type", nil)); err == nil || err.Code != ErrorSendingErrorFailed {
+			t.Errorf("client.SendError(...) = %v, want Error{Code: %d}", err, ErrorSendingErrorFailed)
+		}
+	})
 }
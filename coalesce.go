@@ -0,0 +1,187 @@
+package pts
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CoalesceMode decides when coalesced publishes to a path are broadcast.
+type CoalesceMode int
+
+const (
+	CoalesceDebounce CoalesceMode = iota // CoalesceDebounce broadcasts once no publish happened for the window
+	CoalesceThrottle                     // CoalesceThrottle broadcasts at most once per window, the first publish immediately
+)
+
+// CoalesceOptions coalesces publishes to one concrete path of a Channel within a time window.
+// Publishes that skip different clients are coalesced separately, the other broadcast options of the latest publish win.
+type CoalesceOptions struct {
+	Mode   CoalesceMode
+	Window time.Duration
+	// Merge combines the pending payload with the next one. If it is nil, the latest payload wins.
+	// Merge is not called concurrently for the same path and skipped clients.
+	Merge func(pending []byte, next []byte) []byte
+}
+
+type pendingPublish struct {
+	fullPath   string
+	payload    []byte
+	options    *ChannelBroadcastOptions
+	hasPayload bool
+	// released is set once the entry left the coalescer, publishes that raced with the release start a new entry.
+	released   bool
+	timer      *time.Timer
+	generation int
+	// mutex guards payload, options, hasPayload and released, it is held while Merge runs.
+	mutex sync.Mutex
+}
+
+// coalescer holds the pending publishes of a Channel per path and skipped clients.
+type coalescer struct {
+	pending map[string]*pendingPublish
+	mutex   sync.Mutex
+}
+
+// coalesceKey identifies publishes that are coalesced, publishes that skip different clients are kept apart.
+func coalesceKey(fullPath string, options *ChannelBroadcastOptions) string {
+	if options == nil || len(options.SkipClientIds) == 0 {
+		return fullPath
+	}
+	ids := append([]string{}, options.SkipClientIds...)
+	sort.Strings(ids)
+	return fullPath + "\x00" + strings.Join(ids, "\x00")
+}
+
+// publish broadcasts the payload or defers it, it returns nil if the payload was deferred.
+func (c *Channel) publish(fullPath string, payload []byte, options *ChannelBroadcastOptions) *ChannelBroadcastResult {
+	coalesce := c.options.Coalesce
+	co := &c.coalescer
+	key := coalesceKey(fullPath, options)
+
+	for {
+		co.mutex.Lock()
+		if co.pending == nil {
+			co.pending = map[string]*pendingPublish{}
+		}
+		entry, found := co.pending[key]
+
+		if coalesce.Mode == CoalesceThrottle && !found {
+			// leading edge, the window starts now
+			entry = &pendingPublish{fullPath: fullPath}
+			co.pending[key] = entry
+			entry.timer = time.AfterFunc(coalesce.Window, func() {
+				c.flushThrottled(key, entry)
+			})
+			co.mutex.Unlock()
+			return c.broadcast(fullPath, payload, options)
+		}
+		if !found {
+			entry = &pendingPublish{fullPath: fullPath}
+			co.pending[key] = entry
+		}
+		co.mutex.Unlock()
+
+		// Merge runs outside of the lock of the coalescer, so a slow Merge only delays publishes to the same key
+		entry.mutex.Lock()
+		if entry.released {
+			entry.mutex.Unlock()
+			continue
+		}
+		if entry.hasPayload && coalesce.Merge != nil {
+			entry.payload = coalesce.Merge(entry.payload, payload)
+		} else {
+			entry.payload = payload
+		}
+		entry.options = options
+		entry.hasPayload = true
+		entry.mutex.Unlock()
+
+		if coalesce.Mode == CoalesceDebounce {
+			co.mutex.Lock()
+			if co.pending[key] == entry {
+				if entry.timer != nil {
+					entry.timer.Stop()
+				}
+				entry.generation++
+				generation := entry.generation
+				entry.timer = time.AfterFunc(coalesce.Window, func() {
+					c.flushDebounced(key, entry, generation)
+				})
+			}
+			co.mutex.Unlock()
+		}
+		return nil
+	}
+}
+
+// take releases the entry and returns its pending payload.
+func (entry *pendingPublish) take() ([]byte, *ChannelBroadcastOptions, bool) {
+	entry.mutex.Lock()
+	defer entry.mutex.Unlock()
+	entry.released = true
+	return entry.payload, entry.options, entry.hasPayload
+}
+
+// flushDebounced broadcasts the pending payload, unless a later publish restarted the window.
+func (c *Channel) flushDebounced(key string, entry *pendingPublish, generation int) {
+	co := &c.coalescer
+	co.mutex.Lock()
+	if co.pending[key] != entry || entry.generation != generation {
+		co.mutex.Unlock()
+		return
+	}
+	delete(co.pending, key)
+	co.mutex.Unlock()
+
+	if payload, options, found := entry.take(); found {
+		c.broadcast(entry.fullPath, payload, options)
+	}
+}
+
+// flushThrottled broadcasts the pending payload at the end of a window and starts the next window,
+// the path is released if nothing was published during the window.
+func (c *Channel) flushThrottled(key string, entry *pendingPublish) {
+	co := &c.coalescer
+	entry.mutex.Lock()
+	co.mutex.Lock()
+	if co.pending[key] != entry {
+		co.mutex.Unlock()
+		entry.mutex.Unlock()
+		return
+	}
+	if !entry.hasPayload {
+		entry.released = true
+		delete(co.pending, key)
+		co.mutex.Unlock()
+		entry.mutex.Unlock()
+		return
+	}
+	payload, options := entry.payload, entry.options
+	entry.payload, entry.options, entry.hasPayload = nil, nil, false
+	entry.timer = time.AfterFunc(c.options.Coalesce.Window, func() {
+		c.flushThrottled(key, entry)
+	})
+	co.mutex.Unlock()
+	entry.mutex.Unlock()
+
+	c.broadcast(entry.fullPath, payload, options)
+}
+
+// stop drops all pending publishes and stops their timers, e.g. when the Channel is unregistered.
+func (co *coalescer) stop() {
+	co.mutex.Lock()
+	pending := co.pending
+	co.pending = nil
+	for _, entry := range pending {
+		if entry.timer != nil {
+			entry.timer.Stop()
+		}
+	}
+	co.mutex.Unlock()
+
+	for _, entry := range pending {
+		entry.take()
+	}
+}
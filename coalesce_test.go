@@ -0,0 +1,178 @@
+package pts
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func waitForMessages(t *testing.T, received func() []string, count int) []string {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if got := received(); len(got) >= count {
+			return got
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("received = %v, want %d messages", received(), count)
+	return nil
+}
+
+func TestCoalesce(t *testing.T) {
+	t.Run("Debounce broadcasts the latest payload after the window", func(t *testing.T) {
+		store := ChannelStore{}
+		store.init(func(err *Error) {})
+		channel := store.Register("forms/:id", ChannelHandlers{}, ChannelOptions{
+			Coalesce: &CoalesceOptions{Mode: CoalesceDebounce, Window: 20 * time.Millisecond},
+		})
+		_, received := recordingClient(&store, "1", "forms/a")
+
+		for _, payload := range []string{`"h"`, `"he"`, `"hel"`} {
+			if result := channel.Broadcast("forms/a", []byte(payload), nil); !result.Coalesced {
+				t.Errorf("channel.Broadcast(%s).Coalesced = false, want true", payload)
+			}
+		}
+
+		got := waitForMessages(t, received, 1)
+		time.Sleep(40 * time.Millisecond)
+		if got = received(); len(got) != 1 || got[0] != `"hel"` {
+			t.Errorf("received = %v, want [\"hel\"]", got)
+		}
+	})
+
+	t.Run("Throttle broadcasts immediately and once per window", func(t *testing.T) {
+		store := ChannelStore{}
+		store.init(func(err *Error) {})
+		channel := store.Register("forms/:id", ChannelHandlers{}, ChannelOptions{
+			Coalesce: &CoalesceOptions{Mode: CoalesceThrottle, Window: 20 * time.Millisecond},
+		})
+		_, received := recordingClient(&store, "1", "forms/a")
+
+		if result := channel.Broadcast("forms/a", []byte(`1`), nil); result.Coalesced || result.Sent != 1 {
+			t.Errorf("first broadcast = %+v, want it to be sent immediately", result)
+		}
+		channel.Broadcast("forms/a", []byte(`2`), nil)
+		channel.Broadcast("forms/a", []byte(`3`), nil)
+
+		got := waitForMessages(t, received, 2)
+		if got[0] != `1` || got[1] != `3` {
+			t.Errorf("received = %v, want [1 3]", got)
+		}
+	})
+
+	t.Run("Context.Broadcast is coalesced with its options", func(t *testing.T) {
+		store := ChannelStore{}
+		store.init(func(err *Error) {})
+		store.Register("forms/:id", ChannelHandlers{}, ChannelOptions{
+			Coalesce: &CoalesceOptions{Mode: CoalesceDebounce, Window: 10 * time.Millisecond},
+		})
+		owner, ownerReceived := recordingClient(&store, "1", "forms/a")
+		_, otherReceived := recordingClient(&store, "2", "forms/a")
+		context, _ := store.channels["forms/:id"].subscribers.GetContext(owner.Id, "forms/a")
+
+		context.Broadcast([]byte(`1`), &ContextBroadcastOptions{ExcludeContextOwner: true})
+		context.Broadcast([]byte(`2`), &ContextBroadcastOptions{ExcludeContextOwner: true})
+
+		if got := waitForMessages(t, otherReceived, 1); got[0] != `2` {
+			t.Errorf("other client received %v, want [2]", got)
+		}
+		if got := ownerReceived(); len(got) != 0 {
+			t.Errorf("owner received %v, want nothing", got)
+		}
+	})
+
+	t.Run("Merge combines pending payloads", func(t *testing.T) {
+		store := ChannelStore{}
+		store.init(func(err *Error) {})
+		channel := store.Register("forms/:id", ChannelHandlers{}, ChannelOptions{
+			Coalesce: &CoalesceOptions{
+				Mode:   CoalesceDebounce,
+				Window: 10 * time.Millisecond,
+				Merge: func(pending []byte, next []byte) []byte {
+					return bytes.Join([][]byte{pending[:len(pending)-1], next[1:]}, []byte(","))
+				},
+			},
+		})
+		_, received := recordingClient(&store, "1", "forms/a")
+
+		channel.Broadcast("forms/a", []byte(`[1]`), nil)
+		channel.Broadcast("forms/a", []byte(`[2]`), nil)
+		channel.Broadcast("forms/a", []byte(`[3]`), nil)
+
+		if got := waitForMessages(t, received, 1); got[0] != `[1,2,3]` {
+			t.Errorf("received = %v, want [[1,2,3]]", got)
+		}
+	})
+
+	t.Run("Publishes that skip different clients are coalesced separately", func(t *testing.T) {
+		store := ChannelStore{}
+		store.init(func(err *Error) {})
+		channel := store.Register("forms/:id", ChannelHandlers{}, ChannelOptions{
+			Coalesce: &CoalesceOptions{Mode: CoalesceDebounce, Window: 10 * time.Millisecond},
+		})
+		_, firstReceived := recordingClient(&store, "1", "forms/a")
+		_, secondReceived := recordingClient(&store, "2", "forms/a")
+
+		channel.Broadcast("forms/a", []byte(`1`), &ChannelBroadcastOptions{SkipClientIds: []string{"1"}})
+		channel.Broadcast("forms/a", []byte(`2`), &ChannelBroadcastOptions{SkipClientIds: []string{"2"}})
+
+		if got := waitForMessages(t, firstReceived, 1); len(got) != 1 || got[0] != `2` {
+			t.Errorf("client 1 received %v, want [2]", got)
+		}
+		if got := waitForMessages(t, secondReceived, 1); len(got) != 1 || got[0] != `1` {
+			t.Errorf("client 2 received %v, want [1]", got)
+		}
+	})
+
+	t.Run("Merge does not block other paths", func(t *testing.T) {
+		store := ChannelStore{}
+		store.init(func(err *Error) {})
+		merging := make(chan struct{})
+		release := make(chan struct{})
+		channel := store.Register("forms/:id", ChannelHandlers{}, ChannelOptions{
+			Coalesce: &CoalesceOptions{
+				Mode:   CoalesceDebounce,
+				Window: 10 * time.Millisecond,
+				Merge: func(pending []byte, next []byte) []byte {
+					close(merging)
+					<-release
+					return next
+				},
+			},
+		})
+
+		channel.Broadcast("forms/a", []byte(`1`), nil)
+		go channel.Broadcast("forms/a", []byte(`2`), nil)
+		<-merging
+
+		done := make(chan struct{})
+		go func() {
+			channel.Broadcast("forms/b", []byte(`1`), nil)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Errorf("channel.Broadcast(forms/b) blocked on the Merge of forms/a")
+		}
+		close(release)
+	})
+
+	t.Run("Unregister drops pending publishes", func(t *testing.T) {
+		store := ChannelStore{}
+		store.init(func(err *Error) {})
+		channel := store.Register("forms/:id", ChannelHandlers{}, ChannelOptions{
+			Coalesce: &CoalesceOptions{Mode: CoalesceThrottle, Window: time.Hour},
+		})
+		channel.Broadcast("forms/a", []byte(`1`), nil)
+		channel.Broadcast("forms/a", []byte(`2`), nil)
+
+		store.Unregister("forms/:id")
+		channel.coalescer.mutex.Lock()
+		pending := len(channel.coalescer.pending)
+		channel.coalescer.mutex.Unlock()
+		if pending != 0 {
+			t.Errorf("len(pending) = %d after Unregister, want 0", pending)
+		}
+	})
+}
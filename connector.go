@@ -2,30 +2,46 @@ package pts
 
 import (
 	"net/http"
+	"sync"
+	"sync/atomic"
 )
 
 type ConnectHookFunc func(*Client)
 type DisconnectHookFunc func(*Client)
 type MessageHookFunc func(*Client, []byte)
+type ErrorHookFunc func(*Error)
 type RequestHandlerFunc func(writer http.ResponseWriter, request *http.Request, properties map[string]interface{}) error
 
 type Connector struct {
 	requestHandler RequestHandlerFunc
 	errorHandler   ErrorHandlerFunc
 	clients        ClientStore
-	hooks          *Hooks
+	hooks          []*Hooks
+	hooksMutex     sync.RWMutex
+	queueOptions   *QueueOptions
+	queueMemory    queueMemory
+	queueMutex     sync.RWMutex
 }
 
 type Hooks struct {
-	OnConnect    ConnectHookFunc
-	OnDisconnect DisconnectHookFunc
-	OnMessage    MessageHookFunc
+	OnConnect       ConnectHookFunc
+	OnDisconnect    DisconnectHookFunc
+	OnMessage       MessageHookFunc
+	OnBinaryMessage MessageHookFunc
+	OnError         ErrorHookFunc
+}
+
+// JoinOptions contains optional capabilities of a connection that joins the Connector.
+type JoinOptions struct {
+	// Disconnect closes the connection, it is used whenever go-pts needs to drop a client.
+	Disconnect DisconnectFunc
+	// SendBinary sends a binary frame. Without it, binary payloads are sent base64 encoded with sendMessage.
+	SendBinary MessageSendFunc
 }
 
 func NewConnector(requestHandler RequestHandlerFunc, errorHandler ErrorHandlerFunc) *Connector {
 	connector := &Connector{
 		requestHandler: requestHandler,
-		hooks:          &Hooks{},
 		errorHandler:   errorHandler,
 	}
 	connector.clients.init()
@@ -34,35 +50,120 @@ func NewConnector(requestHandler RequestHandlerFunc, errorHandler ErrorHandlerFu
 
 // Join To be triggered if a client connects via ws
 func (c *Connector) Join(sendMessage MessageSendFunc, properties map[string]interface{}) *Client {
+	return c.JoinWithOptions(sendMessage, properties, nil)
+}
+
+// JoinWithOptions To be triggered if a client connects via ws, options describe optional capabilities of the connection
+func (c *Connector) JoinWithOptions(sendMessage MessageSendFunc, properties map[string]interface{}, options *JoinOptions) *Client {
 	client := NewClient(sendMessage, properties)
+	if options != nil {
+		client.disconnect = options.Disconnect
+		client.sendBinary = options.SendBinary
+	}
+	if queueOptions := c.getQueueOptions(); queueOptions != nil {
+		client.queue = newClientQueue(client, *queueOptions, &c.queueMemory, func(err error) {
+			c.error(NewError(nil, ErrorSendingMessageFailed, "failed to send queued message to client", err))
+		})
+	}
 	c.clients.Join(client)
-	if c.hooks.OnConnect != nil {
-		c.hooks.OnConnect(client)
+	client.leave = func(reason UnsubscribeReason) {
+		c.LeaveWithReason(client.Id, reason)
+	}
+	for _, hooks := range c.getHooks() {
+		if hooks.OnConnect != nil {
+			hooks.OnConnect(client)
+		}
 	}
 	return client
 }
 
 func (c *Connector) Message(clientId string, data []byte) {
 	client := c.clients.Get(clientId)
-	if c.hooks.OnMessage != nil {
-		c.hooks.OnMessage(client, data)
+	if client == nil {
+		return
+	}
+	for _, hooks := range c.getHooks() {
+		if hooks.OnMessage != nil {
+			hooks.OnMessage(client, data)
+		}
+	}
+}
+
+// MessageBinary To be triggered if a client sends a binary frame
+func (c *Connector) MessageBinary(clientId string, data []byte) {
+	client := c.clients.Get(clientId)
+	if client == nil {
+		return
+	}
+	for _, hooks := range c.getHooks() {
+		if hooks.OnBinaryMessage != nil {
+			hooks.OnBinaryMessage(client, data)
+		}
 	}
 }
 
+// Leave To be triggered if a client disconnects
 func (c *Connector) Leave(clientId string) {
+	c.LeaveWithReason(clientId, UnsubscribeReasonClientDisconnect)
+}
+
+// LeaveWithReason To be triggered if a client disconnects for a specific reason, e.g. UnsubscribeReasonHeartbeatTimeout
+func (c *Connector) LeaveWithReason(clientId string, reason UnsubscribeReason) {
 	client := c.clients.Get(clientId)
-	if c.hooks.OnDisconnect != nil {
-		c.hooks.OnDisconnect(client)
+	if client == nil {
+		return
+	}
+	if !client.startLeaving() {
+		return
+	}
+	client.setDisconnectReason(reason)
+	client.close()
+	for _, hooks := range c.getHooks() {
+		if hooks.OnDisconnect != nil {
+			hooks.OnDisconnect(client)
+		}
 	}
 	c.clients.Remove(client.Id)
 }
 
+// setQueueOptions enables outbound queues for clients that join afterwards.
+func (c *Connector) setQueueOptions(options QueueOptions) {
+	c.queueMutex.Lock()
+	defer c.queueMutex.Unlock()
+	c.queueOptions = &options
+	atomic.StoreInt64(&c.queueMemory.limit, options.MaxTotalBytes)
+}
+
+func (c *Connector) getQueueOptions() *QueueOptions {
+	c.queueMutex.RLock()
+	defer c.queueMutex.RUnlock()
+	return c.queueOptions
+}
+
 func (c *Connector) error(err *Error) {
+	for _, hooks := range c.getHooks() {
+		if hooks.OnError != nil {
+			hooks.OnError(err)
+		}
+	}
 	if c.errorHandler != nil {
 		c.errorHandler(err)
 	}
 }
 
+// AddHooks registers additional hooks, all registered hooks are executed in the order they were added.
+func (c *Connector) AddHooks(hooks *Hooks) {
+	c.hook(hooks)
+}
+
 func (c *Connector) hook(hooks *Hooks) {
-	c.hooks = hooks
+	c.hooksMutex.Lock()
+	defer c.hooksMutex.Unlock()
+	c.hooks = append(c.hooks, hooks)
+}
+
+func (c *Connector) getHooks() []*Hooks {
+	c.hooksMutex.RLock()
+	defer c.hooksMutex.RUnlock()
+	return c.hooks
 }
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"net/http"
 	"testing"
+	"time"
 )
 
 func TestConnector(t *testing.T) {
@@ -129,4 +130,116 @@ func TestConnector(t *testing.T) {
 			return
 		}
 	})
+	t.Run("Disconnect", func(t *testing.T) {
+		connector := NewConnector(func(writer http.ResponseWriter, request *http.Request, properties map[string]interface{}) error {
+			return nil
+		}, func(_ *Error) {})
+
+		disconnectCount := 0
+		leaveCount := 0
+
+		connector.hook(&Hooks{
+			OnDisconnect: func(client *Client) {
+				leaveCount++
+			},
+		})
+
+		client := connector.JoinWithOptions(func(message []byte) error {
+			return nil
+		}, map[string]interface{}{}, &JoinOptions{
+			Disconnect: func() error {
+				disconnectCount++
+				return nil
+			},
+		})
+
+		if err := client.Disconnect(); err != nil {
+			t.Errorf("client.Disconnect() = %v, want nil", err)
+		}
+		connector.Leave(client.Id)
+
+		if disconnectCount != 1 {
+			t.Errorf("Disconnect func was called %d times, want 1", disconnectCount)
+		}
+		if leaveCount != 1 {
+			t.Errorf("OnDisconnect hook was called %d times, want 1", leaveCount)
+		}
+		if connector.clients.Exists(client.Id) {
+			t.Errorf("connector.clients.Exists(client.Id) = true, want false")
+		}
+	})
+
+	t.Run("Panic during disconnect", func(t *testing.T) {
+		connector := NewConnector(nil, func(_ *Error) {})
+		tubeSystem := New(connector)
+		tubeSystem.SetPanicPolicy(PanicPolicy{DisconnectClient: true})
+		unsubscribeCount := 0
+		tubeSystem.RegisterChannel("example/path", ChannelHandlers{
+			OnUnsubscribe: func(s *Context) {
+				unsubscribeCount++
+				panic("unsubscribe failed")
+			},
+		})
+		disconnectCount := 0
+		client := connector.JoinWithOptions(func(message []byte) error {
+			return nil
+		}, map[string]interface{}{}, &JoinOptions{
+			Disconnect: func() error {
+				disconnectCount++
+				return nil
+			},
+		})
+		connector.Message(client.Id, SubMessage("example/path"))
+
+		done := make(chan struct{})
+		go func() {
+			_ = client.Disconnect()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("client.Disconnect() did not return, want no deadlock")
+		}
+		if unsubscribeCount != 1 || disconnectCount != 1 {
+			t.Errorf("OnUnsubscribe was called %d times and Disconnect %d times, want 1", unsubscribeCount, disconnectCount)
+		}
+		if err := client.Disconnect(); err != nil || disconnectCount != 1 {
+			t.Errorf("client.Disconnect() = %v after leaving, want nil without closing the connection again", err)
+		}
+	})
+
+	t.Run("Multiple hooks", func(t *testing.T) {
+		var errHandlerCalled bool
+		connector := NewConnector(func(writer http.ResponseWriter, request *http.Request, properties map[string]interface{}) error {
+			return nil
+		}, func(_ *Error) {
+			errHandlerCalled = true
+		})
+
+		var events []string
+		connector.hook(&Hooks{
+			OnConnect: func(client *Client) {
+				events = append(events, "connect1")
+			},
+		})
+		connector.AddHooks(&Hooks{
+			OnConnect: func(client *Client) {
+				events = append(events, "connect2")
+			},
+			OnError: func(err *Error) {
+				events = append(events, "error2")
+			},
+		})
+
+		connector.Join(func(message []byte) error { return nil }, map[string]interface{}{})
+		connector.error(NewError(nil, ErrorUnknownType, "unknown type", nil))
+
+		if len(events) != 3 || events[0] != "connect1" || events[1] != "connect2" || events[2] != "error2" {
+			t.Errorf("hooks were called with %v, want [connect1 connect2 error2]", events)
+		}
+		if !errHandlerCalled {
+			t.Errorf("error handler was not called, want it to be called")
+		}
+	})
 }
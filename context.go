@@ -1,48 +1,32 @@
 package pts
 
 import (
+	stdcontext "context"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
+// Context describes the subscription of a Client to a concrete path of a Channel.
+// It implements context.Context, which is cancelled as soon as the subscription ends.
 type Context struct {
-	Client     *Client
-	FullPath   string
-	Channel    *Channel
-	params     map[string]string
-	properties map[string]interface{}
-}
-
-type ErrorHandlerFunc func(*Error)
-
-const (
-	ErrorInvalidMessage       = iota // ErrorInvalidMessage if an incoming message could not be parsed
-	ErrorUnknownType                 // ErrorUnknownType if a message with an unknown type is received
-	ErrorUnknownChannel              // ErrorUnknownChannel if a message to an unknown channel is received or sent
-	ErrorClientNotSubscribed         // ErrorClientNotSubscribed if a message is sent through a channel that is not subscribed by the client
-	ErrorSendingErrorFailed          // ErrorSendingErrorFailed if a error message could not be send to a client
-	ErrorSendingMessageFailed        // ErrorSendingMessageFailed if a message could not be sent to a client
-)
-
-type Error struct {
-	Context     *Context `json:"-"`
-	Code        int      `json:"code"`
-	Description string   `json:"description"`
-	Raw         error    `json:"-"`
-}
-
-func NewError(context *Context, code int, description string, err error) *Error {
-	if err == nil {
-		err = errors.New(description)
-	}
-
-	return &Error{
-		Context:     context,
-		Code:        code,
-		Description: description,
-		Raw:         err,
-	}
+	Client        *Client
+	FullPath      string
+	Channel       *Channel
+	params        map[string]string
+	properties    map[string]interface{}
+	propsMutex    sync.RWMutex
+	ctx           stdcontext.Context
+	cancel        stdcontext.CancelFunc
+	ctxMutex      sync.RWMutex
+	reason        UnsubscribeReason
+	delivery      *deliveryState
+	deliveryMutex sync.Mutex
+	sendFailures  int32
+	group         string
+	inFlight      int
 }
 
 func (context *Context) MustGet(key string) interface{} {
@@ -52,52 +36,271 @@ func (context *Context) MustGet(key string) interface{} {
 	panic(fmt.Sprintf("Key '%s' does not exist", key))
 }
 
+// Get returns a property of the Context. If the Channel sets InheritClientProperties, missing properties are looked up in the Client.
 func (context *Context) Get(key string) (value interface{}, exists bool) {
-	if val, ok := context.properties[key]; ok {
+	context.propsMutex.RLock()
+	val, ok := context.properties[key]
+	context.propsMutex.RUnlock()
+	if ok {
 		return val, ok
 	}
+	if context.Channel != nil && context.Channel.options.InheritClientProperties && context.Client != nil {
+		return context.Client.Get(key)
+	}
 	return nil, false
 }
 
 func (context *Context) Set(key string, value interface{}) {
+	context.propsMutex.Lock()
+	defer context.propsMutex.Unlock()
+	if context.properties == nil {
+		context.properties = map[string]interface{}{}
+	}
 	context.properties[key] = value
 }
 
 func (context *Context) SendError(error *Error) *Error {
-	data, err := json.Marshal(error)
-	if err != nil {
-		return NewError(context, ErrorSendingErrorFailed, "failed to send error to client", err)
+	return context.Client.sendError(context, context.FullPath, error)
+}
+
+func (context *Context) Send(payload []byte) *Error {
+	return context.SendWithOptions(payload, nil)
+}
+
+// SendWithOptions sends a message to the client, e.g. with a Priority for its outbound queue.
+func (context *Context) SendWithOptions(payload []byte, options *SendOptions) *Error {
+	return context.send(payload, "", false, options)
+}
+
+// send sends a message to the client, the id replaces the id of the options in the envelope if it is not empty.
+// A job is a message for one member of a queue group, which must not be dropped by the DeliveryPolicy.
+func (context *Context) send(payload []byte, id string, job bool, options *SendOptions) *Error {
+	if context.Err() != nil {
+		return NewError(context, ErrorContextClosed, "failed to send message to client, context is closed", context.Err())
 	}
-	message := Message{
-		Type:    MessageTypeChannelMessage,
-		Channel: context.FullPath,
-		Payload: data,
+	payload, deliver := context.Channel.intercept(context, payload)
+	if !deliver {
+		return nil
+	}
+	now := time.Now()
+	options = context.Channel.stampOutbound(options, now)
+	expiresAt := options.expiresAt(now)
+	if expired(expiresAt, now) {
+		return nil
+	}
+	envelope := channelEnvelope(context.FullPath, payload, id, options, expiresAt)
+	if size := context.Channel.chunkSize(payload, options.binary(), context.Client.supportsBinary()); size > 0 {
+		return context.sendChunks(envelope, size, options, expiresAt)
 	}
-	data, err = json.Marshal(message)
+	frame := options.binary() && context.Client.supportsBinary()
+	data, err := encodeChannelMessage(&envelope, options.binary(), frame)
 	if err != nil {
-		return NewError(context, ErrorSendingErrorFailed, "failed to send error to client", err)
+		return NewError(context, ErrorSendingMessageFailed, "failed to send error to client", err)
+	}
+	return context.deliver(outbound{data: data, binary: frame, payload: payload, priority: options.priority(), expiresAt: expiresAt, job: job})
+}
+
+// deliver sends an already encoded message to the client, according to the DeliveryPolicy of the subscription.
+// Messages with PriorityHigh and jobs of queue groups bypass the DeliveryPolicy, so they are never sampled or deferred.
+func (context *Context) deliver(message outbound) *Error {
+	if context.Err() != nil {
+		return NewError(context, ErrorContextClosed, "failed to send message to client, context is closed", context.Err())
+	}
+	if message.priority >= PriorityHigh || message.job {
+		return context.write(message)
 	}
+	if delivery := context.deliveryState(); delivery != nil {
+		return delivery.admit(context, message)
+	}
+	return context.write(message)
+}
 
-	if err = context.Client.Send(data); err != nil {
-		return NewError(context, ErrorSendingErrorFailed, "failed to send error to client", err)
+// write passes an encoded message to the client, messages with the same non empty key replace each other in its queue.
+func (context *Context) write(message outbound) *Error {
+	context.Channel.plugins().onOutbound(context, message.payload)
+	return context.transmit(message)
+}
+
+// transmit passes an encoded message to the client like write, but without the outbound plugin hooks.
+// A queued message counts as sent once the queue wrote it.
+func (context *Context) transmit(message outbound) *Error {
+	message.context = context
+	if err := context.Client.send(message); err != nil {
+		return context.failed(message, err)
+	}
+	if context.Client.queue == nil {
+		context.resetFailures()
 	}
 	return nil
 }
 
-func (context *Context) Send(payload []byte) *Error {
+// failed retries a failed send, or applies the SendFailurePolicy once the retries are exhausted.
+func (context *Context) failed(message outbound, err error) *Error {
+	if context.Channel.retry(context, message) {
+		return nil
+	}
+	sendErr := NewError(context, ErrorSendingMessageFailed, "failed to send error to client", err)
+	context.Channel.sendFailed(context, sendErr)
+	return sendErr
+}
+
+func (context *Context) resetFailures() {
+	atomic.StoreInt32(&context.sendFailures, 0)
+}
+
+// SetDeliveryPolicy sets the DeliveryPolicy of the subscription, it replaces the default policy of the Channel.
+func (context *Context) SetDeliveryPolicy(policy DeliveryPolicy) {
+	context.deliveryMutex.Lock()
+	defer context.deliveryMutex.Unlock()
+	if context.delivery != nil {
+		context.delivery.stop()
+	}
+	context.delivery = newDeliveryState(policy)
+}
+
+// DeliveryPolicy returns the DeliveryPolicy of the subscription, if there is one.
+func (context *Context) DeliveryPolicy() (DeliveryPolicy, bool) {
+	if delivery := context.deliveryState(); delivery != nil {
+		return delivery.policy, true
+	}
+	return DeliveryPolicy{}, false
+}
+
+// deliveryState returns the state of the DeliveryPolicy, it falls back to the default policy of the Channel.
+func (context *Context) deliveryState() *deliveryState {
+	context.deliveryMutex.Lock()
+	defer context.deliveryMutex.Unlock()
+	if context.delivery == nil && context.Channel != nil && context.Channel.options.DeliveryPolicy != nil {
+		context.delivery = newDeliveryState(*context.Channel.options.DeliveryPolicy)
+	}
+	return context.delivery
+}
+
+// channelEnvelope returns the envelope of a channel message with the metadata of the options.
+// A non empty id replaces the id of the options, empty fields are omitted.
+func channelEnvelope(path string, payload []byte, id string, options *SendOptions, expiresAt time.Time) Message {
 	message := Message{
 		Type:    MessageTypeChannelMessage,
-		Channel: context.FullPath,
+		Channel: path,
 		Payload: payload,
+		Id:      id,
 	}
-	data, err := json.Marshal(message)
-	if err != nil {
-		return NewError(context, ErrorSendingMessageFailed, "failed to send error to client", err)
+	if options != nil {
+		if message.Id == "" {
+			message.Id = options.Id
+		}
+		if !options.Timestamp.IsZero() {
+			message.Timestamp = options.Timestamp.UnixMilli()
+		}
+		message.Sender = options.Sender
+		message.Headers = options.Headers
 	}
-	if err = context.Client.Send(data); err != nil {
-		return NewError(context, ErrorSendingMessageFailed, "failed to send error to client", err)
+	if !expiresAt.IsZero() {
+		message.ExpiresAt = expiresAt.UnixMilli()
 	}
-	return nil
+	return message
+}
+
+// encodeChannelMessage encodes the envelope, a binary payload is encoded as a binary frame if frame is set and base64
+// encoded otherwise.
+func encodeChannelMessage(envelope *Message, binary bool, frame bool) ([]byte, error) {
+	switch {
+	case frame:
+		return encodeBinaryMessage(envelope)
+	case binary:
+		payload, err := json.Marshal([]byte(envelope.Payload))
+		if err != nil {
+			return nil, err
+		}
+		encoded := *envelope
+		encoded.Payload = payload
+		encoded.Encoding = PayloadEncodingBase64
+		return json.Marshal(encoded)
+	}
+	return json.Marshal(envelope)
+}
+
+// open creates the context of the subscription, derived from the context of the client.
+func (context *Context) open() {
+	parent := stdcontext.Background()
+	if context.Client != nil {
+		parent = context.Client.Context()
+	}
+
+	context.ctxMutex.Lock()
+	defer context.ctxMutex.Unlock()
+	context.ctx, context.cancel = stdcontext.WithCancel(parent)
+}
+
+func (context *Context) setUnsubscribeReason(reason UnsubscribeReason) {
+	context.ctxMutex.Lock()
+	defer context.ctxMutex.Unlock()
+	context.reason = reason
+}
+
+// UnsubscribeReason returns why the subscription ended, or UnsubscribeReasonNone if it is still active.
+func (context *Context) UnsubscribeReason() UnsubscribeReason {
+	context.ctxMutex.RLock()
+	defer context.ctxMutex.RUnlock()
+	return context.reason
+}
+
+// close cancels the context of the subscription.
+func (context *Context) close() {
+	context.ctxMutex.RLock()
+	if context.cancel != nil {
+		context.cancel()
+	}
+	context.ctxMutex.RUnlock()
+
+	context.deliveryMutex.Lock()
+	defer context.deliveryMutex.Unlock()
+	if context.delivery != nil {
+		context.delivery.stop()
+	}
+}
+
+func (context *Context) subscriptionContext() stdcontext.Context {
+	context.ctxMutex.RLock()
+	defer context.ctxMutex.RUnlock()
+	if context.ctx == nil {
+		return stdcontext.Background()
+	}
+	return context.ctx
+}
+
+// handlerContext returns the context of a single handler call, derived from the context of the subscription,
+// and the function that ends it.
+func (context *Context) handlerContext(timeout time.Duration) (stdcontext.Context, stdcontext.CancelFunc) {
+	if timeout > 0 {
+		return stdcontext.WithTimeout(context.subscriptionContext(), timeout)
+	}
+	return stdcontext.WithCancel(context.subscriptionContext())
+}
+
+// Deadline implements context.Context.
+func (context *Context) Deadline() (deadline time.Time, ok bool) {
+	return context.subscriptionContext().Deadline()
+}
+
+// Done returns a channel that is closed as soon as the subscription ends.
+func (context *Context) Done() <-chan struct{} {
+	return context.subscriptionContext().Done()
+}
+
+// Err returns a non nil error if the subscription already ended.
+func (context *Context) Err() error {
+	return context.subscriptionContext().Err()
+}
+
+// Value implements context.Context, string keys are looked up in the properties of the Context first.
+func (context *Context) Value(key interface{}) interface{} {
+	if name, ok := key.(string); ok {
+		if value, exists := context.Get(name); exists {
+			return value
+		}
+	}
+	return context.subscriptionContext().Value(key)
 }
 
 func (context *Context) SetParams(params map[string]string) {
@@ -109,13 +312,17 @@ func (context *Context) Param(key string) string {
 }
 
 type ContextBroadcastOptions struct {
+	SendOptions
 	ExcludeContextOwner bool
 }
 
 func (context *Context) Broadcast(payload []byte, options *ContextBroadcastOptions) *ChannelBroadcastResult {
 	opts := &ChannelBroadcastOptions{}
-	if options != nil && options.ExcludeContextOwner {
-		opts.SkipClientIds = []string{context.Client.Id}
+	if options != nil {
+		opts.SendOptions = options.SendOptions
+		if options.ExcludeContextOwner {
+			opts.SkipClientIds = []string{context.Client.Id}
+		}
 	}
 	return context.Channel.Broadcast(context.FullPath, payload, opts)
 }
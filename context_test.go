@@ -7,49 +7,6 @@ import (
 	"testing"
 )
 
-func TestError(t *testing.T) {
-	t.Run("Init Error with go error", func(t *testing.T) {
-		testContext := &Context{}
-		testDescription := "Foo Bar Error"
-		testCode := ErrorSendingErrorFailed
-		testErr := errors.New("A error")
-
-		err := NewError(testContext, testCode, testDescription, testErr)
-		if err.Context != testContext {
-			t.Errorf("err.Context = %p, want %p", err.Context, testContext)
-		}
-		if err.Code != testCode {
-			t.Errorf("err.Code = %d, want %d", err.Code, testCode)
-		}
-		if err.Description != testDescription {
-			t.Errorf("err.Description = %s, want %s", err.Description, testDescription)
-		}
-		if err.Raw != testErr {
-			t.Errorf("err.Raw = %e, want %e", err.Raw, testErr)
-		}
-	})
-
-	t.Run("Init Error without go error", func(t *testing.T) {
-		testContext := &Context{}
-		testDescription := "Foo Bar Error"
-		testCode := ErrorSendingErrorFailed
-
-		err := NewError(testContext, testCode, testDescription, nil)
-		if err.Context != testContext {
-			t.Errorf("err.Context = %p, want %p", err.Context, testContext)
-		}
-		if err.Code != testCode {
-			t.Errorf("err.Code = %d, want %d", err.Code, testCode)
-		}
-		if err.Description != testDescription {
-			t.Errorf("err.Description = %s, want %s", err.Description, testDescription)
-		}
-		if err.Raw.Error() != testDescription {
-			t.Errorf("err.Raw = %s, want %s", err.Raw, testDescription)
-		}
-	})
-}
-
 func TestContext(t *testing.T) {
 
 	t.Run("Get/Set properties", func(t *testing.T) {
@@ -0,0 +1,106 @@
+package pts
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// DeduplicationScope decides which messages share idempotency keys.
+type DeduplicationScope int
+
+const (
+	DeduplicatePerClient DeduplicationScope = iota // DeduplicatePerClient keeps the keys per Client.Id on all paths of the channel, it is the default
+	DeduplicatePerPath                             // DeduplicatePerPath shares the keys of all clients on a path, so retries after a reconnect are detected, but equal keys of different clients collide
+)
+
+const defaultDeduplicationWindow = time.Minute
+
+// DeduplicationOptions configures the deduplication of inbound messages with an IdempotencyKey.
+// A duplicate within the window is acknowledged with a message of type MessageTypeAck, but not passed to the
+// message handlers. Keys are recorded before the handlers run, so a message is handled at most once.
+type DeduplicationOptions struct {
+	// Window is the time a key is remembered. Zero means one minute.
+	Window time.Duration
+	Scope  DeduplicationScope
+	// Identity returns the application identity of the sender, e.g. a user id from the client properties. If it is
+	// set, keys are remembered per path and identity instead of Scope, so retries after a reconnect are detected
+	// without the keys of different senders colliding.
+	Identity func(s *Context) string
+	// MaxKeys limits the number of remembered keys, the oldest keys are forgotten first. Zero means no limit.
+	MaxKeys int
+}
+
+type dedupEntry struct {
+	key       string
+	expiresAt time.Time
+}
+
+// deduplicator remembers idempotency keys for a window.
+type deduplicator struct {
+	seen  map[string]time.Time
+	order []dedupEntry
+	mutex sync.Mutex
+}
+
+// firstSeen records the key and returns false if it was already seen within the window.
+func (d *deduplicator) firstSeen(key string, options *DeduplicationOptions, now time.Time) bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.seen == nil {
+		d.seen = map[string]time.Time{}
+	}
+
+	for len(d.order) > 0 && (!now.Before(d.order[0].expiresAt) || (options.MaxKeys > 0 && len(d.order) >= options.MaxKeys)) {
+		if d.seen[d.order[0].key] == d.order[0].expiresAt {
+			delete(d.seen, d.order[0].key)
+		}
+		d.order = d.order[1:]
+	}
+	if expiresAt, found := d.seen[key]; found && now.Before(expiresAt) {
+		return false
+	}
+
+	window := options.Window
+	if window <= 0 {
+		window = defaultDeduplicationWindow
+	}
+	expiresAt := now.Add(window)
+	d.seen[key] = expiresAt
+	d.order = append(d.order, dedupEntry{key: key, expiresAt: expiresAt})
+	return true
+}
+
+// deduplicate returns false if the message is a duplicate, messages without IdempotencyKey are never duplicates.
+func (c *Channel) deduplicate(context *Context, message *Message) bool {
+	options := c.options.Deduplication
+	if options == nil || message.IdempotencyKey == "" {
+		return true
+	}
+	scope := context.Client.Id
+	switch {
+	case options.Identity != nil:
+		scope = context.FullPath + "\x00" + options.Identity(context)
+	case options.Scope == DeduplicatePerPath:
+		scope = context.FullPath
+	}
+	return c.dedup.firstSeen(scope+"\x00"+message.IdempotencyKey, options, time.Now())
+}
+
+// acknowledge confirms the receipt of a message with an IdempotencyKey to the client.
+func (c *Channel) acknowledge(context *Context, message *Message) {
+	if c.options.Deduplication == nil || message.IdempotencyKey == "" {
+		return
+	}
+	data, err := json.Marshal(Message{
+		Type:           MessageTypeAck,
+		Channel:        message.Channel,
+		IdempotencyKey: message.IdempotencyKey,
+	})
+	if err == nil {
+		err = context.Client.send(outbound{data: data, priority: PriorityHigh})
+	}
+	if err != nil {
+		c.error(NewError(context, ErrorSendingMessageFailed, "failed to acknowledge message", err))
+	}
+}
@@ -0,0 +1,113 @@
+package pts
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeduplication(t *testing.T) {
+	t.Run("Retries after a reconnect are acknowledged but handled once", func(t *testing.T) {
+		connector := NewConnector(nil, nil)
+		tubeSystem := New(connector)
+		var handled []string
+		tubeSystem.RegisterChannel("chat/:room", ChannelHandlers{
+			OnMessage: func(s *Context, message *Message) {
+				handled = append(handled, string(message.Payload))
+			},
+		}, ChannelOptions{Deduplication: &DeduplicationOptions{Scope: DeduplicatePerPath}})
+
+		order := []byte(`{"type":"message","channel":"chat/1","payload":"hi","idempotencyKey":"k1"}`)
+		first := newGroupWorker(connector)
+		connector.Message(first.client.Id, SubMessage("chat/1"))
+		connector.Message(first.client.Id, order)
+		connector.Leave(first.client.Id)
+
+		second := newGroupWorker(connector)
+		connector.Message(second.client.Id, SubMessage("chat/1"))
+		connector.Message(second.client.Id, order)
+		connector.Message(second.client.Id, ChannelMessage("chat/1", []byte(`"no key"`)))
+		connector.Message(second.client.Id, ChannelMessage("chat/1", []byte(`"no key"`)))
+
+		if len(handled) != 3 {
+			t.Errorf("handled = %v, want 3 messages", handled)
+		}
+		for _, worker := range []*groupWorker{first, second} {
+			received := worker.received()
+			if len(received) != 1 || received[0].Type != MessageTypeAck || received[0].IdempotencyKey != "k1" {
+				t.Errorf("received = %+v, want one ack for k1", received)
+			}
+		}
+	})
+
+	t.Run("Per client scope is the default", func(t *testing.T) {
+		connector := NewConnector(nil, nil)
+		tubeSystem := New(connector)
+		handled := 0
+		tubeSystem.RegisterChannel("orders", ChannelHandlers{
+			OnMessage: func(s *Context, message *Message) {
+				handled++
+			},
+		}, ChannelOptions{Deduplication: &DeduplicationOptions{}})
+
+		order := []byte(`{"type":"message","channel":"orders","payload":{},"idempotencyKey":"k1"}`)
+		for i := 0; i < 2; i++ {
+			worker := newGroupWorker(connector)
+			connector.Message(worker.client.Id, SubMessage("orders"))
+			connector.Message(worker.client.Id, order)
+			connector.Message(worker.client.Id, order)
+		}
+
+		if handled != 2 {
+			t.Errorf("handled = %d, want 2", handled)
+		}
+	})
+
+	t.Run("Identity scope", func(t *testing.T) {
+		connector := NewConnector(nil, nil)
+		tubeSystem := New(connector)
+		var handled []string
+		userKey := NewKey[string]("user")
+		tubeSystem.RegisterChannel("orders", ChannelHandlers{
+			OnMessage: func(s *Context, message *Message) {
+				handled = append(handled, MustGetT(s.Client, userKey))
+			},
+		}, ChannelOptions{Deduplication: &DeduplicationOptions{
+			Identity: func(s *Context) string {
+				return MustGetT(s.Client, userKey)
+			},
+		}})
+
+		order := []byte(`{"type":"message","channel":"orders","payload":{},"idempotencyKey":"k1"}`)
+		for _, user := range []string{"alice", "alice", "bob"} {
+			client := connector.Join(func(message []byte) error { return nil }, map[string]interface{}{"user": user})
+			connector.Message(client.Id, SubMessage("orders"))
+			connector.Message(client.Id, order)
+			connector.Leave(client.Id)
+		}
+
+		if len(handled) != 2 || handled[0] != "alice" || handled[1] != "bob" {
+			t.Errorf("handled = %v, want [alice bob], the retry of alice is a duplicate and the key of bob does not collide", handled)
+		}
+	})
+
+	t.Run("Window and max keys", func(t *testing.T) {
+		d := deduplicator{}
+		options := &DeduplicationOptions{Window: time.Second, MaxKeys: 2}
+		now := time.Now()
+
+		if !d.firstSeen("a", options, now) || d.firstSeen("a", options, now) {
+			t.Errorf("a was not deduplicated within the window")
+		}
+		if !d.firstSeen("a", options, now.Add(time.Second)) {
+			t.Errorf("a was deduplicated after the window")
+		}
+		d.firstSeen("b", options, now.Add(time.Second))
+		d.firstSeen("c", options, now.Add(time.Second))
+		if !d.firstSeen("a", options, now.Add(time.Second)) {
+			t.Errorf("a was not forgotten after MaxKeys newer keys")
+		}
+		if len(d.seen) > 2 {
+			t.Errorf("len(d.seen) = %d, want at most 2", len(d.seen))
+		}
+	})
+}
@@ -0,0 +1,215 @@
+package pts
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// DeliveryPolicy decides which messages of a path are delivered to a subscriber.
+// Collapsed messages are dropped in favour of newer ones instead of being queued.
+type DeliveryPolicy struct {
+	// ConflationKey is a top-level field of the payload. Only the latest message per value of the field is kept
+	// while the subscriber is rate limited or its outbound queue is not flushed yet. Messages without the field
+	// are not conflated in the outbound queue.
+	ConflationKey string `json:"conflationKey,omitempty"`
+	// MaxRate is the maximum number of messages per second, one message is written per interval. Messages in
+	// between are collapsed to the latest message per value of the ConflationKey, up to 1024 values, and the latest
+	// message without it. Zero means no limit. Rates requested by clients are at least 1 per second.
+	MaxRate float64 `json:"maxRate,omitempty"`
+	// SampleEvery delivers only every n-th message. Zero or one delivers every message.
+	SampleEvery int `json:"sampleEvery,omitempty"`
+}
+
+// maxPendingKeys is the maximum number of collapsed messages a rate limited subscriber keeps.
+const maxPendingKeys = 1024
+
+// minClientMaxRate is the lowest MaxRate a client can request, so that the server does not hold its messages for long.
+const minClientMaxRate = 1
+
+// clientPolicy returns the policy with the limits that apply to policies requested by clients.
+func (p DeliveryPolicy) clientPolicy() DeliveryPolicy {
+	if p.MaxRate > 0 && p.MaxRate < minClientMaxRate {
+		p.MaxRate = minClientMaxRate
+	}
+	return p
+}
+
+func (p DeliveryPolicy) interval() time.Duration {
+	if p.MaxRate <= 0 {
+		return 0
+	}
+	return time.Duration(float64(time.Second) / p.MaxRate)
+}
+
+// subscribeRequest is the payload of a subscribe message.
+type subscribeRequest struct {
+	Delivery *DeliveryPolicy `json:"delivery"`
+	Group    string          `json:"group"`
+}
+
+// deliveryState applies the DeliveryPolicy of a subscription.
+type deliveryState struct {
+	policy   DeliveryPolicy
+	interval time.Duration
+	count    int
+	last     time.Time
+	pending  []outbound
+	timer    *time.Timer
+	mutex    sync.Mutex
+}
+
+func newDeliveryState(policy DeliveryPolicy) *deliveryState {
+	return &deliveryState{policy: policy, interval: policy.interval()}
+}
+
+// admit delivers, defers or drops an encoded message.
+func (d *deliveryState) admit(context *Context, message outbound) *Error {
+	d.mutex.Lock()
+	if d.policy.SampleEvery > 1 {
+		d.count++
+		if (d.count-1)%d.policy.SampleEvery != 0 {
+			d.mutex.Unlock()
+			return nil
+		}
+	}
+
+	message.key = d.conflationKey(context, message.payload)
+	if d.interval > 0 {
+		now := time.Now()
+		if wait := d.last.Add(d.interval).Sub(now); wait > 0 || len(d.pending) > 0 {
+			d.deferMessage(message)
+			if d.timer == nil {
+				d.timer = time.AfterFunc(wait, func() {
+					d.flush(context)
+				})
+			}
+			d.mutex.Unlock()
+			return nil
+		}
+		d.last = now
+	}
+	d.mutex.Unlock()
+	return context.write(message)
+}
+
+// deferMessage replaces the pending message with the same key, messages without a key replace each other.
+// If too many messages are pending, the oldest is dropped. The caller must hold the lock.
+func (d *deliveryState) deferMessage(message outbound) {
+	for i := range d.pending {
+		if d.pending[i].key == message.key {
+			d.pending[i] = message
+			return
+		}
+	}
+	if len(d.pending) >= maxPendingKeys {
+		d.pending[0] = outbound{}
+		d.pending = d.pending[1:]
+	}
+	d.pending = append(d.pending, message)
+}
+
+// flush writes the oldest pending message once the rate limit allows it, the next one is written an interval later.
+func (d *deliveryState) flush(context *Context) {
+	d.mutex.Lock()
+	d.timer = nil
+	if context.Err() != nil {
+		d.pending = nil
+		d.mutex.Unlock()
+		return
+	}
+	var message outbound
+	found := false
+	for !found && len(d.pending) > 0 {
+		message = d.pending[0]
+		d.pending[0] = outbound{}
+		d.pending = d.pending[1:]
+		found = !expired(message.expiresAt, time.Now())
+	}
+	d.last = time.Now()
+	if len(d.pending) > 0 {
+		d.timer = time.AfterFunc(d.interval, func() {
+			d.flush(context)
+		})
+	}
+	d.mutex.Unlock()
+
+	if !found {
+		return
+	}
+	if err := context.write(message); err != nil {
+		context.Channel.error(err)
+	}
+}
+
+func (d *deliveryState) stop() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if d.timer != nil {
+		d.timer.Stop()
+		d.timer = nil
+	}
+	d.pending = nil
+}
+
+// conflationKey identifies messages that replace each other, it is empty if the policy does not conflate.
+func (d *deliveryState) conflationKey(context *Context, payload []byte) string {
+	if d.policy.ConflationKey == "" {
+		return ""
+	}
+	value, ok := lookupField(payload, d.policy.ConflationKey)
+	if !ok {
+		// messages without the field are never conflated
+		return ""
+	}
+	return context.FullPath + "\x00" + string(value)
+}
+
+// lookupField returns the raw value of a top-level field of a JSON object.
+func lookupField(data []byte, name string) ([]byte, bool) {
+	p := envelopeParser{data: data, maxDepth: defaultMaxDepth}
+	p.skipSpace()
+	if !p.consume('{') {
+		return nil, false
+	}
+	var found []byte
+	for {
+		p.skipSpace()
+		if !p.consume('"') {
+			return found, found != nil
+		}
+		start, end, _, err := p.scanString()
+		if err != nil {
+			return nil, false
+		}
+		key := p.data[start:end]
+		p.skipSpace()
+		if !p.consume(':') {
+			return nil, false
+		}
+		p.skipSpace()
+		valueStart := p.pos
+		if err := p.skipValue(0); err != nil {
+			return nil, false
+		}
+		if string(key) == name {
+			found = p.data[valueStart:p.pos]
+		}
+		p.skipSpace()
+		if !p.consume(',') {
+			return found, found != nil
+		}
+	}
+}
+
+// parseSubscribeRequest reads the delivery policy a client requested in its subscribe message.
+func parseSubscribeRequest(payload json.RawMessage) (*subscribeRequest, error) {
+	request := &subscribeRequest{}
+	if len(payload) == 0 || string(payload) == "null" {
+		return request, nil
+	}
+	if err := json.Unmarshal(payload, request); err != nil {
+		return nil, err
+	}
+	return request, nil
+}
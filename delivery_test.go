@@ -0,0 +1,187 @@
+package pts
+
+import (
+	"encoding/json"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// recordingClient subscribes a client that records the payloads it receives.
+func recordingClient(store *ChannelStore, id string, path string) (*Client, func() []string) {
+	var mutex sync.Mutex
+	var received []string
+	client := &Client{Id: id, sendMessage: func(message []byte) error {
+		var msg Message
+		_ = json.Unmarshal(message, &msg)
+		mutex.Lock()
+		defer mutex.Unlock()
+		received = append(received, string(msg.Payload))
+		return nil
+	}}
+	store.Subscribe(client, path)
+	return client, func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]string{}, received...)
+	}
+}
+
+func TestDeliveryPolicy(t *testing.T) {
+	t.Run("Sample one in n", func(t *testing.T) {
+		store := ChannelStore{}
+		store.init(func(err *Error) {})
+		channel := store.Register("cursor/:id", ChannelHandlers{}, ChannelOptions{
+			DeliveryPolicy: &DeliveryPolicy{SampleEvery: 3},
+		})
+		_, received := recordingClient(&store, "1", "cursor/a")
+
+		for i := 0; i < 7; i++ {
+			channel.Broadcast("cursor/a", []byte(strconv.Itoa(i)), nil)
+		}
+
+		if got := received(); len(got) != 3 || got[0] != "0" || got[1] != "3" || got[2] != "6" {
+			t.Errorf("received = %v, want [0 3 6]", got)
+		}
+	})
+
+	t.Run("High priority messages bypass the policy", func(t *testing.T) {
+		store := ChannelStore{}
+		store.init(func(err *Error) {})
+		channel := store.Register("cursor/:id", ChannelHandlers{}, ChannelOptions{
+			DeliveryPolicy: &DeliveryPolicy{SampleEvery: 3, MaxRate: 1},
+		})
+		_, received := recordingClient(&store, "1", "cursor/a")
+
+		channel.Broadcast("cursor/a", []byte(`0`), nil)
+		channel.Broadcast("cursor/a", []byte(`"kick"`), &ChannelBroadcastOptions{SendOptions: SendOptions{Priority: PriorityHigh}})
+		channel.Broadcast("cursor/a", []byte(`"ack"`), &ChannelBroadcastOptions{SendOptions: SendOptions{Priority: PriorityHigh}})
+
+		if got := received(); len(got) != 3 || got[1] != `"kick"` || got[2] != `"ack"` {
+			t.Errorf("received = %v, want [0 \"kick\" \"ack\"]", got)
+		}
+	})
+
+	t.Run("Max rate collapses to the latest value per key", func(t *testing.T) {
+		store := ChannelStore{}
+		store.init(func(err *Error) {})
+		channel := store.Register("prices", ChannelHandlers{}, ChannelOptions{
+			DeliveryPolicy: &DeliveryPolicy{ConflationKey: "symbol", MaxRate: 20},
+		})
+		var mutex sync.Mutex
+		var received []string
+		var times []time.Time
+		store.Subscribe(&Client{Id: "1", sendMessage: func(message []byte) error {
+			var msg Message
+			_ = json.Unmarshal(message, &msg)
+			mutex.Lock()
+			defer mutex.Unlock()
+			received = append(received, string(msg.Payload))
+			times = append(times, time.Now())
+			return nil
+		}}, "prices")
+
+		channel.Broadcast("prices", []byte(`{"symbol":"AAPL","price":1}`), nil)
+		channel.Broadcast("prices", []byte(`{"symbol":"AAPL","price":2}`), nil)
+		channel.Broadcast("prices", []byte(`{"symbol":"MSFT","price":3}`), nil)
+		channel.Broadcast("prices", []byte(`{"symbol":"AAPL","price":4}`), nil)
+		channel.Broadcast("prices", []byte(`{"note":1}`), nil)
+		channel.Broadcast("prices", []byte(`{"note":2}`), nil)
+
+		time.Sleep(300 * time.Millisecond)
+		mutex.Lock()
+		defer mutex.Unlock()
+		want := []string{`{"symbol":"AAPL","price":1}`, `{"symbol":"AAPL","price":4}`, `{"symbol":"MSFT","price":3}`, `{"note":2}`}
+		if len(received) != len(want) {
+			t.Fatalf("received = %v, want %v", received, want)
+		}
+		for i := range want {
+			if received[i] != want[i] {
+				t.Errorf("received[%d] = %s, want %s", i, received[i], want[i])
+			}
+			if i > 0 && times[i].Sub(times[i-1]) < 45*time.Millisecond {
+				t.Errorf("received[%d] %v after the previous message, want one message per 50ms", i, times[i].Sub(times[i-1]))
+			}
+		}
+	})
+
+	t.Run("Max rate keeps only the latest message without a key", func(t *testing.T) {
+		store := ChannelStore{}
+		store.init(func(err *Error) {})
+		channel := store.Register("cursor", ChannelHandlers{}, ChannelOptions{
+			DeliveryPolicy: &DeliveryPolicy{MaxRate: 20},
+		})
+		_, received := recordingClient(&store, "1", "cursor")
+
+		for i := 0; i < 100; i++ {
+			channel.Broadcast("cursor", []byte(strconv.Itoa(i)), nil)
+		}
+		time.Sleep(150 * time.Millisecond)
+		if got := received(); len(got) != 2 || got[0] != "0" || got[1] != "99" {
+			t.Errorf("received = %v, want [0 99]", got)
+		}
+	})
+
+	t.Run("Conflation replaces queued messages", func(t *testing.T) {
+		connector := NewConnector(nil, nil)
+		tubeSystem := New(connector)
+		tubeSystem.SetQueueOptions(QueueOptions{})
+		channel := tubeSystem.RegisterChannel("prices", ChannelHandlers{}, ChannelOptions{
+			DeliveryPolicy: &DeliveryPolicy{ConflationKey: "symbol"},
+		})
+
+		socket := newSlowSocket()
+		client := connector.Join(socket.send, nil)
+		connector.Message(client.Id, SubMessage("prices"))
+
+		fillQueue(t, client)
+		channel.Broadcast("prices", []byte(`{"symbol":"AAPL","price":1}`), nil)
+		channel.Broadcast("prices", []byte(`{"symbol":"MSFT","price":2}`), nil)
+		channel.Broadcast("prices", []byte(`{"symbol":"AAPL","price":3}`), nil)
+		channel.Broadcast("prices", []byte(`{"market":"closed"}`), nil)
+		channel.Broadcast("prices", []byte(`{"market":"open"}`), nil)
+
+		if length := client.queue.len(); length != 4 {
+			t.Errorf("client.queue.len() = %d, want 4, messages without the key are not conflated", length)
+		}
+		socket.release()
+		received := socket.waitFor(t, 5)
+		if received[1] != string(ChannelMessage("prices", []byte(`{"symbol":"AAPL","price":3}`))) {
+			t.Errorf("received[1] = %s, want latest AAPL price", received[1])
+		}
+	})
+
+	t.Run("Client requests a policy on subscribe", func(t *testing.T) {
+		connector := NewConnector(nil, nil)
+		tubeSystem := New(connector)
+		var policy DeliveryPolicy
+		tubeSystem.RegisterChannel("cursor", ChannelHandlers{
+			OnSubscribe: func(s *Context) {
+				policy, _ = s.DeliveryPolicy()
+			},
+		}, ChannelOptions{AllowClientDeliveryPolicy: true})
+
+		client := connector.Join(func(message []byte) error { return nil }, nil)
+		connector.Message(client.Id, []byte(`{"type":"subscribe","channel":"cursor","payload":{"delivery":{"maxRate":30,"sampleEvery":2}}}`))
+
+		if policy.MaxRate != 30 || policy.SampleEvery != 2 {
+			t.Errorf("s.DeliveryPolicy() = %+v, want {MaxRate: 30, SampleEvery: 2}", policy)
+		}
+
+		connector.Message(client.Id, []byte(`{"type":"unsubscribe","channel":"cursor"}`))
+		connector.Message(client.Id, []byte(`{"type":"subscribe","channel":"cursor","payload":{"delivery":{"maxRate":0.0001}}}`))
+		if policy.MaxRate != minClientMaxRate {
+			t.Errorf("s.DeliveryPolicy().MaxRate = %v, want the requested rate clamped to %v", policy.MaxRate, minClientMaxRate)
+		}
+	})
+
+	t.Run("Lookup field", func(t *testing.T) {
+		if value, ok := lookupField([]byte(`{"a":{"symbol":"x"},"symbol" : "AAPL"}`), "symbol"); !ok || string(value) != `"AAPL"` {
+			t.Errorf("lookupField(...) = (%s, %t), want (\"AAPL\", true)", value, ok)
+		}
+		if _, ok := lookupField([]byte(`[1]`), "symbol"); ok {
+			t.Errorf("lookupField([1]) found a field, want none")
+		}
+	})
+}
@@ -0,0 +1,472 @@
+package pts
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// defaultMaxDepth is the nesting limit of encoding/json.
+const defaultMaxDepth = 10000
+
+const (
+	defaultMaxTransferSize      = 8 << 20
+	defaultMaxTransferFragments = 4096
+	defaultMaxTransfers         = 16
+	defaultTransferTimeout      = 30 * time.Second
+)
+
+// InboundOptions configures how messages received from clients are parsed.
+type InboundOptions struct {
+	// MaxMessageSize is the maximum size of a message in bytes. Zero means no limit.
+	MaxMessageSize int
+	// MaxDepth is the maximum nesting depth of the payload. Zero means 10000, the limit of encoding/json.
+	MaxDepth int
+	// PoolMessages reuses the Message structs of inbound messages. Handlers must not retain the *Message,
+	// or its Payload, after they returned.
+	PoolMessages bool
+	// ReassembleTransfers enables the reassembly of chunked transfers, fragments are rejected otherwise.
+	// Reassembled JSON payloads are validated against MaxDepth.
+	ReassembleTransfers bool
+	// MaxTransferSize is the maximum size of a payload reassembled from a chunked transfer in bytes.
+	// Zero means MaxMessageSize, or 8 MiB if MaxMessageSize is zero as well.
+	MaxTransferSize int
+	// MaxTransferFragments is the maximum number of fragments of a chunked transfer. Zero means 4096.
+	MaxTransferFragments int
+	// MaxTransfers is the maximum number of incomplete chunked transfers per client. Zero means 16.
+	MaxTransfers int
+	// TransferTimeout discards incomplete chunked transfers that did not receive a fragment for the given duration.
+	// Zero means 30 seconds.
+	TransferTimeout time.Duration
+	// OnTransferProgress is called after each received fragment of a chunked transfer.
+	OnTransferProgress func(client *Client, progress TransferProgress)
+}
+
+func (o InboundOptions) maxDepth() int {
+	if o.MaxDepth <= 0 {
+		return defaultMaxDepth
+	}
+	return o.MaxDepth
+}
+
+func (o InboundOptions) maxTransferSize() int {
+	switch {
+	case o.MaxTransferSize > 0:
+		return o.MaxTransferSize
+	case o.MaxMessageSize > 0:
+		return o.MaxMessageSize
+	}
+	return defaultMaxTransferSize
+}
+
+func (o InboundOptions) maxTransferFragments() int {
+	if o.MaxTransferFragments <= 0 {
+		return defaultMaxTransferFragments
+	}
+	return o.MaxTransferFragments
+}
+
+func (o InboundOptions) maxTransfers() int {
+	if o.MaxTransfers <= 0 {
+		return defaultMaxTransfers
+	}
+	return o.MaxTransfers
+}
+
+func (o InboundOptions) transferTimeout() time.Duration {
+	if o.TransferTimeout <= 0 {
+		return defaultTransferTimeout
+	}
+	return o.TransferTimeout
+}
+
+// reassemblyLimits returns the limits of inbound chunked transfers.
+func (o InboundOptions) reassemblyLimits() reassemblyLimits {
+	return reassemblyLimits{
+		maxSize:      o.maxTransferSize(),
+		maxTransfers: o.maxTransfers(),
+		maxFragments: o.maxTransferFragments(),
+		timeout:      o.transferTimeout(),
+	}
+}
+
+var messagePool = sync.Pool{
+	New: func() any {
+		return new(Message)
+	},
+}
+
+// errEnvelopeFallback signals that the envelope uses a feature the parser does not handle, e.g. escaped keys.
+var errEnvelopeFallback = errors.New("envelope requires encoding/json")
+
+// envelopeParser reads the envelope of an inbound message without decoding the payload.
+// The Payload of the parsed Message is a slice of the original buffer.
+type envelopeParser struct {
+	data     []byte
+	pos      int
+	maxDepth int
+}
+
+// parseMessage parses data into message, it behaves like json.Unmarshal but validates the payload against maxDepth.
+func parseMessage(data []byte, message *Message, maxDepth int) error {
+	p := envelopeParser{data: data, maxDepth: maxDepth}
+	err := p.parseEnvelope(message)
+	if err == errEnvelopeFallback {
+		*message = Message{}
+		if err := json.Unmarshal(data, message); err != nil {
+			return err
+		}
+		return validatePayload(message.Payload, maxDepth)
+	}
+	return err
+}
+
+// validatePayload validates a raw JSON payload against maxDepth, an empty payload is valid.
+func validatePayload(payload []byte, maxDepth int) error {
+	if len(payload) == 0 {
+		return nil
+	}
+	p := envelopeParser{data: payload, maxDepth: maxDepth}
+	return p.skipValue(0)
+}
+
+func (p *envelopeParser) error(reason string) error {
+	return fmt.Errorf("invalid message at offset %d: %s", p.pos, reason)
+}
+
+func (p *envelopeParser) parseEnvelope(message *Message) error {
+	p.skipSpace()
+	if !p.consume('{') {
+		return p.error("expected object")
+	}
+	p.skipSpace()
+	if !p.consume('}') {
+		for {
+			if err := p.parseField(message); err != nil {
+				return err
+			}
+			p.skipSpace()
+			if p.consume(',') {
+				p.skipSpace()
+				continue
+			}
+			if p.consume('}') {
+				break
+			}
+			return p.error("expected ',' or '}'")
+		}
+	}
+	p.skipSpace()
+	if p.pos != len(p.data) {
+		return p.error("unexpected data after message")
+	}
+	return nil
+}
+
+func (p *envelopeParser) parseField(message *Message) error {
+	if !p.consume('"') {
+		return p.error("expected key")
+	}
+	start, end, escaped, err := p.scanString()
+	if err != nil {
+		return err
+	}
+	key := p.data[start:end]
+	for _, c := range key {
+		// encoding/json matches keys with unicode case folding
+		if c >= 0x80 {
+			escaped = true
+		}
+	}
+	if escaped {
+		return errEnvelopeFallback
+	}
+	p.skipSpace()
+	if !p.consume(':') {
+		return p.error("expected ':'")
+	}
+	p.skipSpace()
+
+	switch {
+	case equalFoldASCII(key, "type"):
+		return p.parseString(&message.Type, "type")
+	case equalFoldASCII(key, "channel"):
+		return p.parseString(&message.Channel, "channel")
+	case equalFoldASCII(key, "id"):
+		return p.parseString(&message.Id, "id")
+	case equalFoldASCII(key, "idempotencykey"):
+		return p.parseString(&message.IdempotencyKey, "idempotencyKey")
+	case equalFoldASCII(key, "expiresat"):
+		return p.parseInt(&message.ExpiresAt, "expiresAt")
+	case equalFoldASCII(key, "timestamp"):
+		return p.parseInt(&message.Timestamp, "timestamp")
+	case equalFoldASCII(key, "encoding"):
+		return p.parseString(&message.Encoding, "encoding")
+	case equalFoldASCII(key, "sender"):
+		return p.parseString(&message.Sender, "sender")
+	case equalFoldASCII(key, "headers"):
+		start := p.pos
+		if err := p.skipValue(0); err != nil {
+			return err
+		}
+		// headers are rare, encoding/json decodes them with its exact semantics
+		return json.Unmarshal(p.data[start:p.pos], &message.Headers)
+	case equalFoldASCII(key, "chunk"):
+		start := p.pos
+		if err := p.skipValue(0); err != nil {
+			return err
+		}
+		return json.Unmarshal(p.data[start:p.pos], &message.Chunk)
+	case equalFoldASCII(key, "payload"):
+		start := p.pos
+		if err := p.skipValue(0); err != nil {
+			return err
+		}
+		message.Payload = p.data[start:p.pos]
+		return nil
+	default:
+		return p.skipValue(0)
+	}
+}
+
+// parseString parses a string field, null leaves the field unchanged.
+func (p *envelopeParser) parseString(field *string, name string) error {
+	if p.consumeLiteral("null") {
+		return nil
+	}
+	if !p.consume('"') {
+		return p.error("field '" + name + "' must be a string")
+	}
+	start, end, escaped, err := p.scanString()
+	if err != nil {
+		return err
+	}
+	if escaped {
+		return json.Unmarshal(p.data[start-1:end+1], field)
+	}
+	*field = internMessageType(p.data[start:end])
+	return nil
+}
+
+// parseInt parses an integer field, null leaves the field unchanged.
+func (p *envelopeParser) parseInt(field *int64, name string) error {
+	if p.consumeLiteral("null") {
+		return nil
+	}
+	start := p.pos
+	if err := p.skipNumber(); err != nil {
+		return err
+	}
+	var value int64
+	negative := p.data[start] == '-'
+	digits := p.data[start:p.pos]
+	if negative {
+		digits = digits[1:]
+	}
+	for _, c := range digits {
+		if c < '0' || c > '9' || value > (math.MaxInt64-int64(c-'0'))/10 {
+			return p.error("field '" + name + "' must be an integer")
+		}
+		value = value*10 + int64(c-'0')
+	}
+	if negative {
+		value = -value
+	}
+	*field = value
+	return nil
+}
+
+// internMessageType returns the constant for the built-in message types, to avoid allocating them.
+func internMessageType(value []byte) string {
+	switch string(value) {
+	case MessageTypeSubscribe:
+		return MessageTypeSubscribe
+	case MessageTypeUnsubscribe:
+		return MessageTypeUnsubscribe
+	case MessageTypeChannelMessage:
+		return MessageTypeChannelMessage
+	}
+	return string(value)
+}
+
+// scanString scans a string whose opening quote was consumed, it returns the bounds of its content.
+func (p *envelopeParser) scanString() (start int, end int, escaped bool, err error) {
+	start = p.pos
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		switch {
+		case c == '"':
+			end = p.pos
+			p.pos++
+			return start, end, escaped, nil
+		case c == '\\':
+			escaped = true
+			p.pos++
+			if p.pos >= len(p.data) {
+				return 0, 0, false, p.error("unterminated string")
+			}
+			switch p.data[p.pos] {
+			case '"', '\\', '/', 'b', 'f', 'n', 'r', 't':
+				p.pos++
+			case 'u':
+				p.pos++
+				for i := 0; i < 4; i++ {
+					if p.pos >= len(p.data) || !isHex(p.data[p.pos]) {
+						return 0, 0, false, p.error("invalid unicode escape")
+					}
+					p.pos++
+				}
+			default:
+				return 0, 0, false, p.error("invalid escape")
+			}
+		case c < 0x20:
+			return 0, 0, false, p.error("control character in string")
+		default:
+			p.pos++
+		}
+	}
+	return 0, 0, false, p.error("unterminated string")
+}
+
+// skipValue validates and skips a value, depth is the nesting depth of its parent.
+func (p *envelopeParser) skipValue(depth int) error {
+	if p.pos >= len(p.data) {
+		return p.error("expected value")
+	}
+	switch c := p.data[p.pos]; {
+	case c == '{' || c == '[':
+		return p.skipContainer(depth + 1)
+	case c == '"':
+		p.pos++
+		_, _, _, err := p.scanString()
+		return err
+	case c == '-' || (c >= '0' && c <= '9'):
+		return p.skipNumber()
+	case p.consumeLiteral("true"), p.consumeLiteral("false"), p.consumeLiteral("null"):
+		return nil
+	}
+	return p.error("expected value")
+}
+
+func (p *envelopeParser) skipContainer(depth int) error {
+	if depth > p.maxDepth {
+		return p.error("exceeded max depth")
+	}
+	closing := byte(']')
+	isObject := p.data[p.pos] == '{'
+	if isObject {
+		closing = '}'
+	}
+	p.pos++
+	p.skipSpace()
+	if p.consume(closing) {
+		return nil
+	}
+	for {
+		if isObject {
+			if !p.consume('"') {
+				return p.error("expected key")
+			}
+			if _, _, _, err := p.scanString(); err != nil {
+				return err
+			}
+			p.skipSpace()
+			if !p.consume(':') {
+				return p.error("expected ':'")
+			}
+			p.skipSpace()
+		}
+		if err := p.skipValue(depth); err != nil {
+			return err
+		}
+		p.skipSpace()
+		if p.consume(',') {
+			p.skipSpace()
+			continue
+		}
+		if p.consume(closing) {
+			return nil
+		}
+		return p.error("expected ',' or '" + string(closing) + "'")
+	}
+}
+
+func (p *envelopeParser) skipNumber() error {
+	p.consume('-')
+	if p.consume('0') {
+		// no leading zeros
+	} else if !p.skipDigits() {
+		return p.error("invalid number")
+	}
+	if p.consume('.') && !p.skipDigits() {
+		return p.error("invalid number")
+	}
+	if p.consume('e') || p.consume('E') {
+		if !p.consume('+') {
+			p.consume('-')
+		}
+		if !p.skipDigits() {
+			return p.error("invalid number")
+		}
+	}
+	return nil
+}
+
+func (p *envelopeParser) skipDigits() bool {
+	start := p.pos
+	for p.pos < len(p.data) && p.data[p.pos] >= '0' && p.data[p.pos] <= '9' {
+		p.pos++
+	}
+	return p.pos > start
+}
+
+func (p *envelopeParser) skipSpace() {
+	for p.pos < len(p.data) {
+		switch p.data[p.pos] {
+		case ' ', '\t', '\n', '\r':
+			p.pos++
+		default:
+			return
+		}
+	}
+}
+
+func (p *envelopeParser) consume(c byte) bool {
+	if p.pos < len(p.data) && p.data[p.pos] == c {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *envelopeParser) consumeLiteral(literal string) bool {
+	if len(p.data)-p.pos >= len(literal) && string(p.data[p.pos:p.pos+len(literal)]) == literal {
+		p.pos += len(literal)
+		return true
+	}
+	return false
+}
+
+func isHex(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'f') || (c >= 'A' && c <= 'F')
+}
+
+// equalFoldASCII compares an ASCII key case-insensitively.
+func equalFoldASCII(key []byte, name string) bool {
+	if len(key) != len(name) {
+		return false
+	}
+	for i := range key {
+		c := key[i]
+		if c >= 'A' && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		if c != name[i] {
+			return false
+		}
+	}
+	return true
+}
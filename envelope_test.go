@@ -0,0 +1,134 @@
+package pts
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMessage(t *testing.T) {
+	t.Run("Matches encoding/json", func(t *testing.T) {
+		inputs := []string{
+			`{"type":"subscribe","channel":"a/b","payload":null,"idempotencyKey":"k1","id":"7"}`,
+			` { "type" : "message" , "channel" : "a" , "payload" : {"x":[1,-2.5e+3,true,false,null,"\"y\\u00e9"]} } `,
+			`{"Type":"message","CHANNEL":"a","Payload":"text"}`,
+			`{"type":"message","channel":"café\n","extra":{"a":[{}]},"payload":[]}`,
+			`{"payload":1,"payload":[2],"type":"a","type":null}`,
+			`{"ty\u0070e":"escaped key"}`,
+			`{}`,
+			`{"type":"message","expiresAt":1700000000000,"EXPIRESAT":-5}`,
+			`{"expiresAt":null}`,
+			`{"expiresAt":1.5}`,
+			`{"expiresAt":"1"}`,
+			`{"type":"message","timestamp":1700000000000,"sender":"c1","headers":{"trace":"t1","Trace":"t2"}}`,
+			`{"headers":{"a":"1"},"headers":{"b":"2"},"HEADERS":null}`,
+			`{"headers":{"a":1}}`,
+			`{"payload":"AAE=","encoding":"base64","Encoding":null}`,
+			`{"timestamp":"1"}`,
+			`{"type":1}`,
+			`{"type":"a",}`,
+			`{"type":"a"} x`,
+			`{"payload":01}`,
+			`{"payload":1.}`,
+			`{"payload":"\x"}`,
+			`{"payload":[1,]}`,
+			`{"payload":tru}`,
+			`["type"]`,
+			`{"type":"a"`,
+			``,
+		}
+		for _, input := range inputs {
+			var want, got Message
+			wantErr := json.Unmarshal([]byte(input), &want)
+			gotErr := parseMessage([]byte(input), &got, defaultMaxDepth)
+
+			if (wantErr == nil) != (gotErr == nil) {
+				t.Errorf("parseMessage(%s) error = %v, want %v", input, gotErr, wantErr)
+				continue
+			}
+			if wantErr != nil {
+				continue
+			}
+			payloadsEqual := bytes.Equal(got.Payload, want.Payload)
+			got.Payload, want.Payload = nil, nil
+			if !payloadsEqual || !reflect.DeepEqual(got, want) {
+				t.Errorf("parseMessage(%s) = %+v, want %+v", input, got, want)
+			}
+		}
+	})
+
+	t.Run("Payload references the original buffer", func(t *testing.T) {
+		data := []byte(`{"type":"message","channel":"a","payload":{"x":1}}`)
+		var message Message
+		if err := parseMessage(data, &message, defaultMaxDepth); err != nil {
+			t.Fatalf("parseMessage(...) = %v, want nil", err)
+		}
+		if &message.Payload[0] != &data[len(`{"type":"message","channel":"a","payload":`)] {
+			t.Errorf("message.Payload is a copy, want a slice of the original buffer")
+		}
+	})
+
+	t.Run("Max depth", func(t *testing.T) {
+		nested := `{"type":"message","payload":` + strings.Repeat("[", 5) + strings.Repeat("]", 5) + `}`
+		var message Message
+		if err := parseMessage([]byte(nested), &message, 5); err != nil {
+			t.Errorf("parseMessage(depth 5, max 5) = %v, want nil", err)
+		}
+		if err := parseMessage([]byte(nested), &message, 4); err == nil {
+			t.Errorf("parseMessage(depth 5, max 4) = nil, want error")
+		}
+
+		// escaped keys are parsed by encoding/json
+		escaped := `{"typ\u0065":"message","payload":` + strings.Repeat("[", 5) + strings.Repeat("]", 5) + `}`
+		if err := parseMessage([]byte(escaped), &message, 5); err != nil || message.Type != MessageTypeChannelMessage {
+			t.Errorf("parseMessage(escaped, depth 5, max 5) = %v, want nil", err)
+		}
+		if err := parseMessage([]byte(escaped), &message, 4); err == nil {
+			t.Errorf("parseMessage(escaped, depth 5, max 4) = nil, want error")
+		}
+	})
+
+	t.Run("Does not allocate for built-in types", func(t *testing.T) {
+		data := []byte(`{"type":"message","payload":{"value":42,"unit":"C"}}`)
+		var message Message
+		allocs := testing.AllocsPerRun(100, func() {
+			_ = parseMessage(data, &message, defaultMaxDepth)
+		})
+		if allocs != 0 {
+			t.Errorf("parseMessage(...) allocates %v times, want 0", allocs)
+		}
+	})
+}
+
+func TestInboundOptions(t *testing.T) {
+	t.Run("Max message size", func(t *testing.T) {
+		testChannelPath := "telemetry/device"
+		var errs []*Error
+		fakeConnector, fakeSocket := NewFakeConnector(func(err *Error) {
+			errs = append(errs, err)
+		})
+		tubeSystem := New(fakeConnector)
+		tubeSystem.SetInboundOptions(InboundOptions{MaxMessageSize: 128, PoolMessages: true})
+
+		var received []string
+		tubeSystem.RegisterChannel(testChannelPath, ChannelHandlers{
+			OnMessage: func(s *Context, message *Message) {
+				received = append(received, string(message.Payload))
+			},
+		})
+
+		fakeClient := fakeSocket.NewClientConnects(func(_ []byte) {})
+		fakeClient.Send(SubMessage(testChannelPath))
+		fakeClient.Send(ChannelMessage(testChannelPath, json.RawMessage(`{"t":21}`)))
+		fakeClient.Send(ChannelMessage(testChannelPath, json.RawMessage(`"`+strings.Repeat("x", 128)+`"`)))
+
+		if len(received) != 1 || received[0] != `{"t":21}` {
+			t.Errorf("received = %v, want [{\"t\":21}]", received)
+		}
+		if len(errs) != 1 || errs[0].Code != ErrorInvalidMessage {
+			t.Errorf("errors = %v, want [%s]", errs, ErrorInvalidMessage)
+		}
+	})
+}
@@ -0,0 +1,140 @@
+package pts
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+type ErrorHandlerFunc func(*Error)
+
+// ErrorCode identifies the kind of an Error, applications can register additional codes with RegisterErrorCode.
+type ErrorCode int
+
+const (
+	ErrorInvalidMessage       ErrorCode = iota // ErrorInvalidMessage if an incoming message could not be parsed
+	ErrorUnknownType                           // ErrorUnknownType if a message with an unknown type is received
+	ErrorUnknownChannel                        // ErrorUnknownChannel if a message to an unknown channel is received or sent
+	ErrorClientNotSubscribed                   // ErrorClientNotSubscribed if a message is sent through a channel that is not subscribed by the client
+	ErrorSendingErrorFailed                    // ErrorSendingErrorFailed if a error message could not be send to a client
+	ErrorSendingMessageFailed                  // ErrorSendingMessageFailed if a message could not be sent to a client
+	ErrorContextClosed                         // ErrorContextClosed if a message is sent through a Context that is already unsubscribed
+	ErrorHandlerPanic                          // ErrorHandlerPanic if a handler or middleware panicked
+	ErrorHandlerFailed                         // ErrorHandlerFailed if a handler returned an error that is not an *Error
+	ErrorDisconnectFailed                      // ErrorDisconnectFailed if the connection of a client could not be closed
+	ErrorQueueFull                             // ErrorQueueFull if a message does not fit into the outbound queue of a client
+	ErrorNoSubscribers                         // ErrorNoSubscribers if a broadcast is scheduled for a path without subscribers
+)
+
+var (
+	errorCodeNames = map[ErrorCode]string{
+		ErrorInvalidMessage:       "invalid_message",
+		ErrorUnknownType:          "unknown_type",
+		ErrorUnknownChannel:       "unknown_channel",
+		ErrorClientNotSubscribed:  "client_not_subscribed",
+		ErrorSendingErrorFailed:   "sending_error_failed",
+		ErrorSendingMessageFailed: "sending_message_failed",
+		ErrorContextClosed:        "context_closed",
+		ErrorHandlerPanic:         "handler_panic",
+		ErrorHandlerFailed:        "handler_failed",
+		ErrorDisconnectFailed:     "disconnect_failed",
+		ErrorQueueFull:            "queue_full",
+		ErrorNoSubscribers:        "no_subscribers",
+	}
+	errorCodeMutex sync.RWMutex
+)
+
+// Sentinel errors for the built-in error codes, an *Error matches them with errors.Is if it has the same code.
+var (
+	ErrInvalidMessage       = &Error{Code: ErrorInvalidMessage, Description: "invalid message"}
+	ErrUnknownType          = &Error{Code: ErrorUnknownType, Description: "unknown message type"}
+	ErrUnknownChannel       = &Error{Code: ErrorUnknownChannel, Description: "unknown channel"}
+	ErrClientNotSubscribed  = &Error{Code: ErrorClientNotSubscribed, Description: "client not subscribed"}
+	ErrSendingErrorFailed   = &Error{Code: ErrorSendingErrorFailed, Description: "sending error failed"}
+	ErrSendingMessageFailed = &Error{Code: ErrorSendingMessageFailed, Description: "sending message failed"}
+	ErrContextClosed        = &Error{Code: ErrorContextClosed, Description: "context closed"}
+	ErrHandlerPanic         = &Error{Code: ErrorHandlerPanic, Description: "handler panic"}
+	ErrHandlerFailed        = &Error{Code: ErrorHandlerFailed, Description: "handler failed"}
+	ErrDisconnectFailed     = &Error{Code: ErrorDisconnectFailed, Description: "disconnect failed"}
+	ErrQueueFull            = &Error{Code: ErrorQueueFull, Description: "outbound queue full"}
+	ErrNoSubscribers        = &Error{Code: ErrorNoSubscribers, Description: "no subscribers"}
+)
+
+// RegisterErrorCode registers the name of an application defined ErrorCode.
+// It panics if the code is already registered.
+func RegisterErrorCode(code ErrorCode, name string) {
+	errorCodeMutex.Lock()
+	defer errorCodeMutex.Unlock()
+	if existing, found := errorCodeNames[code]; found {
+		panic(fmt.Sprintf("ErrorCode %d is already registered as '%s'", int(code), existing))
+	}
+	errorCodeNames[code] = name
+}
+
+// String returns the registered name of the ErrorCode.
+func (code ErrorCode) String() string {
+	errorCodeMutex.RLock()
+	defer errorCodeMutex.RUnlock()
+	if name, found := errorCodeNames[code]; found {
+		return name
+	}
+	return fmt.Sprintf("ErrorCode(%d)", int(code))
+}
+
+type Error struct {
+	Context     *Context  `json:"-"`
+	Code        ErrorCode `json:"code"`
+	Description string    `json:"description"`
+	Raw         error     `json:"-"`
+	Stack       []byte    `json:"-"`
+}
+
+func NewError(context *Context, code ErrorCode, description string, err error) *Error {
+	if err == nil {
+		err = errors.New(description)
+	}
+
+	return &Error{
+		Context:     context,
+		Code:        code,
+		Description: description,
+		Raw:         err,
+	}
+}
+
+// AsError converts err into an *Error. If err does not wrap an *Error, a new Error with code ErrorHandlerFailed is created,
+// it has the generic description of ErrHandlerFailed and keeps err as Raw, so that its message is not sent to the client.
+func AsError(context *Context, err error) *Error {
+	if err == nil {
+		return nil
+	}
+	var ptsErr *Error
+	if errors.As(err, &ptsErr) {
+		if ptsErr.Context != nil {
+			return ptsErr
+		}
+		withContext := *ptsErr
+		withContext.Context = context
+		return &withContext
+	}
+	return NewError(context, ErrorHandlerFailed, ErrHandlerFailed.Description, err)
+}
+
+// Error implements the error interface.
+func (err *Error) Error() string {
+	if err.Raw != nil && err.Raw.Error() != err.Description {
+		return fmt.Sprintf("%s: %s: %s", err.Code, err.Description, err.Raw)
+	}
+	return fmt.Sprintf("%s: %s", err.Code, err.Description)
+}
+
+// Unwrap returns the underlying error.
+func (err *Error) Unwrap() error {
+	return err.Raw
+}
+
+// Is reports whether target is an *Error with the same code.
+func (err *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t != nil && t.Code == err.Code
+}
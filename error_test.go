@@ -0,0 +1,128 @@
+package pts
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestError(t *testing.T) {
+	t.Run("Init Error with go error", func(t *testing.T) {
+		testContext := &Context{}
+		testDescription := "Foo Bar Error"
+		testCode := ErrorSendingErrorFailed
+		testErr := errors.New("A error")
+
+		err := NewError(testContext, testCode, testDescription, testErr)
+		if err.Context != testContext {
+			t.Errorf("err.Context = %p, want %p", err.Context, testContext)
+		}
+		if err.Code != testCode {
+			t.Errorf("err.Code = %d, want %d", err.Code, testCode)
+		}
+		if err.Description != testDescription {
+			t.Errorf("err.Description = %s, want %s", err.Description, testDescription)
+		}
+		if err.Raw != testErr {
+			t.Errorf("err.Raw = %e, want %e", err.Raw, testErr)
+		}
+	})
+
+	t.Run("Init Error without go error", func(t *testing.T) {
+		testContext := &Context{}
+		testDescription := "Foo Bar Error"
+		testCode := ErrorSendingErrorFailed
+
+		err := NewError(testContext, testCode, testDescription, nil)
+		if err.Context != testContext {
+			t.Errorf("err.Context = %p, want %p", err.Context, testContext)
+		}
+		if err.Code != testCode {
+			t.Errorf("err.Code = %d, want %d", err.Code, testCode)
+		}
+		if err.Description != testDescription {
+			t.Errorf("err.Description = %s, want %s", err.Description, testDescription)
+		}
+		if err.Raw.Error() != testDescription {
+			t.Errorf("err.Raw = %s, want %s", err.Raw, testDescription)
+		}
+	})
+
+	t.Run("Error implements error", func(t *testing.T) {
+		testErr := errors.New("connection reset")
+		err := NewError(nil, ErrorSendingMessageFailed, "failed to send message", testErr)
+
+		var goErr error = err
+		if goErr.Error() != "sending_message_failed: failed to send message: connection reset" {
+			t.Errorf("err.Error() = %s, want %s", goErr.Error(), "sending_message_failed: failed to send message: connection reset")
+		}
+		if !errors.Is(goErr, testErr) {
+			t.Errorf("errors.Is(err, testErr) = false, want true")
+		}
+		if !errors.Is(goErr, ErrSendingMessageFailed) {
+			t.Errorf("errors.Is(err, ErrSendingMessageFailed) = false, want true")
+		}
+		if errors.Is(goErr, ErrUnknownChannel) {
+			t.Errorf("errors.Is(err, ErrUnknownChannel) = true, want false")
+		}
+		if errors.Is(goErr, (*Error)(nil)) {
+			t.Errorf("errors.Is(err, (*Error)(nil)) = true, want false")
+		}
+
+		var ptsErr *Error
+		if !errors.As(fmt.Errorf("wrapped: %w", goErr), &ptsErr) || ptsErr != err {
+			t.Errorf("errors.As(wrapped, &ptsErr) did not return the original error")
+		}
+	})
+
+	t.Run("Register error code", func(t *testing.T) {
+		testCode := ErrorCode(4001)
+		testName := "quota_exceeded"
+
+		if testCode.String() != "ErrorCode(4001)" {
+			t.Errorf("testCode.String() = %s, want %s", testCode.String(), "ErrorCode(4001)")
+		}
+
+		RegisterErrorCode(testCode, testName)
+		defer func() {
+			errorCodeMutex.Lock()
+			delete(errorCodeNames, testCode)
+			errorCodeMutex.Unlock()
+		}()
+		if testCode.String() != testName {
+			t.Errorf("testCode.String() = %s, want %s", testCode.String(), testName)
+		}
+		if !errors.Is(NewError(nil, testCode, "quota exceeded", nil), &Error{Code: testCode}) {
+			t.Errorf("errors.Is(NewError(nil, testCode, ...), &Error{Code: testCode}) = false, want true")
+		}
+
+		defer func() { recover() }()
+		RegisterErrorCode(ErrorUnknownChannel, testName)
+		t.Errorf("RegisterErrorCode(ErrorUnknownChannel, ...) did not panic, but it should have")
+	})
+
+	t.Run("AsError", func(t *testing.T) {
+		testContext := &Context{}
+		testErr := errors.New("database unavailable")
+
+		if err := AsError(testContext, nil); err != nil {
+			t.Errorf("AsError(testContext, nil) = %v, want nil", err)
+		}
+
+		err := AsError(testContext, testErr)
+		if err.Code != ErrorHandlerFailed || err.Raw != testErr || err.Context != testContext {
+			t.Errorf("AsError(testContext, testErr) = %v, want Error{Code: %d} wrapping testErr", err, ErrorHandlerFailed)
+		}
+		if err.Description != ErrHandlerFailed.Description {
+			t.Errorf("AsError(testContext, testErr).Description = %q, want %q", err.Description, ErrHandlerFailed.Description)
+		}
+
+		err = AsError(testContext, fmt.Errorf("wrapped: %w", ErrClientNotSubscribed))
+		if err.Code != ErrorClientNotSubscribed || err.Context != testContext {
+			t.Errorf("AsError(testContext, wrapped) = %v, want Error{Code: %d}", err, ErrorClientNotSubscribed)
+		}
+		if ErrClientNotSubscribed.Context != nil {
+			t.Errorf("AsError modified the sentinel error, want it to be unchanged")
+		}
+	})
+}
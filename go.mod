@@ -2,4 +2,4 @@ module github.com/mono424/go-pts
 
 go 1.18
 
-require github.com/google/uuid v1.3.0 // indirect
+require github.com/google/uuid v1.3.0
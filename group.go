@@ -0,0 +1,321 @@
+package pts
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// GroupStrategy decides which member of a queue group receives a message.
+type GroupStrategy int
+
+const (
+	GroupRoundRobin  GroupStrategy = iota // GroupRoundRobin picks the members in turn
+	GroupLeastLoaded                      // GroupLeastLoaded picks the member with the fewest unacknowledged and queued messages
+)
+
+// QueueGroupOptions configures the queue groups of a Channel. A broadcast delivers each message to exactly one
+// member of each group on the path, subscribers outside of groups receive every message.
+type QueueGroupOptions struct {
+	Strategy GroupStrategy
+	// RequireAck adds an id to each message sent to a group member, which the member acknowledges with a message of
+	// type MessageTypeAck and the same id. Unacknowledged messages of a member that leaves are reassigned.
+	RequireAck bool
+	// AckTimeout reassigns a message with RequireAck, that is not acknowledged within the timeout, to another member
+	// of the group and sends it again with the same id. Zero means no timeout.
+	AckTimeout time.Duration
+}
+
+type groupJob struct {
+	id      string
+	payload []byte
+	options SendOptions
+	member  *Context
+	group   *queueGroup
+	timer   *time.Timer
+}
+
+func (job *groupJob) expired() bool {
+	return expired(job.options.ExpiresAt, time.Now())
+}
+
+// stopTimer stops the AckTimeout of the job, the caller must hold the lock of the queue groups.
+func (job *groupJob) stopTimer() {
+	if job.timer != nil {
+		job.timer.Stop()
+		job.timer = nil
+	}
+}
+
+type queueGroup struct {
+	members []*Context
+	next    int
+	pending map[string]*groupJob
+	orphans []*groupJob
+}
+
+// queueGroups holds the queue groups of a Channel by path and name.
+type queueGroups struct {
+	groups map[string]map[string]*queueGroup
+	nextId uint64
+	mutex  sync.Mutex
+}
+
+// groupDelivery is a message assigned to a group member by a broadcast.
+type groupDelivery struct {
+	context *Context
+	id      string
+}
+
+func (c *Channel) groupOptions() QueueGroupOptions {
+	if c.options.QueueGroups == nil {
+		return QueueGroupOptions{}
+	}
+	return *c.options.QueueGroups
+}
+
+// JoinGroup adds the subscription to the queue group with the given name, it leaves its previous group.
+func (context *Context) JoinGroup(name string) {
+	c := context.Channel
+	c.leaveGroup(context)
+
+	g := &c.groups
+	g.mutex.Lock()
+	if g.groups == nil {
+		g.groups = map[string]map[string]*queueGroup{}
+	}
+	if g.groups[context.FullPath] == nil {
+		g.groups[context.FullPath] = map[string]*queueGroup{}
+	}
+	group := g.groups[context.FullPath][name]
+	if group == nil {
+		group = &queueGroup{pending: map[string]*groupJob{}}
+		g.groups[context.FullPath][name] = group
+	}
+	group.members = append(group.members, context)
+	context.group = name
+
+	var orphans []*groupJob
+	for _, job := range group.orphans {
+		if job.expired() {
+			continue
+		}
+		orphans = append(orphans, job)
+	}
+	group.orphans = nil
+	for _, job := range orphans {
+		job.member = context
+		group.pending[job.id] = job
+		context.inFlight++
+		c.watchAck(job)
+	}
+	g.mutex.Unlock()
+
+	c.sendJobs(orphans)
+}
+
+// Group returns the name of the queue group of the subscription, or an empty string.
+func (context *Context) Group() string {
+	g := &context.Channel.groups
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return context.group
+}
+
+// leaveGroup removes the subscription from its queue group and reassigns its unacknowledged messages.
+func (c *Channel) leaveGroup(context *Context) {
+	g := &c.groups
+	g.mutex.Lock()
+	group := g.groups[context.FullPath][context.group]
+	if group == nil {
+		g.mutex.Unlock()
+		return
+	}
+	for i, member := range group.members {
+		if member == context {
+			group.members = append(group.members[:i], group.members[i+1:]...)
+			break
+		}
+	}
+	if len(group.members) == 0 && len(group.pending) == 0 {
+		delete(g.groups[context.FullPath], context.group)
+		if len(g.groups[context.FullPath]) == 0 {
+			delete(g.groups, context.FullPath)
+		}
+	}
+	context.group = ""
+	context.inFlight = 0
+
+	var reassigned []*groupJob
+	for id, job := range group.pending {
+		if job.member != context {
+			continue
+		}
+		job.stopTimer()
+		if job.expired() {
+			delete(group.pending, id)
+			continue
+		}
+		if member := c.pickMember(group, nil); member != nil {
+			job.member = member
+			member.inFlight++
+			c.watchAck(job)
+			reassigned = append(reassigned, job)
+		} else {
+			delete(group.pending, id)
+			group.orphans = append(group.orphans, job)
+		}
+	}
+	g.mutex.Unlock()
+
+	c.sendJobs(reassigned)
+}
+
+// assignGroups replaces the group members among the recipients of a broadcast by one member per group.
+// The picked members are returned with the ids of the messages to acknowledge, which are empty without RequireAck.
+func (c *Channel) assignGroups(fullPath string, contexts []*Context, payload []byte, options *SendOptions, skip func(id string) bool) ([]*Context, map[*Context]string) {
+	g := &c.groups
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	groups := g.groups[fullPath]
+	if len(groups) == 0 {
+		return contexts, nil
+	}
+
+	recipients := make([]*Context, 0, len(contexts))
+	for _, context := range contexts {
+		if context.group == "" {
+			recipients = append(recipients, context)
+		}
+	}
+
+	requireAck := c.groupOptions().RequireAck
+	jobs := map[*Context]string{}
+	for _, group := range groups {
+		member := c.pickMember(group, skip)
+		if member == nil {
+			continue
+		}
+		recipients = append(recipients, member)
+		jobs[member] = ""
+		if !requireAck {
+			continue
+		}
+		g.nextId++
+		job := &groupJob{id: strconv.FormatUint(g.nextId, 36), payload: payload, member: member, group: group}
+		if options != nil {
+			job.options = options.absolute(time.Now())
+		}
+		group.pending[job.id] = job
+		member.inFlight++
+		c.watchAck(job)
+		jobs[member] = job.id
+	}
+	return recipients, jobs
+}
+
+// watchAck starts the AckTimeout of a job for its member, the caller must hold the lock.
+func (c *Channel) watchAck(job *groupJob) {
+	timeout := c.groupOptions().AckTimeout
+	if timeout <= 0 {
+		return
+	}
+	member := job.member
+	job.timer = time.AfterFunc(timeout, func() {
+		c.ackTimedOut(job, member)
+	})
+}
+
+// ackTimedOut reassigns a job that its member did not acknowledge in time, preferably to another member.
+func (c *Channel) ackTimedOut(job *groupJob, member *Context) {
+	g := &c.groups
+	g.mutex.Lock()
+	group := job.group
+	if job.member != member || group.pending[job.id] != job {
+		// acknowledged or reassigned in the meantime
+		g.mutex.Unlock()
+		return
+	}
+	member.inFlight--
+	job.timer = nil
+	if job.expired() {
+		delete(group.pending, job.id)
+		g.mutex.Unlock()
+		return
+	}
+	next := c.pickMember(group, func(id string) bool {
+		return id == member.Client.Id
+	})
+	if next == nil {
+		next = c.pickMember(group, nil)
+	}
+	if next == nil {
+		delete(group.pending, job.id)
+		group.orphans = append(group.orphans, job)
+		g.mutex.Unlock()
+		return
+	}
+	job.member = next
+	next.inFlight++
+	c.watchAck(job)
+	g.mutex.Unlock()
+
+	c.sendJobs([]*groupJob{job})
+}
+
+// pickMember returns the next member of the group, the caller must hold the lock.
+func (c *Channel) pickMember(group *queueGroup, skip func(id string) bool) *Context {
+	var picked *Context
+	pickedLoad := 0
+	for i := 0; i < len(group.members); i++ {
+		member := group.members[(group.next+i)%len(group.members)]
+		if member.Err() != nil || (skip != nil && skip(member.Client.Id)) {
+			continue
+		}
+		if c.groupOptions().Strategy == GroupRoundRobin {
+			group.next = (group.next + i + 1) % len(group.members)
+			return member
+		}
+		if load := member.load(); picked == nil || load < pickedLoad {
+			picked, pickedLoad = member, load
+		}
+	}
+	if picked != nil {
+		group.next++
+	}
+	return picked
+}
+
+// load is the number of unacknowledged and queued messages of a group member, the caller must hold the lock.
+func (context *Context) load() int {
+	load := context.inFlight
+	if context.Client.queue != nil {
+		load += context.Client.queue.len()
+	}
+	return load
+}
+
+// ack acknowledges a message sent to a group member.
+func (c *Channel) ack(context *Context, id string) {
+	g := &c.groups
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	group := g.groups[context.FullPath][context.group]
+	if group == nil {
+		return
+	}
+	if job, found := group.pending[id]; found && job.member == context {
+		job.stopTimer()
+		delete(group.pending, id)
+		context.inFlight--
+	}
+}
+
+func (c *Channel) sendJobs(jobs []*groupJob) {
+	for _, job := range jobs {
+		options := job.options
+		if err := job.member.send(job.payload, job.id, true, &options); err != nil {
+			c.error(err)
+		}
+	}
+}
@@ -0,0 +1,186 @@
+package pts
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+)
+
+// groupWorker is a client that records the messages it receives.
+type groupWorker struct {
+	client   *Client
+	mutex    sync.Mutex
+	messages []Message
+}
+
+func newGroupWorker(connector *Connector) *groupWorker {
+	worker := &groupWorker{}
+	worker.client = connector.Join(func(data []byte) error {
+		var message Message
+		_ = json.Unmarshal(data, &message)
+		worker.mutex.Lock()
+		defer worker.mutex.Unlock()
+		worker.messages = append(worker.messages, message)
+		return nil
+	}, nil)
+	return worker
+}
+
+func (w *groupWorker) received() []Message {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return append([]Message{}, w.messages...)
+}
+
+func TestQueueGroups(t *testing.T) {
+	t.Run("Round robin per group and fanout to ungrouped subscribers", func(t *testing.T) {
+		connector := NewConnector(nil, nil)
+		tubeSystem := New(connector)
+		channel := tubeSystem.RegisterChannel("jobs", ChannelHandlers{}, ChannelOptions{QueueGroups: &QueueGroupOptions{}})
+
+		var workers []*groupWorker
+		for i := 0; i < 3; i++ {
+			worker := newGroupWorker(connector)
+			connector.Message(worker.client.Id, []byte(`{"type":"subscribe","channel":"jobs","payload":{"group":"workers"}}`))
+			workers = append(workers, worker)
+		}
+		auditor := newGroupWorker(connector)
+		connector.Message(auditor.client.Id, []byte(`{"type":"subscribe","channel":"jobs","payload":{"group":"audit"}}`))
+		observer := newGroupWorker(connector)
+		connector.Message(observer.client.Id, SubMessage("jobs"))
+
+		for i := 0; i < 6; i++ {
+			channel.Broadcast("jobs", []byte(`{}`), nil)
+		}
+
+		for i, worker := range workers {
+			if count := len(worker.received()); count != 2 {
+				t.Errorf("worker %d received %d messages, want 2", i, count)
+			}
+		}
+		if count := len(auditor.received()); count != 6 {
+			t.Errorf("auditor received %d messages, want 6", count)
+		}
+		if count := len(observer.received()); count != 6 {
+			t.Errorf("observer received %d messages, want 6", count)
+		}
+	})
+
+	t.Run("Unacknowledged messages are reassigned", func(t *testing.T) {
+		connector := NewConnector(nil, nil)
+		tubeSystem := New(connector)
+		channel := tubeSystem.RegisterChannel("jobs", ChannelHandlers{}, ChannelOptions{
+			QueueGroups: &QueueGroupOptions{Strategy: GroupLeastLoaded, RequireAck: true},
+		})
+
+		first := newGroupWorker(connector)
+		second := newGroupWorker(connector)
+		for _, worker := range []*groupWorker{first, second} {
+			connector.Message(worker.client.Id, []byte(`{"type":"subscribe","channel":"jobs","payload":{"group":"workers"}}`))
+		}
+
+		channel.Broadcast("jobs", []byte(`1`), nil)
+		channel.Broadcast("jobs", []byte(`2`), nil)
+		channel.Broadcast("jobs", []byte(`3`), nil)
+
+		if len(first.received()) != 2 || len(second.received()) != 1 {
+			t.Fatalf("workers received (%d, %d) messages, want (2, 1)", len(first.received()), len(second.received()))
+		}
+		job := first.received()[0]
+		if job.Id == "" {
+			t.Fatalf("message has no id, want an id to acknowledge")
+		}
+		connector.Message(first.client.Id, []byte(`{"type":"ack","channel":"jobs","id":"`+job.Id+`"}`))
+
+		connector.Leave(first.client.Id)
+
+		received := second.received()
+		if len(received) != 2 {
+			t.Fatalf("second worker received %d messages, want 2", len(received))
+		}
+		if string(received[1].Payload) != `3` || received[1].Id != first.received()[1].Id {
+			t.Errorf("reassigned message = %+v, want the unacknowledged message 3", received[1])
+		}
+	})
+
+	t.Run("Messages without members wait for the next member", func(t *testing.T) {
+		connector := NewConnector(nil, nil)
+		tubeSystem := New(connector)
+		channel := tubeSystem.RegisterChannel("jobs", ChannelHandlers{}, ChannelOptions{
+			QueueGroups: &QueueGroupOptions{RequireAck: true},
+		})
+
+		first := newGroupWorker(connector)
+		connector.Message(first.client.Id, []byte(`{"type":"subscribe","channel":"jobs","payload":{"group":"workers"}}`))
+		channel.Broadcast("jobs", []byte(`1`), nil)
+		connector.Message(first.client.Id, UnsubMessage("jobs"))
+
+		second := newGroupWorker(connector)
+		connector.Message(second.client.Id, SubMessage("jobs"))
+		context, _ := channel.subscribers.GetContext(second.client.Id, "jobs")
+		context.JoinGroup("workers")
+
+		if received := second.received(); len(received) != 1 || string(received[0].Payload) != `1` {
+			t.Errorf("second worker received %v, want the message of the first worker", received)
+		}
+		if group := context.Group(); group != "workers" {
+			t.Errorf("context.Group() = %s, want workers", group)
+		}
+	})
+
+	t.Run("Unacknowledged messages are redelivered after the ack timeout", func(t *testing.T) {
+		connector := NewConnector(nil, nil)
+		tubeSystem := New(connector)
+		channel := tubeSystem.RegisterChannel("jobs", ChannelHandlers{}, ChannelOptions{
+			QueueGroups: &QueueGroupOptions{RequireAck: true, AckTimeout: 10 * time.Millisecond},
+		})
+
+		first := newGroupWorker(connector)
+		second := newGroupWorker(connector)
+		for _, worker := range []*groupWorker{first, second} {
+			connector.Message(worker.client.Id, []byte(`{"type":"subscribe","channel":"jobs","payload":{"group":"workers"}}`))
+		}
+		channel.Broadcast("jobs", []byte(`1`), nil)
+		if len(first.received()) != 1 || len(second.received()) != 0 {
+			t.Fatalf("workers received (%d, %d) messages, want (1, 0)", len(first.received()), len(second.received()))
+		}
+
+		deadline := time.Now().Add(time.Second)
+		for len(second.received()) == 0 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		received := second.received()
+		if len(received) != 1 || received[0].Id != first.received()[0].Id {
+			t.Fatalf("second worker received %+v, want the unacknowledged message", received)
+		}
+		connector.Message(second.client.Id, []byte(`{"type":"ack","channel":"jobs","id":"`+received[0].Id+`"}`))
+		time.Sleep(30 * time.Millisecond)
+		if len(first.received()) != 1 || len(second.received()) != 1 {
+			t.Errorf("workers received (%d, %d) messages after the ack, want (1, 1)", len(first.received()), len(second.received()))
+		}
+	})
+
+	t.Run("Messages for group members bypass the delivery policy", func(t *testing.T) {
+		connector := NewConnector(nil, nil)
+		tubeSystem := New(connector)
+		channel := tubeSystem.RegisterChannel("jobs", ChannelHandlers{}, ChannelOptions{
+			QueueGroups:    &QueueGroupOptions{},
+			DeliveryPolicy: &DeliveryPolicy{SampleEvery: 2},
+		})
+		worker := newGroupWorker(connector)
+		connector.Message(worker.client.Id, []byte(`{"type":"subscribe","channel":"jobs","payload":{"group":"workers"}}`))
+		observer := newGroupWorker(connector)
+		connector.Message(observer.client.Id, SubMessage("jobs"))
+
+		for i := 0; i < 4; i++ {
+			channel.Broadcast("jobs", []byte(`{}`), nil)
+		}
+		if count := len(worker.received()); count != 4 {
+			t.Errorf("worker received %d messages, want 4", count)
+		}
+		if count := len(observer.received()); count != 2 {
+			t.Errorf("observer received %d messages, want 2 sampled messages", count)
+		}
+	})
+}
@@ -0,0 +1,72 @@
+package pts
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Time returns the Timestamp of the message, or the zero time if it has none.
+func (m *Message) Time() time.Time {
+	if m.Timestamp == 0 {
+		return time.Time{}
+	}
+	return time.UnixMilli(m.Timestamp)
+}
+
+// Header returns the header with the given key, or an empty string if it is not set.
+func (m *Message) Header(key string) string {
+	return m.Headers[key]
+}
+
+// SetHeader sets the header with the given key.
+func (m *Message) SetHeader(key string, value string) {
+	if m.Headers == nil {
+		m.Headers = map[string]string{}
+	}
+	m.Headers[key] = value
+}
+
+// newMessageId returns a new server-assigned message id.
+func newMessageId() string {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return ""
+	}
+	return id.String()
+}
+
+// stampInbound sets the Sender of an inbound message to the id of its client, so clients cannot spoof it.
+// If the Channel sets AssignMetadata, it also assigns the id and overwrites the timestamp.
+func (c *Channel) stampInbound(client *Client, message *Message, now time.Time) {
+	message.Sender = client.Id
+	if c == nil || !c.options.AssignMetadata {
+		return
+	}
+	if message.Id == "" {
+		message.Id = newMessageId()
+	}
+	message.Timestamp = now.UnixMilli()
+}
+
+// stampOutbound returns the options with an id and timestamp if the Channel sets AssignMetadata.
+// Metadata set by the caller is kept.
+func (c *Channel) stampOutbound(options *SendOptions, now time.Time) *SendOptions {
+	if c == nil || !c.options.AssignMetadata {
+		return options
+	}
+	stamped := SendOptions{}
+	if options != nil {
+		if options.Id != "" && !options.Timestamp.IsZero() {
+			return options
+		}
+		stamped = *options
+	}
+	if stamped.Id == "" {
+		stamped.Id = newMessageId()
+	}
+	if stamped.Timestamp.IsZero() {
+		stamped.Timestamp = now
+	}
+	return &stamped
+}
@@ -0,0 +1,111 @@
+package pts
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMessageMetadata(t *testing.T) {
+	t.Run("Assigned metadata is relayed to other subscribers", func(t *testing.T) {
+		connector := NewConnector(nil, nil)
+		tubeSystem := New(connector)
+		var inbound Message
+		tubeSystem.RegisterChannel("chat/:room", ChannelHandlers{
+			OnMessage: func(s *Context, message *Message) {
+				inbound = *message
+				s.Broadcast(message.Payload, &ContextBroadcastOptions{
+					SendOptions:         SendOptions{Sender: message.Sender, Headers: message.Headers},
+					ExcludeContextOwner: true,
+				})
+			},
+		}, ChannelOptions{AssignMetadata: true})
+
+		author := newGroupWorker(connector)
+		readers := []*groupWorker{newGroupWorker(connector), newGroupWorker(connector)}
+		for _, worker := range append(readers, author) {
+			connector.Message(worker.client.Id, SubMessage("chat/1"))
+		}
+		before := time.Now().UnixMilli()
+		connector.Message(author.client.Id, []byte(`{"type":"message","channel":"chat/1","payload":"hi","sender":"spoofed","timestamp":1,"headers":{"trace":"t1"}}`))
+
+		if inbound.Sender != author.client.Id || inbound.Timestamp < before || inbound.Id == "" || inbound.Header("trace") != "t1" {
+			t.Errorf("inbound = %+v, want the sender, timestamp and id assigned by the server", inbound)
+		}
+		var ids []string
+		for _, reader := range readers {
+			received := reader.received()
+			if len(received) != 1 {
+				t.Fatalf("received = %+v, want 1 message", received)
+			}
+			message := received[0]
+			if message.Sender != author.client.Id || message.Header("trace") != "t1" || message.Timestamp < before {
+				t.Errorf("received = %+v, want the sender, headers and timestamp", message)
+			}
+			ids = append(ids, message.Id)
+		}
+		if ids[0] == "" || ids[0] != ids[1] {
+			t.Errorf("ids = %v, want one id for all recipients of the broadcast", ids)
+		}
+		if received := author.received(); len(received) != 0 {
+			t.Errorf("author received = %+v, want nothing", received)
+		}
+	})
+
+	t.Run("Metadata of the caller is kept", func(t *testing.T) {
+		store := ChannelStore{}
+		store.init(func(err *Error) {})
+		channel := store.Register("news", ChannelHandlers{}, ChannelOptions{AssignMetadata: true})
+		worker := newGroupWorker(NewConnector(nil, nil))
+		store.Subscribe(worker.client, "news")
+		context, _ := channel.subscribers.GetContext(worker.client.Id, "news")
+
+		at := time.UnixMilli(1700000000000)
+		context.SendWithOptions([]byte(`1`), &SendOptions{Id: "m1", Timestamp: at})
+		context.Send([]byte(`2`))
+
+		received := worker.received()
+		if len(received) != 2 {
+			t.Fatalf("received = %+v, want 2 messages", received)
+		}
+		if received[0].Id != "m1" || !received[0].Time().Equal(at) {
+			t.Errorf("received[0] = %+v, want id m1 at %v", received[0], at)
+		}
+		if received[1].Id == "" || received[1].Id == "m1" || received[1].Timestamp == 0 {
+			t.Errorf("received[1] = %+v, want a new id and a timestamp", received[1])
+		}
+	})
+
+	t.Run("Only the sender is assigned by default", func(t *testing.T) {
+		connector := NewConnector(nil, nil)
+		tubeSystem := New(connector)
+		var inbound Message
+		tubeSystem.RegisterChannel("news", ChannelHandlers{
+			OnMessage: func(s *Context, message *Message) {
+				inbound = *message
+				s.Send(message.Payload)
+			},
+		})
+		worker := newGroupWorker(connector)
+		connector.Message(worker.client.Id, SubMessage("news"))
+		connector.Message(worker.client.Id, []byte(`{"type":"message","channel":"news","payload":1,"sender":"s","timestamp":5}`))
+
+		if inbound.Sender != worker.client.Id || inbound.Timestamp != 5 || inbound.Id != "" {
+			t.Errorf("inbound = %+v, want the timestamp of the client and its id as sender", inbound)
+		}
+		received := worker.received()
+		if len(received) != 1 || received[0].Id != "" || received[0].Timestamp != 0 || received[0].Sender != "" || received[0].Headers != nil {
+			t.Errorf("received = %+v, want no metadata", received)
+		}
+	})
+
+	t.Run("Headers and time", func(t *testing.T) {
+		message := Message{}
+		if !message.Time().IsZero() || message.Header("a") != "" {
+			t.Errorf("message = %+v, want no time and headers", message)
+		}
+		message.SetHeader("a", "1")
+		if message.Header("a") != "1" {
+			t.Errorf("Header(a) = %q, want 1", message.Header("a"))
+		}
+	})
+}
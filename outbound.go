@@ -0,0 +1,50 @@
+package pts
+
+import "sync"
+
+// OutboundInterceptor is executed before a payload is sent to the target Context.
+// It returns the payload that should be sent instead, or false to drop the message for this recipient.
+type OutboundInterceptor func(target *Context, payload []byte) ([]byte, bool)
+
+// outboundInterceptors is a chain of OutboundInterceptor.
+type outboundInterceptors struct {
+	chain []OutboundInterceptor
+	mutex sync.RWMutex
+}
+
+func (i *outboundInterceptors) add(interceptors ...OutboundInterceptor) {
+	i.mutex.Lock()
+	defer i.mutex.Unlock()
+	i.chain = append(i.chain, interceptors...)
+}
+
+// empty returns true if the chain has no interceptors.
+func (i *outboundInterceptors) empty() bool {
+	if i == nil {
+		return true
+	}
+	i.mutex.RLock()
+	defer i.mutex.RUnlock()
+	return len(i.chain) == 0
+}
+
+// apply executes the chain, it stops as soon as an interceptor drops the message.
+func (i *outboundInterceptors) apply(target *Context, payload []byte) ([]byte, bool) {
+	if i == nil {
+		return payload, true
+	}
+	i.mutex.RLock()
+	chain := i.chain
+	i.mutex.RUnlock()
+	return applyInterceptors(chain, target, payload)
+}
+
+func applyInterceptors(chain []OutboundInterceptor, target *Context, payload []byte) ([]byte, bool) {
+	for _, interceptor := range chain {
+		var deliver bool
+		if payload, deliver = interceptor(target, payload); !deliver {
+			return nil, false
+		}
+	}
+	return payload, true
+}
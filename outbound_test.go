@@ -0,0 +1,73 @@
+package pts
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestOutboundInterceptors(t *testing.T) {
+	t.Run("Interceptors redact and drop messages per recipient", func(t *testing.T) {
+		testChannelPath := "ticket/42"
+		fakeConnector, fakeSocket := NewFakeConnector(func(err *Error) {})
+		tubeSystem := New(fakeConnector)
+
+		tubeSystem.InterceptOutbound(func(target *Context, payload []byte) ([]byte, bool) {
+			if role, _ := target.Client.Get("role"); role == "staff" {
+				return payload, true
+			}
+			var note map[string]interface{}
+			if err := json.Unmarshal(payload, &note); err != nil {
+				return payload, true
+			}
+			if note["internal"] == true {
+				return nil, false
+			}
+			delete(note, "author")
+			redacted, _ := json.Marshal(note)
+			return redacted, true
+		})
+
+		var channelInterceptorCalls int
+		channel := tubeSystem.RegisterChannel("ticket/:id", ChannelHandlers{}, ChannelOptions{
+			OutboundInterceptors: []OutboundInterceptor{
+				func(target *Context, payload []byte) ([]byte, bool) {
+					channelInterceptorCalls++
+					return payload, true
+				},
+			},
+		})
+
+		var staffMessages, customerMessages []Message
+		staff := fakeSocket.NewClientConnects(func(msg []byte) {
+			var message Message
+			_ = json.Unmarshal(msg, &message)
+			staffMessages = append(staffMessages, message)
+		})
+		fakeConnector.clients.Get(staff.Id).Set("role", "staff")
+		customer := fakeSocket.NewClientConnects(func(msg []byte) {
+			var message Message
+			_ = json.Unmarshal(msg, &message)
+			customerMessages = append(customerMessages, message)
+		})
+
+		staff.Send(SubMessage(testChannelPath))
+		customer.Send(SubMessage(testChannelPath))
+
+		channel.Broadcast(testChannelPath, []byte(`{"text":"escalated","internal":true,"author":"anna"}`), nil)
+		channel.Broadcast(testChannelPath, []byte(`{"text":"fixed","author":"anna"}`), nil)
+
+		if len(staffMessages) != 2 {
+			t.Errorf("staff received %d messages, want 2", len(staffMessages))
+		}
+		if len(customerMessages) != 1 {
+			t.Errorf("customer received %d messages, want 1", len(customerMessages))
+			return
+		}
+		if string(customerMessages[0].Payload) != `{"text":"fixed"}` {
+			t.Errorf("customer received %s, want %s", customerMessages[0].Payload, `{"text":"fixed"}`)
+		}
+		if channelInterceptorCalls != 3 {
+			t.Errorf("channel interceptor was called %d times, want 3", channelInterceptorCalls)
+		}
+	})
+}
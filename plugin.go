@@ -0,0 +1,143 @@
+package pts
+
+import "sync"
+
+// Plugin extends the lifecycle of a TubeSystem, see TubeSystem.Install.
+// A Plugin implements any of the optional hook interfaces ConnectPlugin, DisconnectPlugin, SubscribePlugin,
+// UnsubscribePlugin, InboundPlugin, OutboundPlugin and ErrorPlugin.
+type Plugin interface {
+	Name() string
+}
+
+// ConnectPlugin is executed when a client connects, returning a non nil Error rejects the connection.
+type ConnectPlugin interface {
+	OnConnect(client *Client) *Error
+}
+
+// DisconnectPlugin is executed when a client, whose connection was accepted, disconnects.
+type DisconnectPlugin interface {
+	OnDisconnect(client *Client, reason UnsubscribeReason)
+}
+
+// SubscribePlugin is executed after the middlewares of a Channel passed, returning a non nil Error rejects the subscription.
+type SubscribePlugin interface {
+	OnSubscribe(context *Context) *Error
+}
+
+// UnsubscribePlugin is executed when a subscription ends.
+type UnsubscribePlugin interface {
+	OnUnsubscribe(context *Context, reason UnsubscribeReason)
+}
+
+// InboundPlugin is executed for every parsed message of a client, returning a non nil Error drops the message.
+type InboundPlugin interface {
+	OnInbound(client *Client, message *Message) *Error
+}
+
+// OutboundPlugin is executed for every payload that is sent to a Context.
+type OutboundPlugin interface {
+	OnOutbound(context *Context, payload []byte)
+}
+
+// ErrorPlugin is executed for every Error that is passed to the ErrorHandlerFunc.
+type ErrorPlugin interface {
+	OnError(err *Error)
+}
+
+// plugins stores the installed plugins by the hooks they implement.
+type plugins struct {
+	installed   []Plugin
+	subscribe   []SubscribePlugin
+	unsubscribe []UnsubscribePlugin
+	inbound     []InboundPlugin
+	outbound    []OutboundPlugin
+	errors      []ErrorPlugin
+	mutex       sync.RWMutex
+}
+
+func (p *plugins) install(plugin Plugin) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.installed = append(p.installed, plugin)
+	if hook, ok := plugin.(SubscribePlugin); ok {
+		p.subscribe = append(p.subscribe, hook)
+	}
+	if hook, ok := plugin.(UnsubscribePlugin); ok {
+		p.unsubscribe = append(p.unsubscribe, hook)
+	}
+	if hook, ok := plugin.(InboundPlugin); ok {
+		p.inbound = append(p.inbound, hook)
+	}
+	if hook, ok := plugin.(OutboundPlugin); ok {
+		p.outbound = append(p.outbound, hook)
+	}
+	if hook, ok := plugin.(ErrorPlugin); ok {
+		p.errors = append(p.errors, hook)
+	}
+}
+
+func (p *plugins) onSubscribe(context *Context) *Error {
+	if p == nil {
+		return nil
+	}
+	p.mutex.RLock()
+	hooks := p.subscribe
+	p.mutex.RUnlock()
+	for _, hook := range hooks {
+		if err := hook.OnSubscribe(context); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *plugins) onUnsubscribe(context *Context, reason UnsubscribeReason) {
+	if p == nil {
+		return
+	}
+	p.mutex.RLock()
+	hooks := p.unsubscribe
+	p.mutex.RUnlock()
+	for _, hook := range hooks {
+		hook.OnUnsubscribe(context, reason)
+	}
+}
+
+func (p *plugins) onInbound(client *Client, message *Message) *Error {
+	if p == nil {
+		return nil
+	}
+	p.mutex.RLock()
+	hooks := p.inbound
+	p.mutex.RUnlock()
+	for _, hook := range hooks {
+		if err := hook.OnInbound(client, message); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *plugins) onOutbound(context *Context, payload []byte) {
+	if p == nil {
+		return
+	}
+	p.mutex.RLock()
+	hooks := p.outbound
+	p.mutex.RUnlock()
+	for _, hook := range hooks {
+		hook.OnOutbound(context, payload)
+	}
+}
+
+func (p *plugins) onError(err *Error) {
+	if p == nil {
+		return
+	}
+	p.mutex.RLock()
+	hooks := p.errors
+	p.mutex.RUnlock()
+	for _, hook := range hooks {
+		hook.OnError(err)
+	}
+}
@@ -0,0 +1,127 @@
+package pts
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+)
+
+type recordingPlugin struct {
+	name          string
+	events        *[]string
+	rejectInbound bool
+	rejectPath    string
+}
+
+func (p *recordingPlugin) Name() string {
+	return p.name
+}
+
+func (p *recordingPlugin) record(event string) {
+	*p.events = append(*p.events, p.name+":"+event)
+}
+
+func (p *recordingPlugin) OnConnect(client *Client) *Error {
+	p.record("connect")
+	return nil
+}
+
+func (p *recordingPlugin) OnDisconnect(client *Client, reason UnsubscribeReason) {
+	p.record("disconnect:" + reason.String())
+}
+
+func (p *recordingPlugin) OnSubscribe(context *Context) *Error {
+	p.record("subscribe:" + context.FullPath)
+	if context.FullPath == p.rejectPath {
+		return NewError(context, 403, "Forbidden", nil)
+	}
+	return nil
+}
+
+func (p *recordingPlugin) OnUnsubscribe(context *Context, reason UnsubscribeReason) {
+	p.record("unsubscribe:" + context.FullPath + ":" + reason.String())
+}
+
+func (p *recordingPlugin) OnInbound(client *Client, message *Message) *Error {
+	p.record("inbound:" + message.Type)
+	if p.rejectInbound && message.Type == MessageTypeChannelMessage {
+		return NewError(nil, 429, "Too many messages", nil)
+	}
+	return nil
+}
+
+func (p *recordingPlugin) OnOutbound(context *Context, payload []byte) {
+	p.record("outbound:" + string(payload))
+}
+
+func (p *recordingPlugin) OnError(err *Error) {
+	p.record("error:" + err.Code.String())
+}
+
+type namedPlugin string
+
+func (p namedPlugin) Name() string {
+	return string(p)
+}
+
+func TestPlugins(t *testing.T) {
+	t.Run("Hooks are executed for all installed plugins", func(t *testing.T) {
+		var events []string
+		fakeConnector, fakeSocket := NewFakeConnector(func(err *Error) {})
+		tubeSystem := New(fakeConnector)
+		tubeSystem.Install(
+			&recordingPlugin{name: "a", events: &events},
+			namedPlugin("without-hooks"),
+			&recordingPlugin{name: "b", events: &events, rejectInbound: true},
+		)
+
+		tubeSystem.RegisterChannel("example/path", ChannelHandlers{})
+
+		fakeClient := fakeSocket.NewClientConnects(func(_ []byte) {})
+		fakeClient.Send(SubMessage("example/path"))
+		_ = tubeSystem.Send("example/path", fakeClient.Id, []byte(`"hi"`))
+		fakeClient.Send(ChannelMessage("example/path", []byte("{}")))
+		fakeClient.Disconnect()
+
+		want := []string{
+			"a:connect", "b:connect",
+			"a:inbound:subscribe", "b:inbound:subscribe",
+			"a:subscribe:example/path", "b:subscribe:example/path",
+			`a:outbound:"hi"`, `b:outbound:"hi"`,
+			"a:inbound:message", "b:inbound:message",
+			"a:error:ErrorCode(429)", "b:error:ErrorCode(429)",
+			"a:unsubscribe:example/path:client_disconnect", "b:unsubscribe:example/path:client_disconnect",
+			"a:disconnect:client_disconnect", "b:disconnect:client_disconnect",
+		}
+		if strings.Join(events, "\n") != strings.Join(want, "\n") {
+			t.Errorf("plugin events = %v, want %v", events, want)
+		}
+	})
+
+	t.Run("Subscribe plugin rejects subscription", func(t *testing.T) {
+		var events []string
+		fakeConnector, fakeSocket := NewFakeConnector(func(err *Error) {})
+		tubeSystem := New(fakeConnector)
+		tubeSystem.Install(&recordingPlugin{name: "a", events: &events, rejectPath: "example/secret"})
+
+		subscribed := false
+		tubeSystem.RegisterChannel("example/secret", ChannelHandlers{
+			OnSubscribe: func(s *Context) {
+				subscribed = true
+			},
+		})
+
+		var receivedMessage map[string]interface{}
+		fakeClient := fakeSocket.NewClientConnects(func(msg []byte) {
+			_ = json.Unmarshal(msg, &receivedMessage)
+		})
+		fakeClient.Send(SubMessage("example/secret"))
+
+		if subscribed || tubeSystem.IsSubscribed("example/secret", fakeClient.Id) {
+			t.Errorf("client is subscribed, want subscription to be rejected")
+		}
+		if receivedMessage == nil || receivedMessage["type"] != MessageTypeError {
+			t.Errorf("client received %v, want error message", receivedMessage)
+		}
+	})
+}
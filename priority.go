@@ -0,0 +1,97 @@
+package pts
+
+import "time"
+
+// Priority orders the messages in the outbound queue of a client, higher priorities are written first.
+type Priority int
+
+const (
+	PriorityLow    Priority = -1 // PriorityLow for bulk data, e.g. history replays
+	PriorityNormal Priority = 0  // PriorityNormal is the default priority
+	PriorityHigh   Priority = 1  // PriorityHigh for control messages, e.g. errors, kicks and acks, it bypasses the DeliveryPolicy
+)
+
+// priorityLanes is the number of lanes of a clientQueue, one per Priority.
+const priorityLanes = 3
+
+// lane returns the lane of the priority in a clientQueue, lane 0 is written first.
+func (p Priority) lane() int {
+	switch {
+	case p >= PriorityHigh:
+		return 0
+	case p <= PriorityLow:
+		return 2
+	}
+	return 1
+}
+
+// SendOptions configures how a message is sent to a client.
+type SendOptions struct {
+	// Priority of the message in the outbound queue of the client, it only has an effect if queues are enabled.
+	Priority Priority
+	// TTL is the time the message may wait for delivery. Zero means no expiry.
+	TTL time.Duration
+	// ExpiresAt is the time after which the message is not delivered anymore, it takes precedence over TTL.
+	ExpiresAt time.Time
+	// Id of the message in its envelope. Messages of queue groups carry the id of their job instead.
+	Id string
+	// Timestamp of the message in its envelope, the zero time omits it.
+	Timestamp time.Time
+	// Sender is the id of the client a relayed message originates from.
+	Sender string
+	// Headers are free-form metadata added to the envelope.
+	Headers map[string]string
+	// Binary sends the payload as opaque bytes instead of JSON, in a binary frame if the connection of the client
+	// supports them and base64 encoded otherwise.
+	Binary bool
+}
+
+func (o *SendOptions) priority() Priority {
+	if o == nil {
+		return PriorityNormal
+	}
+	return o.Priority
+}
+
+func (o *SendOptions) binary() bool {
+	return o != nil && o.Binary
+}
+
+// expiresAt returns the absolute expiry of a message sent now, or the zero time if it does not expire.
+func (o *SendOptions) expiresAt(now time.Time) time.Time {
+	switch {
+	case o == nil:
+		return time.Time{}
+	case !o.ExpiresAt.IsZero():
+		return o.ExpiresAt
+	case o.TTL > 0:
+		return now.Add(o.TTL)
+	}
+	return time.Time{}
+}
+
+// absolute returns a copy of the options with an absolute expiry, for messages that are sent later.
+func (o SendOptions) absolute(now time.Time) SendOptions {
+	o.ExpiresAt = o.expiresAt(now)
+	o.TTL = 0
+	return o
+}
+
+// outbound is an encoded message on its way to a client.
+type outbound struct {
+	data      []byte
+	binary    bool   // data is a binary frame
+	transfer  string // transfer is the id of the chunked transfer of a fragment
+	payload   []byte
+	key       string
+	priority  Priority
+	expiresAt time.Time
+	context   *Context // context is the subscription the message is sent for, failed queued writes are reported to it
+	attempt   int      // attempt is the number of retries of a failed send
+	job       bool     // job is a message for one member of a queue group, it bypasses the DeliveryPolicy
+}
+
+// expired reports whether a message with the given expiry must not be delivered anymore.
+func expired(expiresAt time.Time, now time.Time) bool {
+	return !expiresAt.IsZero() && now.After(expiresAt)
+}
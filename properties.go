@@ -0,0 +1,51 @@
+package pts
+
+import "fmt"
+
+// PropertyStore is implemented by Client and Context.
+type PropertyStore interface {
+	Get(key string) (value interface{}, exists bool)
+	Set(key string, value interface{})
+}
+
+// Key is a typed key for the properties of a PropertyStore, see GetT and SetT.
+type Key[T any] struct {
+	name string
+}
+
+// NewKey creates a typed key for the property with the given name.
+func NewKey[T any](name string) Key[T] {
+	return Key[T]{name: name}
+}
+
+// Name returns the name of the property.
+func (key Key[T]) Name() string {
+	return key.name
+}
+
+// GetT returns the property of the key. It returns false if the property does not exist or is not of type T.
+func GetT[T any](store PropertyStore, key Key[T]) (T, bool) {
+	var zero T
+	value, exists := store.Get(key.name)
+	if !exists {
+		return zero, false
+	}
+	typed, ok := value.(T)
+	if !ok {
+		return zero, false
+	}
+	return typed, true
+}
+
+// MustGetT returns the property of the key and panics if it does not exist or is not of type T.
+func MustGetT[T any](store PropertyStore, key Key[T]) T {
+	if value, ok := GetT(store, key); ok {
+		return value
+	}
+	panic(fmt.Sprintf("Key '%s' does not exist or has the wrong type", key.name))
+}
+
+// SetT sets the property of the key.
+func SetT[T any](store PropertyStore, key Key[T], value T) {
+	store.Set(key.name, value)
+}
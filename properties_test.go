@@ -0,0 +1,79 @@
+package pts
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+)
+
+func TestProperties(t *testing.T) {
+	t.Run("Typed keys", func(t *testing.T) {
+		userIdKey := NewKey[int]("userId")
+		nameKey := NewKey[string]("name")
+		client := NewClient(func(message []byte) error { return nil }, map[string]interface{}{})
+
+		if _, ok := GetT(client, userIdKey); ok {
+			t.Errorf("GetT(client, userIdKey) = (_, true), want (_, false)")
+		}
+
+		SetT(client, userIdKey, 42)
+		client.Set(nameKey.Name(), 7)
+
+		if value, ok := GetT(client, userIdKey); !ok || value != 42 {
+			t.Errorf("GetT(client, userIdKey) = (%d, %t), want (42, true)", value, ok)
+		}
+		if value, ok := GetT(client, nameKey); ok || value != "" {
+			t.Errorf("GetT(client, nameKey) = (%s, %t), want (\"\", false)", value, ok)
+		}
+		if value := MustGetT(client, userIdKey); value != 42 {
+			t.Errorf("MustGetT(client, userIdKey) = %d, want 42", value)
+		}
+
+		defer func() { recover() }()
+		MustGetT(client, nameKey)
+		t.Errorf("MustGetT(client, nameKey) did not panic, but it should have")
+	})
+
+	t.Run("Context falls back to client properties", func(t *testing.T) {
+		roleKey := NewKey[string]("role")
+		client := &Client{Id: "ABC123"}
+		SetT(client, roleKey, "staff")
+
+		context := &Context{Client: client, Channel: &Channel{}}
+		if _, ok := GetT(context, roleKey); ok {
+			t.Errorf("GetT(context, roleKey) = (_, true) without InheritClientProperties, want (_, false)")
+		}
+
+		context.Channel.options.InheritClientProperties = true
+		if value, ok := GetT(context, roleKey); !ok || value != "staff" {
+			t.Errorf("GetT(context, roleKey) = (%s, %t), want (staff, true)", value, ok)
+		}
+
+		SetT(context, roleKey, "customer")
+		if value, _ := GetT(context, roleKey); value != "customer" {
+			t.Errorf("GetT(context, roleKey) = %s, want customer", value)
+		}
+		if value, _ := GetT(client, roleKey); value != "staff" {
+			t.Errorf("GetT(client, roleKey) = %s, want staff", value)
+		}
+	})
+
+	t.Run("Concurrent access", func(t *testing.T) {
+		stores := []PropertyStore{&Client{}, &Context{}}
+		for _, store := range stores {
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					for j := 0; j < 100; j++ {
+						key := strconv.Itoa(j % 10)
+						store.Set(key, i)
+						store.Get(key)
+					}
+				}(i)
+			}
+			wg.Wait()
+		}
+	})
+}
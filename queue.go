@@ -0,0 +1,399 @@
+package pts
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SlowConsumerPolicy decides what happens if a message does not fit into the outbound queue of a client.
+type SlowConsumerPolicy int
+
+const (
+	SlowConsumerDropOldest SlowConsumerPolicy = iota // SlowConsumerDropOldest drops the oldest queued messages to make room
+	SlowConsumerDropNewest                           // SlowConsumerDropNewest drops the message that does not fit
+	SlowConsumerDisconnect                           // SlowConsumerDisconnect disconnects the client with UnsubscribeReasonSlowConsumer
+)
+
+// QueueOptions configures the outbound queues of clients. Each client gets its own queue with a single writer
+// goroutine, so a slow connection does not block the sender. Zero values mean no limit.
+type QueueOptions struct {
+	// MaxMessages is the maximum number of queued messages per client, including the message being written.
+	MaxMessages int
+	// MaxBytes is the maximum size of the queued messages per client, including the message being written.
+	MaxBytes int
+	// MaxTotalBytes is the maximum size of the queued messages of all clients together.
+	MaxTotalBytes int64
+	// Policy is applied if a message exceeds one of the limits. SlowConsumerDropOldest only drops messages
+	// whose Priority is not higher than the priority of the new message.
+	Policy SlowConsumerPolicy
+	// StarvationLimit is the number of times a lane of lower priority may be passed over, before it is written
+	// ahead of higher priorities. Zero means 16.
+	StarvationLimit int
+}
+
+const defaultStarvationLimit = 16
+
+// queueMemory accounts the memory used by all queues of a Connector.
+type queueMemory struct {
+	used  int64
+	limit int64
+}
+
+func (m *queueMemory) reserve(size int) bool {
+	for {
+		used := atomic.LoadInt64(&m.used)
+		if limit := atomic.LoadInt64(&m.limit); limit > 0 && used+int64(size) > limit {
+			return false
+		}
+		if atomic.CompareAndSwapInt64(&m.used, used, used+int64(size)) {
+			return true
+		}
+	}
+}
+
+func (m *queueMemory) release(size int) {
+	atomic.AddInt64(&m.used, -int64(size))
+}
+
+type queuedMessage struct {
+	data      []byte
+	binary    bool
+	transfer  string
+	key       string
+	priority  Priority
+	expiresAt time.Time
+	context   *Context
+	attempt   int
+}
+
+// outbound returns the message as it was passed to the queue, e.g. to retry it.
+func (m queuedMessage) outbound() outbound {
+	return outbound{data: m.data, binary: m.binary, transfer: m.transfer, key: m.key, priority: m.priority,
+		expiresAt: m.expiresAt, context: m.context, attempt: m.attempt}
+}
+
+// clientQueue is the outbound queue of a Client, it has one lane per Priority.
+type clientQueue struct {
+	client        *Client
+	options       QueueOptions
+	memory        *queueMemory
+	onError       func(err error)
+	lanes         [priorityLanes][]queuedMessage
+	skipped       [priorityLanes]int
+	count         int
+	bytes         int
+	inFlight      int
+	inFlightBytes int
+	dropped       []queuedMessage // dropped holds a dropped fragment of each transfer the client must discard
+	wake          chan struct{}
+	mutex         sync.Mutex
+}
+
+// newClientQueue creates the queue and starts its writer, which stops as soon as the client leaves.
+func newClientQueue(client *Client, options QueueOptions, memory *queueMemory, onError func(err error)) *clientQueue {
+	q := &clientQueue{
+		client:  client,
+		options: options,
+		memory:  memory,
+		onError: onError,
+		wake:    make(chan struct{}, 1),
+	}
+	go q.run()
+	return q
+}
+
+// push adds a message to the queue and applies the SlowConsumerPolicy if it does not fit.
+// A queued message with the same non empty key is replaced in place. If a fragment of a chunked transfer is dropped,
+// the whole transfer is dropped and the client is told to discard it.
+func (q *clientQueue) push(message outbound) error {
+	err := q.enqueue(message)
+	q.cancelDropped()
+	return err
+}
+
+func (q *clientQueue) enqueue(message outbound) error {
+	q.mutex.Lock()
+	if q.client.Err() != nil {
+		q.mutex.Unlock()
+		return ErrContextClosed
+	}
+	if message.transfer != "" && q.client.transferCancelled(message.transfer) {
+		q.mutex.Unlock()
+		return nil
+	}
+	if message.key != "" && q.replace(message) {
+		q.mutex.Unlock()
+		return nil
+	}
+	lane := message.priority.lane()
+	if !q.fits(len(message.data)) {
+		q.dropExpired()
+	}
+	for !q.fits(len(message.data)) || !q.memory.reserve(len(message.data)) {
+		if q.options.Policy != SlowConsumerDropOldest || !q.dropOldest(lane) {
+			q.mutex.Unlock()
+			if q.options.Policy == SlowConsumerDisconnect {
+				// asynchronous, because the client may be sending from within its own disconnect
+				go q.client.DisconnectWithReason(UnsubscribeReasonSlowConsumer)
+			}
+			return ErrQueueFull
+		}
+	}
+	if q.droppedTransfer(message.transfer) {
+		// the transfer of the message was dropped to make room
+		q.memory.release(len(message.data))
+		q.mutex.Unlock()
+		return nil
+	}
+	q.lanes[lane] = append(q.lanes[lane], queuedMessage{data: message.data, binary: message.binary, transfer: message.transfer,
+		key: message.key, priority: message.priority, expiresAt: message.expiresAt, context: message.context, attempt: message.attempt})
+	q.count++
+	q.bytes += len(message.data)
+	q.mutex.Unlock()
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// fits reports whether a message of the given size fits into the limits of the client, the caller must hold the lock.
+// The message that is being written counts against the limits.
+func (q *clientQueue) fits(size int) bool {
+	if q.options.MaxMessages > 0 && q.count+q.inFlight+1 > q.options.MaxMessages {
+		return false
+	}
+	return q.options.MaxBytes <= 0 || q.bytes+q.inFlightBytes+size <= q.options.MaxBytes
+}
+
+// replace replaces the data of a queued message with the same key in the lane of the message, the caller must hold
+// the lock. Limits are not applied, because conflated messages usually have a similar size.
+func (q *clientQueue) replace(message outbound) bool {
+	lane := message.priority.lane()
+	for i := range q.lanes[lane] {
+		if queued := &q.lanes[lane][i]; queued.key == message.key {
+			previous := len(queued.data)
+			q.memory.release(previous - len(message.data))
+			q.bytes += len(message.data) - previous
+			queued.data = message.data
+			queued.binary = message.binary
+			queued.expiresAt = message.expiresAt
+			return true
+		}
+	}
+	return false
+}
+
+// dropOldest drops the oldest message of the lowest priority, that is not higher than the priority of the given lane.
+// The caller must hold the lock.
+func (q *clientQueue) dropOldest(lane int) bool {
+	for candidate := priorityLanes - 1; candidate >= lane; candidate-- {
+		if len(q.lanes[candidate]) > 0 {
+			message := q.lanes[candidate][0]
+			q.release(message)
+			q.lanes[candidate] = q.lanes[candidate][1:]
+			q.dropTransfer(message)
+			return true
+		}
+	}
+	return false
+}
+
+// dropExpired drops all expired messages and the transfers of expired fragments, the caller must hold the lock.
+func (q *clientQueue) dropExpired() {
+	now := time.Now()
+	var fragments []queuedMessage
+	q.dropWhere(func(message queuedMessage) bool {
+		if !expired(message.expiresAt, now) {
+			return false
+		}
+		if message.transfer != "" {
+			fragments = append(fragments, message)
+		}
+		return true
+	})
+	for _, message := range fragments {
+		q.dropTransfer(message)
+	}
+}
+
+// dropTransfer drops the queued fragments of the transfer of a dropped fragment and stops its sender.
+// The client is told to discard the transfer by cancelDropped. The caller must hold the lock.
+func (q *clientQueue) dropTransfer(message queuedMessage) {
+	if message.transfer == "" {
+		return
+	}
+	if q.droppedTransfer(message.transfer) {
+		return
+	}
+	q.client.stopTransfer(message.transfer)
+	q.dropWhere(func(queued queuedMessage) bool {
+		return queued.transfer == message.transfer
+	})
+	q.dropped = append(q.dropped, queuedMessage{transfer: message.transfer, context: message.context})
+}
+
+// droppedTransfer reports whether the transfer was dropped and not yet cancelled, the caller must hold the lock.
+func (q *clientQueue) droppedTransfer(transfer string) bool {
+	for _, dropped := range q.dropped {
+		if transfer != "" && dropped.transfer == transfer {
+			return true
+		}
+	}
+	return false
+}
+
+// cancelDropped sends a cancel message for each dropped transfer, the caller must not hold the lock.
+func (q *clientQueue) cancelDropped() {
+	q.mutex.Lock()
+	dropped := q.dropped
+	q.dropped = nil
+	q.mutex.Unlock()
+	for _, message := range dropped {
+		channel := ""
+		if message.context != nil {
+			channel = message.context.FullPath
+		}
+		q.client.sendCancel(channel, message.transfer)
+	}
+}
+
+// cancel drops the queued fragments of a chunked transfer.
+func (q *clientQueue) cancel(transfer string) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.dropWhere(func(message queuedMessage) bool {
+		return message.transfer == transfer
+	})
+}
+
+// dropWhere drops all messages for which drop returns true, the caller must hold the lock.
+func (q *clientQueue) dropWhere(drop func(message queuedMessage) bool) {
+	for lane := range q.lanes {
+		kept := q.lanes[lane][:0]
+		for _, message := range q.lanes[lane] {
+			if drop(message) {
+				q.release(message)
+			} else {
+				kept = append(kept, message)
+			}
+		}
+		q.lanes[lane] = kept
+	}
+}
+
+// release removes a message from the accounting, the caller must hold the lock.
+func (q *clientQueue) release(message queuedMessage) {
+	q.count--
+	q.bytes -= len(message.data)
+	q.memory.release(len(message.data))
+}
+
+// pop removes the next message, lanes of higher priority go first.
+// A lane that was passed over StarvationLimit times goes first, so low priority traffic does not starve.
+// The caller must hold the lock.
+func (q *clientQueue) pop() (queuedMessage, bool) {
+	chosen := -1
+	for lane := range q.lanes {
+		if len(q.lanes[lane]) > 0 {
+			chosen = lane
+			break
+		}
+	}
+	if chosen < 0 {
+		return queuedMessage{}, false
+	}
+	for lane := priorityLanes - 1; lane > chosen; lane-- {
+		if len(q.lanes[lane]) > 0 && q.skipped[lane] >= q.starvationLimit() {
+			chosen = lane
+			break
+		}
+	}
+	for lane := chosen + 1; lane < priorityLanes; lane++ {
+		if len(q.lanes[lane]) > 0 {
+			q.skipped[lane]++
+		}
+	}
+	q.skipped[chosen] = 0
+
+	message := q.lanes[chosen][0]
+	q.lanes[chosen][0] = queuedMessage{}
+	q.lanes[chosen] = q.lanes[chosen][1:]
+	q.count--
+	q.bytes -= len(message.data)
+	q.inFlight++
+	q.inFlightBytes += len(message.data)
+	return message, true
+}
+
+// written removes a popped message from the accounting once it was written or dropped.
+func (q *clientQueue) written(message queuedMessage) {
+	q.mutex.Lock()
+	q.inFlight--
+	q.inFlightBytes -= len(message.data)
+	q.mutex.Unlock()
+	q.memory.release(len(message.data))
+}
+
+func (q *clientQueue) starvationLimit() int {
+	if q.options.StarvationLimit <= 0 {
+		return defaultStarvationLimit
+	}
+	return q.options.StarvationLimit
+}
+
+// len returns the number of queued messages.
+func (q *clientQueue) len() int {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	return q.count
+}
+
+func (q *clientQueue) run() {
+	for {
+		select {
+		case <-q.wake:
+			q.flush()
+		case <-q.client.Done():
+			// best effort, so that last messages, e.g. the reason of a rejection, reach the client
+			q.flush()
+			return
+		}
+	}
+}
+
+// flush writes queued messages to the client one by one, until the queue is empty. Expired messages are dropped.
+// Failed writes of messages sent for a subscription are retried and reported according to its SendFailurePolicy.
+func (q *clientQueue) flush() {
+	for {
+		q.mutex.Lock()
+		message, found := q.pop()
+		q.mutex.Unlock()
+		if !found {
+			return
+		}
+
+		if expired(message.expiresAt, time.Now()) {
+			q.written(message)
+			q.mutex.Lock()
+			q.dropTransfer(message)
+			q.mutex.Unlock()
+			q.cancelDropped()
+			continue
+		}
+		err := q.client.write(message.data, message.binary)
+		q.written(message)
+		switch {
+		case message.context != nil && err == nil:
+			message.context.resetFailures()
+		case message.context != nil:
+			if sendErr := message.context.failed(message.outbound(), err); sendErr != nil {
+				message.context.Channel.error(sendErr)
+			}
+		case err != nil && q.onError != nil:
+			q.onError(err)
+		}
+	}
+}
@@ -0,0 +1,313 @@
+package pts
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// slowSocket blocks every write until release is called.
+type slowSocket struct {
+	gate     chan struct{}
+	mutex    sync.Mutex
+	received []string
+}
+
+func newSlowSocket() *slowSocket {
+	return &slowSocket{gate: make(chan struct{})}
+}
+
+func (s *slowSocket) send(message []byte) error {
+	<-s.gate
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.received = append(s.received, string(message))
+	return nil
+}
+
+func (s *slowSocket) release() {
+	close(s.gate)
+}
+
+func (s *slowSocket) waitFor(t *testing.T, count int) []string {
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		s.mutex.Lock()
+		received := append([]string{}, s.received...)
+		s.mutex.Unlock()
+		if len(received) >= count {
+			return received
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("received less than %d messages", count)
+	return nil
+}
+
+// fillQueue sends a first message, which blocks the writer, and waits until the writer picked it up.
+func fillQueue(t *testing.T, client *Client) {
+	if err := client.Send([]byte("0")); err != nil {
+		t.Fatalf("client.Send(0) = %v, want nil", err)
+	}
+	deadline := time.Now().Add(time.Second)
+	for client.queue.len() > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("writer did not pick up the first message")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestClientQueue(t *testing.T) {
+	t.Run("Send does not block on a slow client", func(t *testing.T) {
+		connector := NewConnector(nil, nil)
+		connector.setQueueOptions(QueueOptions{MaxMessages: 10})
+		socket := newSlowSocket()
+		client := connector.Join(socket.send, nil)
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			for _, message := range []string{"1", "2", "3"} {
+				client.Send([]byte(message))
+			}
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("client.Send blocked on a slow client")
+		}
+
+		socket.release()
+		received := socket.waitFor(t, 3)
+		if received[0] != "1" || received[1] != "2" || received[2] != "3" {
+			t.Errorf("received = %v, want [1 2 3]", received)
+		}
+	})
+
+	t.Run("Drop oldest", func(t *testing.T) {
+		connector := NewConnector(nil, nil)
+		connector.setQueueOptions(QueueOptions{MaxMessages: 3, Policy: SlowConsumerDropOldest})
+		socket := newSlowSocket()
+		client := connector.Join(socket.send, nil)
+
+		fillQueue(t, client)
+		for _, message := range []string{"1", "2", "3"} {
+			if err := client.Send([]byte(message)); err != nil {
+				t.Errorf("client.Send(%s) = %v, want nil", message, err)
+			}
+		}
+
+		socket.release()
+		received := socket.waitFor(t, 3)
+		if len(received) != 3 || received[1] != "2" || received[2] != "3" {
+			t.Errorf("received = %v, want [0 2 3]", received)
+		}
+	})
+
+	t.Run("Drop newest", func(t *testing.T) {
+		connector := NewConnector(nil, nil)
+		connector.setQueueOptions(QueueOptions{MaxBytes: 3, Policy: SlowConsumerDropNewest})
+		socket := newSlowSocket()
+		client := connector.Join(socket.send, nil)
+
+		fillQueue(t, client)
+		client.Send([]byte("1"))
+		client.Send([]byte("2"))
+		if err := client.Send([]byte("3")); !errors.Is(err, ErrQueueFull) {
+			t.Errorf("client.Send(3) = %v, want %v", err, ErrQueueFull)
+		}
+
+		socket.release()
+		received := socket.waitFor(t, 3)
+		if len(received) != 3 || received[1] != "1" || received[2] != "2" {
+			t.Errorf("received = %v, want [0 1 2]", received)
+		}
+	})
+
+	t.Run("Disconnect", func(t *testing.T) {
+		connector := NewConnector(nil, nil)
+		connector.setQueueOptions(QueueOptions{MaxMessages: 2, Policy: SlowConsumerDisconnect})
+		socket := newSlowSocket()
+		defer socket.release()
+		client := connector.Join(socket.send, nil)
+
+		fillQueue(t, client)
+		client.Send([]byte("1"))
+		if err := client.Send([]byte("2")); !errors.Is(err, ErrQueueFull) {
+			t.Errorf("client.Send(2) = %v, want %v", err, ErrQueueFull)
+		}
+
+		select {
+		case <-client.Done():
+		case <-time.After(time.Second):
+			t.Fatalf("slow client was not disconnected")
+		}
+		if reason := client.DisconnectReason(); reason != UnsubscribeReasonSlowConsumer {
+			t.Errorf("client.DisconnectReason() = %s, want %s", reason, UnsubscribeReasonSlowConsumer)
+		}
+	})
+
+	t.Run("Global memory cap", func(t *testing.T) {
+		connector := NewConnector(nil, nil)
+		connector.setQueueOptions(QueueOptions{MaxTotalBytes: 3, Policy: SlowConsumerDropNewest})
+		socket := newSlowSocket()
+		defer socket.release()
+		first := connector.Join(socket.send, nil)
+		second := connector.Join(socket.send, nil)
+
+		if err := first.Send([]byte("12")); err != nil {
+			t.Errorf("first.Send(12) = %v, want nil", err)
+		}
+		if err := second.Send([]byte("34")); !errors.Is(err, ErrQueueFull) {
+			t.Errorf("second.Send(34) = %v, want %v", err, ErrQueueFull)
+		}
+		if err := second.Send([]byte("5")); err != nil {
+			t.Errorf("second.Send(5) = %v, want nil", err)
+		}
+	})
+
+	t.Run("Sending after leave fails", func(t *testing.T) {
+		connector := NewConnector(nil, nil)
+		connector.setQueueOptions(QueueOptions{})
+		client := connector.Join(func(message []byte) error { return nil }, nil)
+		connector.Leave(client.Id)
+
+		if err := client.Send([]byte("1")); !errors.Is(err, ErrContextClosed) {
+			t.Errorf("client.Send(1) = %v, want %v", err, ErrContextClosed)
+		}
+	})
+
+	t.Run("High priority messages jump ahead", func(t *testing.T) {
+		connector := NewConnector(nil, nil)
+		connector.setQueueOptions(QueueOptions{})
+		socket := newSlowSocket()
+		client := connector.Join(socket.send, nil)
+
+		fillQueue(t, client)
+		client.SendWithOptions([]byte("bulk1"), &SendOptions{Priority: PriorityLow})
+		client.Send([]byte("normal"))
+		client.SendWithOptions([]byte("bulk2"), &SendOptions{Priority: PriorityLow})
+		client.SendError(NewError(nil, ErrorQueueFull, "logged out", nil))
+
+		socket.release()
+		received := socket.waitFor(t, 5)
+		if !strings.Contains(received[1], "logged out") || received[2] != "normal" || received[3] != "bulk1" || received[4] != "bulk2" {
+			t.Errorf("received = %v, want [0 error normal bulk1 bulk2]", received)
+		}
+	})
+
+	t.Run("Low priority messages do not starve", func(t *testing.T) {
+		connector := NewConnector(nil, nil)
+		connector.setQueueOptions(QueueOptions{StarvationLimit: 2})
+		socket := newSlowSocket()
+		client := connector.Join(socket.send, nil)
+
+		fillQueue(t, client)
+		client.SendWithOptions([]byte("low"), &SendOptions{Priority: PriorityLow})
+		for i := 1; i <= 4; i++ {
+			client.SendWithOptions([]byte("high"+strconv.Itoa(i)), &SendOptions{Priority: PriorityHigh})
+		}
+
+		socket.release()
+		received := socket.waitFor(t, 6)
+		if received[3] != "low" {
+			t.Errorf("received = %v, want low after two high priority messages", received)
+		}
+	})
+
+	t.Run("Drop oldest keeps higher priorities", func(t *testing.T) {
+		connector := NewConnector(nil, nil)
+		connector.setQueueOptions(QueueOptions{MaxMessages: 3, Policy: SlowConsumerDropOldest})
+		socket := newSlowSocket()
+		client := connector.Join(socket.send, nil)
+
+		fillQueue(t, client)
+		client.SendWithOptions([]byte("high"), &SendOptions{Priority: PriorityHigh})
+		client.SendWithOptions([]byte("low1"), &SendOptions{Priority: PriorityLow})
+		client.SendWithOptions([]byte("low2"), &SendOptions{Priority: PriorityLow})
+		if err := client.Send([]byte("normal")); err != nil {
+			t.Errorf("client.Send(normal) = %v, want nil", err)
+		}
+		if err := client.SendWithOptions([]byte("low3"), &SendOptions{Priority: PriorityLow}); !errors.Is(err, ErrQueueFull) {
+			t.Errorf("client.SendWithOptions(low3) = %v, want %v", err, ErrQueueFull)
+		}
+
+		socket.release()
+		received := socket.waitFor(t, 3)
+		if len(received) != 3 || received[1] != "high" || received[2] != "normal" {
+			t.Errorf("received = %v, want [0 high normal]", received)
+		}
+	})
+
+	t.Run("Keyed messages only replace messages of the same priority", func(t *testing.T) {
+		connector := NewConnector(nil, nil)
+		connector.setQueueOptions(QueueOptions{})
+		socket := newSlowSocket()
+		client := connector.Join(socket.send, nil)
+
+		fillQueue(t, client)
+		client.send(outbound{data: []byte("low"), key: "k", priority: PriorityLow})
+		client.send(outbound{data: []byte("normal1"), key: "k"})
+		client.send(outbound{data: []byte("normal2"), key: "k"})
+
+		socket.release()
+		if received := socket.waitFor(t, 3); len(received) != 3 || received[1] != "normal2" || received[2] != "low" {
+			t.Errorf("received = %v, want [0 normal2 low]", received)
+		}
+	})
+
+	t.Run("Messages being written count against the limits", func(t *testing.T) {
+		connector := NewConnector(nil, nil)
+		connector.setQueueOptions(QueueOptions{MaxMessages: 2, MaxBytes: 3, Policy: SlowConsumerDropNewest})
+		socket := newSlowSocket()
+		client := connector.Join(socket.send, nil)
+
+		fillQueue(t, client)
+		if err := client.Send([]byte("12")); err != nil {
+			t.Errorf("client.Send(12) = %v, want nil", err)
+		}
+		if err := client.Send([]byte("3")); !errors.Is(err, ErrQueueFull) {
+			t.Errorf("client.Send(3) = %v, want %v", err, ErrQueueFull)
+		}
+
+		socket.release()
+		socket.waitFor(t, 2)
+		deadline := time.Now().Add(time.Second)
+		for client.Send([]byte("4")) != nil {
+			if time.Now().After(deadline) {
+				t.Fatalf("client.Send(4) failed after the queue was written")
+			}
+			time.Sleep(time.Millisecond)
+		}
+	})
+
+	t.Run("Expired messages are dropped", func(t *testing.T) {
+		connector := NewConnector(nil, nil)
+		connector.setQueueOptions(QueueOptions{MaxMessages: 3, Policy: SlowConsumerDropNewest})
+		socket := newSlowSocket()
+		client := connector.Join(socket.send, nil)
+
+		fillQueue(t, client)
+		client.send(outbound{data: []byte("stale"), expiresAt: time.Now().Add(10 * time.Millisecond)})
+		client.send(outbound{data: []byte("fresh")})
+		time.Sleep(20 * time.Millisecond)
+		// the queue is full, but the expired message makes room
+		if err := client.Send([]byte("new")); err != nil {
+			t.Errorf("client.Send(new) = %v, want nil", err)
+		}
+		client.send(outbound{data: []byte("expiring"), expiresAt: time.Now().Add(-time.Millisecond)})
+
+		socket.release()
+		socket.waitFor(t, 3)
+		// give the writer time to write messages that should have been dropped
+		time.Sleep(10 * time.Millisecond)
+		if received := socket.waitFor(t, 3); len(received) != 3 || received[1] != "fresh" || received[2] != "new" {
+			t.Errorf("received = %v, want [0 fresh new]", received)
+		}
+	})
+}
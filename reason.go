@@ -0,0 +1,39 @@
+package pts
+
+import "fmt"
+
+// UnsubscribeReason describes why a subscription or a connection ended.
+type UnsubscribeReason int
+
+const (
+	UnsubscribeReasonNone                UnsubscribeReason = iota // UnsubscribeReasonNone if the subscription or connection did not end yet
+	UnsubscribeReasonClientRequest                                // UnsubscribeReasonClientRequest if the client unsubscribed
+	UnsubscribeReasonClientDisconnect                             // UnsubscribeReasonClientDisconnect if the client disconnected
+	UnsubscribeReasonServerKick                                   // UnsubscribeReasonServerKick if the server removed the client
+	UnsubscribeReasonHeartbeatTimeout                             // UnsubscribeReasonHeartbeatTimeout if the connection timed out
+	UnsubscribeReasonShutdown                                     // UnsubscribeReasonShutdown if the TubeSystem shuts down
+	UnsubscribeReasonChannelUnregistered                          // UnsubscribeReasonChannelUnregistered if the Channel was unregistered
+	UnsubscribeReasonExpired                                      // UnsubscribeReasonExpired if the subscription expired
+	UnsubscribeReasonSlowConsumer                                 // UnsubscribeReasonSlowConsumer if the client could not keep up with its outbound queue
+	UnsubscribeReasonSendFailed                                   // UnsubscribeReasonSendFailed if sending to the client failed repeatedly
+)
+
+var unsubscribeReasonNames = map[UnsubscribeReason]string{
+	UnsubscribeReasonNone:                "none",
+	UnsubscribeReasonClientRequest:       "client_request",
+	UnsubscribeReasonClientDisconnect:    "client_disconnect",
+	UnsubscribeReasonServerKick:          "server_kick",
+	UnsubscribeReasonHeartbeatTimeout:    "heartbeat_timeout",
+	UnsubscribeReasonShutdown:            "shutdown",
+	UnsubscribeReasonChannelUnregistered: "channel_unregistered",
+	UnsubscribeReasonExpired:             "expired",
+	UnsubscribeReasonSlowConsumer:        "slow_consumer",
+	UnsubscribeReasonSendFailed:          "send_failed",
+}
+
+func (reason UnsubscribeReason) String() string {
+	if name, found := unsubscribeReasonNames[reason]; found {
+		return name
+	}
+	return fmt.Sprintf("UnsubscribeReason(%d)", int(reason))
+}
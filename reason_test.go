@@ -0,0 +1,14 @@
+package pts
+
+import "testing"
+
+func TestUnsubscribeReason(t *testing.T) {
+	t.Run("String", func(t *testing.T) {
+		if UnsubscribeReasonHeartbeatTimeout.String() != "heartbeat_timeout" {
+			t.Errorf("UnsubscribeReasonHeartbeatTimeout.String() = %s, want %s", UnsubscribeReasonHeartbeatTimeout.String(), "heartbeat_timeout")
+		}
+		if UnsubscribeReason(99).String() != "UnsubscribeReason(99)" {
+			t.Errorf("UnsubscribeReason(99).String() = %s, want %s", UnsubscribeReason(99).String(), "UnsubscribeReason(99)")
+		}
+	})
+}
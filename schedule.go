@@ -0,0 +1,259 @@
+package pts
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	schedulerTick  = 10 * time.Millisecond
+	schedulerSlots = 512
+)
+
+type scheduleState int
+
+const (
+	schedulePending scheduleState = iota
+	scheduleDue                   // scheduleDue messages left the wheel and wait for the dispatcher
+	scheduleFired
+	scheduleCancelled
+)
+
+// ScheduledMessage is a message that is sent at a later time, see TubeSystem.SendAt and TubeSystem.BroadcastAt.
+// It is cancelled automatically if its path has no subscribers anymore, if the targeted client unsubscribes
+// from the path, if the channel is unregistered or if the TubeSystem shuts down, also while it waits to be dispatched.
+type ScheduledMessage struct {
+	at        time.Time
+	path      string
+	channel   *Channel
+	clientId  string
+	send      func()
+	slot      int
+	rounds    int
+	state     scheduleState
+	done      chan struct{}
+	scheduler *scheduler
+}
+
+// At returns the time the message is sent at.
+func (m *ScheduledMessage) At() time.Time {
+	return m.at
+}
+
+// Done returns a channel that is closed as soon as the message was sent or cancelled.
+func (m *ScheduledMessage) Done() <-chan struct{} {
+	return m.done
+}
+
+// Cancel cancels the message, it returns false if the message was already sent or cancelled.
+func (m *ScheduledMessage) Cancel() bool {
+	return m.scheduler.cancel(m)
+}
+
+// Cancelled returns true if the message was cancelled.
+func (m *ScheduledMessage) Cancelled() bool {
+	m.scheduler.mutex.Lock()
+	defer m.scheduler.mutex.Unlock()
+	return m.state == scheduleCancelled
+}
+
+// scheduler is a hashed timer wheel, its ticker only runs while messages are pending.
+// Due messages are sent in order by a dispatcher goroutine, so a slow send does not delay the ticker.
+type scheduler struct {
+	slots       []map[*ScheduledMessage]struct{}
+	byPath      map[string]map[*ScheduledMessage]struct{}
+	position    int
+	base        time.Time
+	processed   int64
+	count       int
+	stop        chan struct{}
+	outbox      []*ScheduledMessage
+	dispatching bool
+	mutex       sync.Mutex
+}
+
+// schedule adds a message to the wheel, send is executed at the given time.
+func (s *scheduler) schedule(channel *Channel, path string, clientId string, at time.Time, send func()) *ScheduledMessage {
+	m := &ScheduledMessage{
+		at:        at,
+		path:      path,
+		channel:   channel,
+		clientId:  clientId,
+		send:      send,
+		done:      make(chan struct{}),
+		scheduler: s,
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.slots == nil {
+		s.slots = make([]map[*ScheduledMessage]struct{}, schedulerSlots)
+		for i := range s.slots {
+			s.slots[i] = map[*ScheduledMessage]struct{}{}
+		}
+		s.byPath = map[string]map[*ScheduledMessage]struct{}{}
+	}
+	if s.count == 0 {
+		s.start()
+	}
+
+	now := s.base.Add(time.Duration(s.processed) * schedulerTick)
+	ticks := int((at.Sub(now) + schedulerTick - 1) / schedulerTick)
+	if ticks < 1 {
+		ticks = 1
+	}
+	m.slot = (s.position + ticks) % schedulerSlots
+	m.rounds = (ticks - 1) / schedulerSlots
+	s.slots[m.slot][m] = struct{}{}
+	if s.byPath[path] == nil {
+		s.byPath[path] = map[*ScheduledMessage]struct{}{}
+	}
+	s.byPath[path][m] = struct{}{}
+	s.count++
+	return m
+}
+
+// start starts the ticker, the caller must hold the lock.
+func (s *scheduler) start() {
+	s.base = time.Now()
+	s.processed = 0
+	stop := make(chan struct{})
+	s.stop = stop
+	go func() {
+		ticker := time.NewTicker(schedulerTick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				s.advance()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// remove removes a pending message from the wheel, the caller must hold the lock.
+func (s *scheduler) remove(m *ScheduledMessage, state scheduleState) {
+	m.state = state
+	delete(s.slots[m.slot], m)
+	delete(s.byPath[m.path], m)
+	if len(s.byPath[m.path]) == 0 {
+		delete(s.byPath, m.path)
+	}
+	s.count--
+	if s.count == 0 {
+		close(s.stop)
+	}
+}
+
+// advance processes all slots up to the current time and passes the due messages to the dispatcher.
+func (s *scheduler) advance() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	target := int64(time.Since(s.base) / schedulerTick)
+	for s.count > 0 && s.processed < target {
+		s.processed++
+		s.position = (s.position + 1) % schedulerSlots
+		for m := range s.slots[s.position] {
+			if m.rounds > 0 {
+				m.rounds--
+				continue
+			}
+			s.remove(m, scheduleDue)
+			s.outbox = append(s.outbox, m)
+		}
+	}
+	if len(s.outbox) > 0 && !s.dispatching {
+		s.dispatching = true
+		go s.dispatch()
+	}
+}
+
+// dispatch sends the due messages in order until the outbox is empty, cancelled messages are skipped.
+func (s *scheduler) dispatch() {
+	for {
+		s.mutex.Lock()
+		if len(s.outbox) == 0 {
+			s.outbox = nil
+			s.dispatching = false
+			s.mutex.Unlock()
+			return
+		}
+		m := s.outbox[0]
+		s.outbox[0] = nil
+		s.outbox = s.outbox[1:]
+		if m.state != scheduleDue {
+			s.mutex.Unlock()
+			continue
+		}
+		m.state = scheduleFired
+		s.mutex.Unlock()
+
+		m.send()
+		close(m.done)
+	}
+}
+
+func (s *scheduler) cancel(m *ScheduledMessage) bool {
+	s.mutex.Lock()
+	switch m.state {
+	case schedulePending:
+		s.remove(m, scheduleCancelled)
+	case scheduleDue:
+		m.state = scheduleCancelled
+	default:
+		s.mutex.Unlock()
+		return false
+	}
+	s.mutex.Unlock()
+	close(m.done)
+	return true
+}
+
+// cancelWhere cancels the pending and due messages of the path that match, all paths are searched if path is empty.
+func (s *scheduler) cancelWhere(path string, match func(m *ScheduledMessage) bool) {
+	if s == nil {
+		return
+	}
+	var cancelled []*ScheduledMessage
+	s.mutex.Lock()
+	for candidatePath, messages := range s.byPath {
+		if path != "" && candidatePath != path {
+			continue
+		}
+		for m := range messages {
+			if match(m) {
+				cancelled = append(cancelled, m)
+			}
+		}
+	}
+	for _, m := range cancelled {
+		s.remove(m, scheduleCancelled)
+	}
+	for _, m := range s.outbox {
+		if m.state == scheduleDue && (path == "" || m.path == path) && match(m) {
+			m.state = scheduleCancelled
+			cancelled = append(cancelled, m)
+		}
+	}
+	s.mutex.Unlock()
+
+	for _, m := range cancelled {
+		close(m.done)
+	}
+}
+
+// unsubscribed cancels the messages for the client of the Context, and all messages of its path if it was the last subscriber.
+func (s *scheduler) unsubscribed(context *Context, lastSubscriber bool) {
+	s.cancelWhere(context.FullPath, func(m *ScheduledMessage) bool {
+		return lastSubscriber || m.clientId == context.Client.Id
+	})
+}
+
+// unregistered cancels all messages of the Channel.
+func (s *scheduler) unregistered(channel *Channel) {
+	s.cancelWhere("", func(m *ScheduledMessage) bool {
+		return m.channel == channel
+	})
+}
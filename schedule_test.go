@@ -0,0 +1,177 @@
+package pts
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func waitDone(t *testing.T, m *ScheduledMessage) {
+	select {
+	case <-m.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("scheduled message is still pending")
+	}
+}
+
+func TestScheduledMessages(t *testing.T) {
+	t.Run("SendAfter and BroadcastAt", func(t *testing.T) {
+		connector := NewConnector(nil, nil)
+		tubeSystem := New(connector)
+		tubeSystem.RegisterChannel("auctions/:id", ChannelHandlers{})
+		worker := newGroupWorker(connector)
+		connector.Message(worker.client.Id, SubMessage("auctions/1"))
+
+		start := time.Now()
+		reminder, err := tubeSystem.SendAfter("auctions/1", worker.client.Id, []byte(`"reminder"`), 30*time.Millisecond)
+		if err != nil {
+			t.Fatalf("tubeSystem.SendAfter(...) = %v, want nil", err)
+		}
+		closing, _ := tubeSystem.BroadcastAt("auctions/1", []byte(`"closed"`), start.Add(60*time.Millisecond))
+
+		waitDone(t, reminder)
+		if elapsed := time.Since(start); elapsed < 30*time.Millisecond {
+			t.Errorf("reminder was sent after %s, want at least 30ms", elapsed)
+		}
+		waitDone(t, closing)
+
+		received := worker.received()
+		if len(received) != 2 || string(received[0].Payload) != `"reminder"` || string(received[1].Payload) != `"closed"` {
+			t.Errorf("received = %v, want reminder and closed", received)
+		}
+		if reminder.Cancel() {
+			t.Errorf("reminder.Cancel() = true after it was sent, want false")
+		}
+	})
+
+	t.Run("Cancel", func(t *testing.T) {
+		connector := NewConnector(nil, nil)
+		tubeSystem := New(connector)
+		tubeSystem.RegisterChannel("countdown", ChannelHandlers{})
+		worker := newGroupWorker(connector)
+		connector.Message(worker.client.Id, SubMessage("countdown"))
+
+		m, _ := tubeSystem.BroadcastAfter("countdown", []byte(`0`), 20*time.Millisecond)
+		if !m.Cancel() {
+			t.Errorf("m.Cancel() = false, want true")
+		}
+		time.Sleep(40 * time.Millisecond)
+		if !m.Cancelled() || len(worker.received()) != 0 {
+			t.Errorf("cancelled message was sent")
+		}
+	})
+
+	t.Run("Cancelled when the path has no subscribers or the channel is unregistered", func(t *testing.T) {
+		connector := NewConnector(nil, nil)
+		tubeSystem := New(connector)
+		tubeSystem.RegisterChannel("auctions/:id", ChannelHandlers{})
+		first := newGroupWorker(connector)
+		second := newGroupWorker(connector)
+		connector.Message(first.client.Id, SubMessage("auctions/1"))
+		connector.Message(second.client.Id, SubMessage("auctions/1"))
+		connector.Message(second.client.Id, SubMessage("auctions/2"))
+
+		toFirst, _ := tubeSystem.SendAfter("auctions/1", first.client.Id, []byte(`1`), time.Minute)
+		broadcast, _ := tubeSystem.BroadcastAfter("auctions/1", []byte(`1`), time.Minute)
+		abandoned, _ := tubeSystem.BroadcastAfter("auctions/2", []byte(`2`), time.Minute)
+
+		connector.Message(first.client.Id, UnsubMessage("auctions/1"))
+		if !toFirst.Cancelled() || broadcast.Cancelled() {
+			t.Errorf("cancelled = (%t, %t), want (true, false)", toFirst.Cancelled(), broadcast.Cancelled())
+		}
+
+		connector.Leave(second.client.Id)
+		if !broadcast.Cancelled() || !abandoned.Cancelled() {
+			t.Errorf("cancelled = (%t, %t) after the last subscriber left, want (true, true)", broadcast.Cancelled(), abandoned.Cancelled())
+		}
+
+		third := newGroupWorker(connector)
+		connector.Message(third.client.Id, SubMessage("auctions/2"))
+		other, _ := tubeSystem.BroadcastAfter("auctions/2", []byte(`2`), time.Minute)
+		tubeSystem.UnregisterChannel("auctions/:id")
+		waitDone(t, other)
+		if !other.Cancelled() {
+			t.Errorf("other.Cancelled() = false after unregister, want true")
+		}
+	})
+
+	t.Run("Wheel rounds", func(t *testing.T) {
+		s := &scheduler{}
+		fired := make(chan struct{})
+		far := s.schedule(nil, "a", "", time.Now().Add(schedulerTick*schedulerSlots*2), func() {})
+		near := s.schedule(nil, "a", "", time.Now().Add(schedulerTick), func() { close(fired) })
+
+		<-fired
+		s.mutex.Lock()
+		rounds := far.rounds
+		s.mutex.Unlock()
+		if rounds != 1 {
+			t.Errorf("far.rounds = %d, want 1", rounds)
+		}
+		if near.Cancel() {
+			t.Errorf("near.Cancel() = true after it was sent, want false")
+		}
+		if !far.Cancel() {
+			t.Errorf("far.Cancel() = false, want true")
+		}
+	})
+
+	t.Run("Slow sends do not block the wheel", func(t *testing.T) {
+		s := &scheduler{}
+		started := make(chan struct{})
+		release := make(chan struct{})
+		var sent int32
+		slow := s.schedule(nil, "a", "", time.Now().Add(schedulerTick), func() {
+			close(started)
+			<-release
+		})
+		next := s.schedule(nil, "b", "", time.Now().Add(2*schedulerTick), func() { atomic.StoreInt32(&sent, 1) })
+		<-started
+
+		deadline := time.Now().Add(time.Second)
+		for {
+			s.mutex.Lock()
+			state := next.state
+			s.mutex.Unlock()
+			if state == scheduleDue {
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("next.state = %d while a send blocks, want the wheel to advance", state)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		s.cancelWhere("", func(m *ScheduledMessage) bool { return true })
+		close(release)
+		waitDone(t, slow)
+		waitDone(t, next)
+		if !next.Cancelled() || atomic.LoadInt32(&sent) != 0 {
+			t.Errorf("next was sent after it was cancelled, want it to be dropped by the dispatcher")
+		}
+	})
+
+	t.Run("Broadcasts are rejected without subscribers and cancelled by unregister and shutdown", func(t *testing.T) {
+		connector := NewConnector(nil, nil)
+		tubeSystem := New(connector)
+		tubeSystem.RegisterChannel("auctions/:id", ChannelHandlers{})
+		tubeSystem.RegisterChannel("news", ChannelHandlers{})
+
+		if m, err := tubeSystem.BroadcastAfter("news", []byte(`1`), time.Minute); m != nil || !errors.Is(err, ErrNoSubscribers) {
+			t.Errorf("BroadcastAfter(...) without subscribers = %v, want ErrNoSubscribers", err)
+		}
+		worker := newGroupWorker(connector)
+		connector.Message(worker.client.Id, SubMessage("auctions/1"))
+		connector.Message(worker.client.Id, SubMessage("news"))
+		unregistered, _ := tubeSystem.BroadcastAfter("auctions/1", []byte(`1`), time.Minute)
+		shutdown, _ := tubeSystem.BroadcastAfter("news", []byte(`1`), time.Minute)
+		tubeSystem.UnregisterChannel("auctions/:id")
+		if !unregistered.Cancelled() || shutdown.Cancelled() {
+			t.Errorf("cancelled = (%t, %t) after unregister, want (true, false)", unregistered.Cancelled(), shutdown.Cancelled())
+		}
+		tubeSystem.Shutdown()
+		if !shutdown.Cancelled() {
+			t.Errorf("shutdown.Cancelled() = false after shutdown, want true")
+		}
+	})
+}
@@ -0,0 +1,89 @@
+package pts
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// SendFailureAction is taken when sending to a subscriber failed repeatedly.
+type SendFailureAction int
+
+const (
+	SendFailureIgnore      SendFailureAction = iota // SendFailureIgnore keeps the subscription
+	SendFailureUnsubscribe                          // SendFailureUnsubscribe unsubscribes the client from the path
+	SendFailureDisconnect                           // SendFailureDisconnect disconnects the client
+)
+
+// SendFailurePolicy describes how a Channel treats failed sends to a subscriber.
+type SendFailurePolicy struct {
+	// Retries is the number of times a failed send is retried. Retries run on a timer and do not block the sender,
+	// a send that is retried is not reported as failed to the sender.
+	Retries int
+	// Backoff is the delay before the first retry, it doubles with every retry.
+	Backoff time.Duration
+	// MaxFailures is the number of consecutive failed sends, after which Action is taken. Zero means 1.
+	MaxFailures int
+	Action      SendFailureAction
+}
+
+func (p *SendFailurePolicy) maxFailures() int32 {
+	if p.MaxFailures <= 0 {
+		return 1
+	}
+	return int32(p.MaxFailures)
+}
+
+func (c *Channel) sendFailurePolicy() *SendFailurePolicy {
+	if c == nil {
+		return nil
+	}
+	return c.options.SendFailurePolicy
+}
+
+// retry schedules the next attempt of a failed send according to the SendFailurePolicy, it returns false if the
+// retries are exhausted. Queued messages are queued again.
+func (c *Channel) retry(context *Context, message outbound) bool {
+	policy := c.sendFailurePolicy()
+	if policy == nil || message.attempt >= policy.Retries {
+		return false
+	}
+	delay := policy.Backoff << message.attempt
+	message.attempt++
+	time.AfterFunc(delay, func() {
+		if context.Err() != nil {
+			return
+		}
+		if err := context.transmit(message); err != nil {
+			c.error(err)
+		}
+	})
+	return true
+}
+
+// sendFailed executes the OnSendError handler and takes the action of the SendFailurePolicy.
+func (c *Channel) sendFailed(context *Context, err *Error) {
+	if c == nil {
+		return
+	}
+	if c.handlers.OnSendError != nil {
+		c.call(context, func() {
+			c.handlers.OnSendError(context, err)
+		})
+	}
+
+	policy := c.sendFailurePolicy()
+	if policy == nil || policy.Action == SendFailureIgnore {
+		return
+	}
+	if atomic.AddInt32(&context.sendFailures, 1) < policy.maxFailures() {
+		return
+	}
+	switch policy.Action {
+	case SendFailureUnsubscribe:
+		c.UnsubscribeWithReason(context.Client.Id, context.FullPath, UnsubscribeReasonSendFailed)
+	case SendFailureDisconnect:
+		if err := context.Client.DisconnectWithReason(UnsubscribeReasonSendFailed); err != nil {
+			c.error(NewError(context, ErrorDisconnectFailed, "failed to disconnect client after failed sends", err))
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package pts
+
+import (
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyClient fails the sends for which fail returns true.
+func flakyClient(id string, fail func(attempt int) bool) (*Client, *int32) {
+	var attempts int32
+	return &Client{Id: id, sendMessage: func(message []byte) error {
+		if fail(int(atomic.AddInt32(&attempts, 1))) {
+			return errors.New("broken pipe")
+		}
+		return nil
+	}}, &attempts
+}
+
+func TestSendFailurePolicy(t *testing.T) {
+	t.Run("Retries with backoff", func(t *testing.T) {
+		store := ChannelStore{}
+		store.init(func(err *Error) {})
+		channel := store.Register("scores", ChannelHandlers{}, ChannelOptions{
+			SendFailurePolicy: &SendFailurePolicy{Retries: 2, Backoff: time.Millisecond},
+		})
+		client, attempts := flakyClient("1", func(attempt int) bool { return attempt < 3 })
+		store.Subscribe(client, "scores")
+
+		if result := channel.Broadcast("scores", []byte(`1`), nil); result.HasErrors {
+			t.Errorf("channel.Broadcast(...).HasErrors = true, want false")
+		}
+		if got := atomic.LoadInt32(attempts); got != 1 {
+			t.Errorf("attempts = %d after the broadcast returned, want 1, retries must not block the sender", got)
+		}
+		deadline := time.Now().Add(time.Second)
+		for atomic.LoadInt32(attempts) < 3 && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(10 * time.Millisecond)
+		if got := atomic.LoadInt32(attempts); got != 3 {
+			t.Errorf("attempts = %d, want 3", got)
+		}
+	})
+
+	t.Run("Unsubscribes after consecutive failures", func(t *testing.T) {
+		store := ChannelStore{}
+		store.init(func(err *Error) {})
+		var sendErrors []*Error
+		var reason UnsubscribeReason
+		channel := store.Register("scores", ChannelHandlers{
+			OnSendError: func(s *Context, err *Error) {
+				sendErrors = append(sendErrors, err)
+			},
+			OnUnsubscribe: func(s *Context) {
+				reason = s.UnsubscribeReason()
+			},
+		}, ChannelOptions{
+			SendFailurePolicy: &SendFailurePolicy{MaxFailures: 2, Action: SendFailureUnsubscribe},
+		})
+		// the second send succeeds, which resets the consecutive failures
+		client, _ := flakyClient("1", func(attempt int) bool { return attempt != 2 })
+		store.Subscribe(client, "scores")
+
+		for i := 0; i < 3; i++ {
+			channel.Broadcast("scores", []byte(`1`), nil)
+			if !channel.IsSubscribed(client.Id, "scores") {
+				t.Fatalf("client was unsubscribed after %d broadcasts, want 4", i+1)
+			}
+		}
+		channel.Broadcast("scores", []byte(`1`), nil)
+
+		if channel.IsSubscribed(client.Id, "scores") {
+			t.Errorf("channel.IsSubscribed(...) = true, want false")
+		}
+		if reason != UnsubscribeReasonSendFailed {
+			t.Errorf("s.UnsubscribeReason() = %s, want %s", reason, UnsubscribeReasonSendFailed)
+		}
+		if len(sendErrors) != 3 || sendErrors[0].Code != ErrorSendingMessageFailed {
+			t.Errorf("OnSendError received %v, want 3 errors with code %s", sendErrors, ErrorSendingMessageFailed)
+		}
+	})
+
+	t.Run("Failed writes of the queue apply the policy", func(t *testing.T) {
+		connector := NewConnector(nil, nil)
+		tubeSystem := New(connector)
+		tubeSystem.SetQueueOptions(QueueOptions{})
+		sendErrors := make(chan *Error, 1)
+		channel := tubeSystem.RegisterChannel("scores", ChannelHandlers{
+			OnSendError: func(s *Context, err *Error) {
+				sendErrors <- err
+			},
+		}, ChannelOptions{
+			SendFailurePolicy: &SendFailurePolicy{Retries: 1, Backoff: time.Millisecond, Action: SendFailureUnsubscribe},
+		})
+		var attempts int32
+		client := connector.Join(func(message []byte) error {
+			atomic.AddInt32(&attempts, 1)
+			return errors.New("broken pipe")
+		}, nil)
+		connector.Message(client.Id, SubMessage("scores"))
+
+		channel.Broadcast("scores", []byte(`1`), nil)
+		select {
+		case err := <-sendErrors:
+			if err.Code != ErrorSendingMessageFailed {
+				t.Errorf("OnSendError received %v, want code %s", err, ErrorSendingMessageFailed)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("OnSendError was not called for a failed queued write")
+		}
+		deadline := time.Now().Add(time.Second)
+		for channel.IsSubscribed(client.Id, "scores") && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		if channel.IsSubscribed(client.Id, "scores") {
+			t.Errorf("channel.IsSubscribed(...) = true, want false")
+		}
+		// the broadcast and its retry
+		if got := atomic.LoadInt32(&attempts); got != 2 {
+			t.Errorf("attempts = %d, want 2", got)
+		}
+	})
+
+	t.Run("Disconnects the client", func(t *testing.T) {
+		fakeConnector, fakeSocket := NewFakeConnector(func(err *Error) {})
+		tubeSystem := New(fakeConnector)
+		tubeSystem.RegisterChannel("scores", ChannelHandlers{}, ChannelOptions{
+			SendFailurePolicy: &SendFailurePolicy{Action: SendFailureDisconnect},
+		})
+
+		fakeClient := fakeSocket.NewClientConnects(func(_ []byte) {})
+		fakeClient.Send(SubMessage("scores"))
+		client := fakeConnector.clients.Get(fakeClient.Id)
+		client.sendMessage = func(message []byte) error {
+			return errors.New("broken pipe")
+		}
+
+		tubeSystem.Send("scores", client.Id, []byte(`1`))
+
+		if tubeSystem.IsConnected(client.Id) {
+			t.Errorf("tubeSystem.IsConnected(...) = true, want false")
+		}
+		if reason := client.DisconnectReason(); reason != UnsubscribeReasonSendFailed {
+			t.Errorf("client.DisconnectReason() = %s, want %s", reason, UnsubscribeReasonSendFailed)
+		}
+	})
+}
@@ -2,72 +2,230 @@ package pts
 
 import "sync"
 
-type ChannelSubscribers struct {
-	subscribers map[string]*Context
-	mutex       sync.RWMutex
+// subscriberShard indexes the subscriptions of a subset of the paths of a Channel by path and by client.
+type subscriberShard struct {
+	byPath   map[string]map[string]*Context
+	byClient map[string]map[string]*Context
+	mutex    sync.RWMutex
 }
 
-func createKey(clientId string, path string) string {
-	return clientId + "__" + path
+func newSubscriberShard() *subscriberShard {
+	return &subscriberShard{
+		byPath:   map[string]map[string]*Context{},
+		byClient: map[string]map[string]*Context{},
+	}
+}
+
+// ChannelSubscribers stores the subscriptions of a Channel, indexed by path and by client.
+// Paths are distributed over one or more shards, each guarded by its own lock.
+type ChannelSubscribers struct {
+	shards []*subscriberShard
+	once   sync.Once
 }
 
 func (subs *ChannelSubscribers) init() {
-	subs.subscribers = map[string]*Context{}
+	subs.initShards(1)
+}
+
+// initShards initializes the subscribers with the given number of shards, only the first call has an effect.
+func (subs *ChannelSubscribers) initShards(count int) {
+	subs.once.Do(func() {
+		if count < 1 {
+			count = 1
+		}
+		subs.shards = make([]*subscriberShard, count)
+		for i := range subs.shards {
+			subs.shards[i] = newSubscriberShard()
+		}
+	})
+}
+
+// shard returns the shard that stores the given path.
+func (subs *ChannelSubscribers) shard(path string) *subscriberShard {
+	subs.init()
+	if len(subs.shards) == 1 {
+		return subs.shards[0]
+	}
+	// FNV-1a
+	hash := uint32(2166136261)
+	for i := 0; i < len(path); i++ {
+		hash ^= uint32(path[i])
+		hash *= 16777619
+	}
+	return subs.shards[hash%uint32(len(subs.shards))]
+}
+
+func (subs *ChannelSubscribers) allShards() []*subscriberShard {
+	subs.init()
+	return subs.shards
 }
 
 func (subs *ChannelSubscribers) IsSubscribed(clientId string, path string) bool {
-	subs.mutex.Lock()
-	defer subs.mutex.Unlock()
-	var _, exists = subs.subscribers[createKey(clientId, path)]
+	_, exists := subs.GetContext(clientId, path)
 	return exists
 }
 
 func (subs *ChannelSubscribers) GetContext(clientId string, path string) (*Context, bool) {
-	subs.mutex.Lock()
-	defer subs.mutex.Unlock()
-	var context, exists = subs.subscribers[createKey(clientId, path)]
+	shard := subs.shard(path)
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+	context, exists := shard.byPath[path][clientId]
 	return context, exists
 }
 
 func (subs *ChannelSubscribers) Add(context *Context) {
-	subs.mutex.Lock()
-	defer subs.mutex.Unlock()
-	subs.subscribers[createKey(context.Client.Id, context.FullPath)] = context
+	shard := subs.shard(context.FullPath)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	shard.put(context)
 }
 
+// add adds the subscription unless the client is already subscribed to the path, it reports whether it was added.
+func (subs *ChannelSubscribers) add(context *Context) bool {
+	shard := subs.shard(context.FullPath)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	if _, exists := shard.byPath[context.FullPath][context.Client.Id]; exists {
+		return false
+	}
+	shard.put(context)
+	return true
+}
+
+// put indexes the subscription by path and by client, the caller must hold the lock of the shard.
+func (shard *subscriberShard) put(context *Context) {
+	clientId, path := context.Client.Id, context.FullPath
+	if shard.byPath[path] == nil {
+		shard.byPath[path] = map[string]*Context{}
+	}
+	shard.byPath[path][clientId] = context
+
+	if shard.byClient[clientId] == nil {
+		shard.byClient[clientId] = map[string]*Context{}
+	}
+	shard.byClient[clientId][path] = context
+}
+
+// GetAll returns a snapshot of all subscribers.
 func (subs *ChannelSubscribers) GetAll() []*Context {
 	var found []*Context
-	for _, context := range subs.subscribers {
-		found = append(found, context)
+	for _, shard := range subs.allShards() {
+		shard.mutex.RLock()
+		for _, contexts := range shard.byPath {
+			for _, context := range contexts {
+				found = append(found, context)
+			}
+		}
+		shard.mutex.RUnlock()
 	}
 	return found
 }
 
+// GetAllForPath returns a snapshot of all subscribers of the path.
 func (subs *ChannelSubscribers) GetAllForPath(path string) []*Context {
-	var found []*Context
-	for _, context := range subs.subscribers {
-		if context.FullPath == path {
-			found = append(found, context)
-		}
+	shard := subs.shard(path)
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+
+	contexts := shard.byPath[path]
+	if len(contexts) == 0 {
+		return nil
+	}
+	found := make([]*Context, 0, len(contexts))
+	for _, context := range contexts {
+		found = append(found, context)
 	}
 	return found
 }
 
+// Count returns the number of subscribers of the path.
+func (subs *ChannelSubscribers) Count(path string) int {
+	shard := subs.shard(path)
+	shard.mutex.RLock()
+	defer shard.mutex.RUnlock()
+	return len(shard.byPath[path])
+}
+
+// Paths returns all paths that have at least one subscriber.
+func (subs *ChannelSubscribers) Paths() []string {
+	var paths []string
+	for _, shard := range subs.allShards() {
+		shard.mutex.RLock()
+		for path := range shard.byPath {
+			paths = append(paths, path)
+		}
+		shard.mutex.RUnlock()
+	}
+	return paths
+}
+
 func (subs *ChannelSubscribers) RemoveAllPaths(clientId string) []*Context {
-	subs.mutex.Lock()
-	defer subs.mutex.Unlock()
 	var removed []*Context
-	for key, context := range subs.subscribers {
-		if context.Client.Id == clientId {
-			delete(subs.subscribers, key)
+	for _, shard := range subs.allShards() {
+		shard.mutex.Lock()
+		for path, context := range shard.byClient[clientId] {
+			shard.removeFromPath(clientId, path)
 			removed = append(removed, context)
 		}
+		delete(shard.byClient, clientId)
+		shard.mutex.Unlock()
 	}
 	return removed
 }
 
-func (subs *ChannelSubscribers) Remove(clientId string, path string) {
-	subs.mutex.Lock()
-	defer subs.mutex.Unlock()
-	delete(subs.subscribers, createKey(clientId, path))
+// Remove removes the subscription of the client to the path, it returns the removed Context or nil if there was none.
+func (subs *ChannelSubscribers) Remove(clientId string, path string) *Context {
+	shard := subs.shard(path)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+
+	paths, found := shard.byClient[clientId]
+	if !found {
+		return nil
+	}
+	context, found := paths[path]
+	if !found {
+		return nil
+	}
+	shard.removeFromPath(clientId, path)
+	delete(paths, path)
+	if len(paths) == 0 {
+		delete(shard.byClient, clientId)
+	}
+	return context
+}
+
+// removeContext removes the subscription if it is still held by the given Context.
+func (subs *ChannelSubscribers) removeContext(context *Context) {
+	shard := subs.shard(context.FullPath)
+	shard.mutex.Lock()
+	defer shard.mutex.Unlock()
+	clientId, path := context.Client.Id, context.FullPath
+	if shard.byPath[path][clientId] != context {
+		return
+	}
+	shard.removeFromPath(clientId, path)
+	delete(shard.byClient[clientId], path)
+	if len(shard.byClient[clientId]) == 0 {
+		delete(shard.byClient, clientId)
+	}
+}
+
+// removeFromPath removes the subscription from the path index, the caller must hold the lock of the shard.
+func (shard *subscriberShard) removeFromPath(clientId string, path string) {
+	if contexts, found := shard.byPath[path]; found {
+		delete(contexts, clientId)
+		if len(contexts) == 0 {
+			delete(shard.byPath, path)
+		}
+	}
+}
+
+// Range calls fn for each subscriber of a snapshot of the subscribers until fn returns false.
+func (subs *ChannelSubscribers) Range(fn func(context *Context) bool) {
+	for _, context := range subs.GetAll() {
+		if !fn(context) {
+			return
+		}
+	}
 }
@@ -0,0 +1,84 @@
+package pts
+
+import (
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestChannelSubscribers(t *testing.T) {
+	for _, shards := range []int{0, 1, 8} {
+		t.Run("Shards "+strconv.Itoa(shards), func(t *testing.T) {
+			subs := ChannelSubscribers{}
+			subs.initShards(shards)
+
+			subs.Add(&Context{Client: &Client{Id: "a"}, FullPath: "x/1"})
+			subs.Add(&Context{Client: &Client{Id: "a"}, FullPath: "x/2"})
+			subs.Add(&Context{Client: &Client{Id: "b"}, FullPath: "x/1"})
+
+			if count := subs.Count("x/1"); count != 2 {
+				t.Errorf("subs.Count(x/1) = %d, want 2", count)
+			}
+			if count := len(subs.GetAll()); count != 3 {
+				t.Errorf("len(subs.GetAll()) = %d, want 3", count)
+			}
+
+			paths := subs.Paths()
+			sort.Strings(paths)
+			if len(paths) != 2 || paths[0] != "x/1" || paths[1] != "x/2" {
+				t.Errorf("subs.Paths() = %v, want [x/1 x/2]", paths)
+			}
+
+			if removed := subs.RemoveAllPaths("a"); len(removed) != 2 {
+				t.Errorf("len(subs.RemoveAllPaths(a)) = %d, want 2", len(removed))
+			}
+			if subs.IsSubscribed("a", "x/1") || subs.IsSubscribed("a", "x/2") {
+				t.Errorf("client a is still subscribed after RemoveAllPaths")
+			}
+			if !subs.IsSubscribed("b", "x/1") {
+				t.Errorf("subs.IsSubscribed(b, x/1) = false, want true")
+			}
+
+			if removed := subs.Remove("b", "x/1"); removed == nil || removed.Client.Id != "b" {
+				t.Errorf("subs.Remove(b, x/1) = %v, want the context of b", removed)
+			}
+			if removed := subs.Remove("b", "x/1"); removed != nil {
+				t.Errorf("subs.Remove(b, x/1) = %v, want nil for a removed subscription", removed)
+			}
+			if paths := subs.Paths(); len(paths) != 0 {
+				t.Errorf("subs.Paths() = %v, want []", paths)
+			}
+		})
+	}
+
+	t.Run("Ids and paths containing separators do not collide", func(t *testing.T) {
+		subs := ChannelSubscribers{}
+		subs.Add(&Context{Client: &Client{Id: "a__b"}, FullPath: "c"})
+
+		if subs.IsSubscribed("a", "b__c") {
+			t.Errorf("subs.IsSubscribed(a, b__c) = true, want false")
+		}
+		if !subs.IsSubscribed("a__b", "c") {
+			t.Errorf("subs.IsSubscribed(a__b, c) = false, want true")
+		}
+	})
+
+	t.Run("SubscriberCount", func(t *testing.T) {
+		store := ChannelStore{}
+		store.init(func(err *Error) {
+			t.Errorf("error was thrown: %s", err.Description)
+		})
+		channel := store.Register("room/:id", ChannelHandlers{}, ChannelOptions{SubscriberShards: 4})
+
+		store.Subscribe(&Client{Id: "1"}, "room/a")
+		store.Subscribe(&Client{Id: "2"}, "room/a")
+		store.Subscribe(&Client{Id: "3"}, "room/b")
+
+		if count := channel.SubscriberCount("room/a"); count != 2 {
+			t.Errorf("channel.SubscriberCount(room/a) = %d, want 2", count)
+		}
+		if paths := channel.Paths(); len(paths) != 2 {
+			t.Errorf("channel.Paths() = %v, want 2 paths", paths)
+		}
+	})
+}
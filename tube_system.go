@@ -3,23 +3,55 @@ package pts
 import (
 	"encoding/json"
 	"net/http"
+	"sync"
+	"time"
 )
 
 const (
 	MessageTypeSubscribe      = "subscribe"
 	MessageTypeUnsubscribe    = "unsubscribe"
 	MessageTypeChannelMessage = "message"
+	MessageTypeError          = "error"
+	MessageTypeAck            = "ack"
+	MessageTypeCancel         = "cancel"
 )
 
 type Message struct {
 	Type    string          `json:"type"`
 	Channel string          `json:"channel"`
 	Payload json.RawMessage `json:"payload"`
+	Id      string          `json:"id,omitempty"`
+	// ExpiresAt is the unix time in milliseconds after which the message is stale, zero if it does not expire.
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
+	// IdempotencyKey identifies a message sent by a client, retries with the same key can be deduplicated.
+	IdempotencyKey string `json:"idempotencyKey,omitempty"`
+	// Timestamp is the unix time in milliseconds the message was sent or received by the server, zero if unknown.
+	Timestamp int64 `json:"timestamp,omitempty"`
+	// Sender is the id of the client that sent a relayed message.
+	Sender string `json:"sender,omitempty"`
+	// Headers are free-form metadata of the message.
+	Headers map[string]string `json:"headers,omitempty"`
+	// Encoding of the payload, empty for JSON, PayloadEncodingBase64 or PayloadEncodingBinary. Use Bytes to read opaque payloads.
+	Encoding string `json:"encoding,omitempty"`
+	// Chunk is set if the message is a fragment of a chunked transfer, or identifies the transfer of a cancel message.
+	Chunk *Chunk `json:"chunk,omitempty"`
 }
 
+// ConnectHandlerFunc is executed when a client connects, if it returns a non nil Error the connection is rejected.
+type ConnectHandlerFunc func(client *Client) *Error
+
+// DisconnectHandlerFunc is executed when a client, whose connection was accepted, disconnects.
+type DisconnectHandlerFunc func(client *Client, reason UnsubscribeReason)
+
 type TubeSystem struct {
-	connector *Connector
-	channels  ChannelStore
+	connector          *Connector
+	channels           ChannelStore
+	connectHandlers    []ConnectHandlerFunc
+	disconnectHandlers []DisconnectHandlerFunc
+	handlersMutex      sync.RWMutex
+	plugins            plugins
+	inbound            InboundOptions
+	inboundMutex       sync.RWMutex
 }
 
 // New Creates a new TubeSystem instance
@@ -28,18 +60,103 @@ func New(connector *Connector) *TubeSystem {
 
 	r.connector = connector
 	r.channels.init(connector.error)
+	r.channels.plugins = &r.plugins
 	r.connector.hook(&Hooks{
-		OnConnect:    r.connectHandler,
-		OnDisconnect: r.disconnectHandler,
-		OnMessage:    r.messageHandler,
+		OnConnect:       r.connectHandler,
+		OnDisconnect:    r.disconnectHandler,
+		OnMessage:       r.messageHandler,
+		OnBinaryMessage: r.binaryMessageHandler,
+		OnError:         r.plugins.onError,
 	})
 
 	return &r
 }
 
-// RegisterChannel registers a new channel
-func (r *TubeSystem) RegisterChannel(channelName string, handlers ChannelHandlers) *Channel {
-	return r.channels.Register(channelName, handlers)
+// RegisterChannel registers a new channel, optionally configured by ChannelOptions
+func (r *TubeSystem) RegisterChannel(channelName string, handlers ChannelHandlers, options ...ChannelOptions) *Channel {
+	return r.channels.Register(channelName, handlers, options...)
+}
+
+// OnConnect registers a handler that is executed when a client connects, handlers are executed in the order they were registered.
+// If a handler returns an Error, the error is sent to the client and the connection is closed.
+func (r *TubeSystem) OnConnect(handler ConnectHandlerFunc) *TubeSystem {
+	r.handlersMutex.Lock()
+	defer r.handlersMutex.Unlock()
+	r.connectHandlers = append(r.connectHandlers, handler)
+	return r
+}
+
+// OnDisconnect registers a handler that is executed when a client disconnects, handlers are executed in the order they were registered.
+func (r *TubeSystem) OnDisconnect(handler DisconnectHandlerFunc) *TubeSystem {
+	r.handlersMutex.Lock()
+	defer r.handlersMutex.Unlock()
+	r.disconnectHandlers = append(r.disconnectHandlers, handler)
+	return r
+}
+
+// Install installs plugins, their hooks are executed in the order the plugins were installed.
+func (r *TubeSystem) Install(plugins ...Plugin) *TubeSystem {
+	for _, plugin := range plugins {
+		r.plugins.install(plugin)
+		if hook, ok := plugin.(ConnectPlugin); ok {
+			r.OnConnect(hook.OnConnect)
+		}
+		if hook, ok := plugin.(DisconnectPlugin); ok {
+			r.OnDisconnect(hook.OnDisconnect)
+		}
+	}
+	return r
+}
+
+// InterceptOutbound adds interceptors that are executed for every payload sent to a subscriber, e.g. by Context.Send,
+// Context.Broadcast or TubeSystem.Send. Interceptors are executed in the order they were added.
+func (r *TubeSystem) InterceptOutbound(interceptors ...OutboundInterceptor) *TubeSystem {
+	r.channels.interceptors.add(interceptors...)
+	return r
+}
+
+// UnregisterChannel removes a channel by its exact path and unsubscribes all of its subscribers with UnsubscribeReasonChannelUnregistered
+func (r *TubeSystem) UnregisterChannel(channelName string) bool {
+	return r.channels.Unregister(channelName)
+}
+
+// Shutdown disconnects all clients with UnsubscribeReasonShutdown, cancels all scheduled messages and drops coalesced
+// publishes
+func (r *TubeSystem) Shutdown() {
+	r.channels.scheduler.cancelWhere("", func(m *ScheduledMessage) bool {
+		return true
+	})
+	for _, channel := range r.channels.All() {
+		channel.coalescer.stop()
+	}
+	for _, client := range r.connector.clients.All() {
+		if err := client.DisconnectWithReason(UnsubscribeReasonShutdown); err != nil {
+			r.connector.error(NewError(nil, ErrorDisconnectFailed, "failed to disconnect client on shutdown", err))
+		}
+	}
+}
+
+// SetQueueOptions gives each client, that connects afterwards, a bounded outbound queue with its own writer goroutine.
+func (r *TubeSystem) SetQueueOptions(options QueueOptions) {
+	r.connector.setQueueOptions(options)
+}
+
+// SetInboundOptions sets limits for messages received from clients and enables pooling of Message structs.
+func (r *TubeSystem) SetInboundOptions(options InboundOptions) {
+	r.inboundMutex.Lock()
+	defer r.inboundMutex.Unlock()
+	r.inbound = options
+}
+
+func (r *TubeSystem) getInboundOptions() InboundOptions {
+	r.inboundMutex.RLock()
+	defer r.inboundMutex.RUnlock()
+	return r.inbound
+}
+
+// SetPanicPolicy sets how recovered panics of handlers and middlewares are treated, it should be called before clients connect.
+func (r *TubeSystem) SetPanicPolicy(policy PanicPolicy) {
+	r.channels.setPanicPolicy(policy)
 }
 
 // HandleRequest handles a new websocket request, adds the properties to the new client
@@ -47,6 +164,16 @@ func (r *TubeSystem) HandleRequest(writer http.ResponseWriter, request *http.Req
 	return r.connector.requestHandler(writer, request, properties)
 }
 
+// RangeClients calls fn for each client of a snapshot of all connected clients until fn returns false
+func (r *TubeSystem) RangeClients(fn func(client *Client) bool) {
+	r.connector.clients.Range(fn)
+}
+
+// RangeChannels calls fn for each channel of a snapshot of all registered channels until fn returns false
+func (r *TubeSystem) RangeChannels(fn func(channel *Channel) bool) {
+	r.channels.Range(fn)
+}
+
 func (r *TubeSystem) IsConnected(clientId string) bool {
 	return r.connector.clients.Exists(clientId)
 }
@@ -76,31 +203,170 @@ func (r *TubeSystem) Send(channelPath string, clientId string, payload []byte) *
 	return context.Send(payload)
 }
 
-// connectHandler handles a new melody connection
-func (r *TubeSystem) connectHandler(client *Client) {}
+// SendAt sends a message to a subscriber of a path at the given time.
+func (r *TubeSystem) SendAt(channelPath string, clientId string, payload []byte, at time.Time) (*ScheduledMessage, *Error) {
+	channelExists, channel, _ := r.channels.Get(channelPath)
+	if !channelExists {
+		return nil, NewError(nil, ErrorUnknownChannel, "channel does not exist", nil)
+	}
+	if !channel.IsSubscribed(clientId, channelPath) {
+		return nil, NewError(nil, ErrorClientNotSubscribed, "user not subscribed to channel", nil)
+	}
+	return r.channels.scheduler.schedule(channel, channelPath, clientId, at, func() {
+		if err := r.Send(channelPath, clientId, payload); err != nil {
+			r.connector.error(err)
+		}
+	}), nil
+}
+
+// SendAfter sends a message to a subscriber of a path after the given duration.
+func (r *TubeSystem) SendAfter(channelPath string, clientId string, payload []byte, delay time.Duration) (*ScheduledMessage, *Error) {
+	return r.SendAt(channelPath, clientId, payload, time.Now().Add(delay))
+}
+
+// BroadcastAt broadcasts a message to all subscribers of a path at the given time.
+// It fails with ErrorNoSubscribers if the path has no subscribers.
+func (r *TubeSystem) BroadcastAt(channelPath string, payload []byte, at time.Time) (*ScheduledMessage, *Error) {
+	channelExists, channel, _ := r.channels.Get(channelPath)
+	if !channelExists {
+		return nil, NewError(nil, ErrorUnknownChannel, "channel does not exist", nil)
+	}
+	if channel.SubscriberCount(channelPath) == 0 {
+		return nil, NewError(nil, ErrorNoSubscribers, "path has no subscribers", nil)
+	}
+	m := r.channels.scheduler.schedule(channel, channelPath, "", at, func() {
+		channel.Broadcast(channelPath, payload, nil)
+	})
+	if channel.SubscriberCount(channelPath) == 0 {
+		// the last subscriber left before the message was scheduled
+		m.Cancel()
+		return nil, NewError(nil, ErrorNoSubscribers, "path has no subscribers", nil)
+	}
+	return m, nil
+}
+
+// BroadcastAfter broadcasts a message to all subscribers of a path after the given duration.
+func (r *TubeSystem) BroadcastAfter(channelPath string, payload []byte, delay time.Duration) (*ScheduledMessage, *Error) {
+	return r.BroadcastAt(channelPath, payload, time.Now().Add(delay))
+}
+
+// connectHandler handles a new connection and rejects it if one of the connect handlers fails
+func (r *TubeSystem) connectHandler(client *Client) {
+	r.handlersMutex.RLock()
+	handlers := r.connectHandlers
+	r.handlersMutex.RUnlock()
+
+	for _, handler := range handlers {
+		if err := handler(client); err != nil {
+			r.reject(client, err)
+			return
+		}
+	}
+}
+
+// reject sends the error to the client and closes its connection
+func (r *TubeSystem) reject(client *Client, err *Error) {
+	client.setRejected()
+	r.connector.error(err)
+	if err := client.SendError(err); err != nil {
+		r.connector.error(err)
+	}
+	if err := client.DisconnectWithReason(UnsubscribeReasonServerKick); err != nil {
+		r.connector.error(NewError(nil, ErrorDisconnectFailed, "failed to disconnect rejected client", err))
+	}
+}
 
 // disconnectHandler handles a client disconnect
 func (r *TubeSystem) disconnectHandler(c *Client) {
-	r.channels.UnsubscribeAll(c.Id)
+	r.channels.UnsubscribeAll(c.Id, c.DisconnectReason())
+
+	if c.isRejected() {
+		return
+	}
+
+	r.handlersMutex.RLock()
+	handlers := r.disconnectHandlers
+	r.handlersMutex.RUnlock()
+
+	for _, handler := range handlers {
+		handler(c, c.DisconnectReason())
+	}
 }
 
 // messageHandler handles a new client message
 func (r *TubeSystem) messageHandler(c *Client, msg []byte) {
-	var req Message
-	err := json.Unmarshal(msg, &req)
-	if err != nil {
+	r.handleMessage(c, msg, parseMessage)
+}
+
+// binaryMessageHandler handles a new client message that was sent in a binary frame
+func (r *TubeSystem) binaryMessageHandler(c *Client, msg []byte) {
+	r.handleMessage(c, msg, decodeBinaryMessage)
+}
+
+func (r *TubeSystem) handleMessage(c *Client, msg []byte, parse func(data []byte, message *Message, maxDepth int) error) {
+	options := r.getInboundOptions()
+	if options.MaxMessageSize > 0 && len(msg) > options.MaxMessageSize {
+		r.connector.error(NewError(nil, ErrorInvalidMessage, "message exceeds max size", nil))
+		return
+	}
+
+	req := &Message{}
+	if options.PoolMessages {
+		req = messagePool.Get().(*Message)
+		defer func() {
+			*req = Message{}
+			messagePool.Put(req)
+		}()
+	}
+	if err := parse(msg, req, options.maxDepth()); err != nil {
 		r.connector.error(NewError(nil, ErrorInvalidMessage, "invalid message received", err))
 		return
 	}
+	message := req
+	if req.Chunk != nil && req.Type != MessageTypeCancel {
+		if !options.ReassembleTransfers {
+			r.connector.error(NewError(nil, ErrorInvalidMessage, "chunked transfers are disabled", nil))
+			return
+		}
+		reassembled, err := c.reassemble(req, options)
+		if err != nil {
+			r.connector.error(NewError(nil, ErrorInvalidMessage, "invalid chunk received", err))
+			return
+		}
+		if reassembled == nil {
+			return
+		}
+		if reassembled.Encoding != PayloadEncodingBinary {
+			if err := validatePayload(reassembled.Payload, options.maxDepth()); err != nil {
+				r.connector.error(NewError(nil, ErrorInvalidMessage, "invalid chunk received", err))
+				return
+			}
+		}
+		message = reassembled
+	}
+
+	if err := r.plugins.onInbound(c, message); err != nil {
+		r.connector.error(err)
+		if err := c.sendError(nil, message.Channel, err); err != nil {
+			r.connector.error(err)
+		}
+		return
+	}
 
-	switch req.Type {
+	switch message.Type {
 	case MessageTypeSubscribe:
-		r.channels.Subscribe(c, req.Channel)
+		r.channels.subscribe(c, message.Channel, message.Payload)
 	case MessageTypeUnsubscribe:
-		r.channels.Unsubscribe(c.Id, req.Channel)
+		r.channels.Unsubscribe(c.Id, message.Channel)
 	case MessageTypeChannelMessage:
-		r.channels.OnMessage(c, &req)
+		r.channels.OnMessage(c, message)
+	case MessageTypeAck:
+		r.channels.Ack(c, message)
+	case MessageTypeCancel:
+		if message.Chunk != nil {
+			c.cancelTransfers(message.Chunk.TransferId)
+		}
 	default:
-		r.connector.error(NewError(nil, ErrorUnknownType, "unknown tubeSystem request type: '"+req.Type+"'", nil))
+		r.connector.error(NewError(nil, ErrorUnknownType, "unknown tubeSystem request type: '"+message.Type+"'", nil))
 	}
 }
@@ -2,6 +2,7 @@ package pts
 
 import (
 	"encoding/json"
+	"strings"
 	"testing"
 )
 
@@ -49,39 +50,21 @@ func NewFakeConnector(errorHandler ErrorHandlerFunc) (*Connector, *FakeSocket) {
 	fakeSocket := &FakeSocket{}
 
 	connector := NewConnector(nil, errorHandler)
-	connector.clients.init()
 
 	fakeSocket.handleConnect = func(s *FakeSocketSession) {
-		client := Client{
-			Id: "",
-			sendMessage: func(msg []byte) error {
-				s.onOutgoingMessage(msg)
-				return nil
-			},
-			properties: map[string]interface{}{},
-		}
-
-		connector.clients.Join(&client)
+		client := connector.Join(func(msg []byte) error {
+			s.onOutgoingMessage(msg)
+			return nil
+		}, map[string]interface{}{})
 		s.Id = client.Id
-
-		if connector.hooks.OnConnect != nil {
-			connector.hooks.OnConnect(&client)
-		}
 	}
 
 	fakeSocket.handleDisconnect = func(s *FakeSocketSession) {
-		client := connector.clients.Get(s.Id)
-		if connector.hooks.OnDisconnect != nil {
-			connector.hooks.OnDisconnect(client)
-		}
-		connector.clients.Remove(client.Id)
+		connector.Leave(s.Id)
 	}
 
 	fakeSocket.handleMessage = func(s *FakeSocketSession, data []byte) {
-		client := connector.clients.Get(s.Id)
-		if connector.hooks.OnMessage != nil {
-			connector.hooks.OnMessage(client, data)
-		}
+		connector.Message(s.Id, data)
 	}
 
 	return connector, fakeSocket
@@ -161,6 +144,109 @@ func TestTubeSystemConnection(t *testing.T) {
 		}
 	})
 
+	t.Run("Connect and disconnect handlers", func(t *testing.T) {
+		fakeConnector, fakeSocket := NewFakeConnector(func(err *Error) {})
+		tubeSystem := New(fakeConnector)
+
+		var calls []string
+		var disconnectReason UnsubscribeReason
+
+		tubeSystem.
+			OnConnect(func(client *Client) *Error {
+				calls = append(calls, "connect1")
+				client.Set("user", "jon")
+				return nil
+			}).
+			OnConnect(func(client *Client) *Error {
+				calls = append(calls, "connect2:"+client.MustGet("user").(string))
+				return nil
+			}).
+			OnDisconnect(func(client *Client, reason UnsubscribeReason) {
+				calls = append(calls, "disconnect")
+				disconnectReason = reason
+			})
+
+		fakeClient := fakeSocket.NewClientConnects(func(_ []byte) {})
+		fakeClient.Disconnect()
+
+		want := []string{"connect1", "connect2:jon", "disconnect"}
+		if strings.Join(calls, ",") != strings.Join(want, ",") {
+			t.Errorf("handlers were called in order %v, want %v", calls, want)
+		}
+		if disconnectReason != UnsubscribeReasonClientDisconnect {
+			t.Errorf("OnDisconnect was called with %s, want %s", disconnectReason, UnsubscribeReasonClientDisconnect)
+		}
+	})
+
+	t.Run("Connect handler rejects connection", func(t *testing.T) {
+		var retrievedErr *Error
+		fakeConnector, fakeSocket := NewFakeConnector(func(err *Error) {
+			retrievedErr = err
+		})
+		tubeSystem := New(fakeConnector)
+
+		testErrCode := ErrorCode(401)
+		disconnectCalled := false
+		subscribeCalled := false
+
+		channel := tubeSystem.RegisterChannel("example/path", ChannelHandlers{
+			OnSubscribe: func(s *Context) {
+				subscribeCalled = true
+			},
+		})
+		tubeSystem.
+			OnConnect(func(client *Client) *Error {
+				return NewError(nil, testErrCode, "Unauthorized", nil)
+			}).
+			OnDisconnect(func(client *Client, reason UnsubscribeReason) {
+				disconnectCalled = true
+			})
+
+		var receivedMessage map[string]interface{}
+		fakeClient := fakeSocket.NewClientConnects(func(msg []byte) {
+			_ = json.Unmarshal(msg, &receivedMessage)
+		})
+
+		if tubeSystem.IsConnected(fakeClient.Id) {
+			t.Errorf("tubeSystem.IsConnected(fakeClient.Id) = true, want false")
+		}
+		if disconnectCalled {
+			t.Errorf("OnDisconnect was called for a rejected client, want it not to be called")
+		}
+		if retrievedErr == nil || retrievedErr.Code != testErrCode {
+			t.Errorf("error handler was called with %v, want Error{Code: %d}", retrievedErr, testErrCode)
+		}
+		if receivedMessage == nil || receivedMessage["type"] != MessageTypeError {
+			t.Errorf("client received %v, want error message", receivedMessage)
+		} else if payload := receivedMessage["payload"].(map[string]interface{}); ErrorCode(payload["code"].(float64)) != testErrCode {
+			t.Errorf("client received error with code %v, want %d", payload["code"], testErrCode)
+		}
+
+		// messages of rejected clients are ignored
+		fakeClient.Send(SubMessage("example/path"))
+		if subscribeCalled || channel.IsSubscribed(fakeClient.Id, "example/path") {
+			t.Errorf("rejected client was subscribed to example/path, want its messages to be ignored")
+		}
+	})
+
+	t.Run("RangeClients visits connected clients", func(t *testing.T) {
+		fakeConnector, fakeSocket := NewFakeConnector(func(err *Error) {})
+		tubeSystem := New(fakeConnector)
+
+		fakeClientA := fakeSocket.NewClientConnects(func(_ []byte) {})
+		fakeClientB := fakeSocket.NewClientConnects(func(_ []byte) {})
+		fakeClientB.Disconnect()
+
+		var visited []string
+		tubeSystem.RangeClients(func(client *Client) bool {
+			visited = append(visited, client.Id)
+			return true
+		})
+		if len(visited) != 1 || visited[0] != fakeClientA.Id {
+			t.Errorf("RangeClients visited %v, want [%s]", visited, fakeClientA.Id)
+		}
+	})
+
 	t.Run("GetChannel should return registered channel", func(t *testing.T) {
 		channelPath := "example/path"
 		channelPathInvalid := "example/path/testy"
@@ -209,6 +295,138 @@ func TestTubeSystemConnection(t *testing.T) {
 		}
 	})
 
+	t.Run("Contexts are cancelled on unsubscribe and disconnect", func(t *testing.T) {
+		testChannelPathA := "example/path/a"
+		testChannelPathB := "example/path/b"
+		fakeConnector, fakeSocket := NewFakeConnector(func(err *Error) {})
+		tubeSystem := New(fakeConnector)
+
+		var contexts []*Context
+		var doneInUnsubscribe bool
+
+		tubeSystem.RegisterChannel("example/path/:var", ChannelHandlers{
+			OnSubscribe: func(s *Context) {
+				contexts = append(contexts, s)
+			},
+			OnUnsubscribe: func(s *Context) {
+				doneInUnsubscribe = s.Err() != nil
+			},
+		})
+
+		fakeClient := fakeSocket.NewClientConnects(func(_ []byte) {})
+		client := fakeConnector.clients.Get(fakeClient.Id)
+		fakeClient.Send(SubMessage(testChannelPathA))
+		fakeClient.Send(SubMessage(testChannelPathB))
+
+		if len(contexts) != 2 {
+			t.Errorf("len(contexts) = %d, want 2", len(contexts))
+			return
+		}
+
+		fakeClient.Send(UnsubMessage(testChannelPathA))
+
+		if contexts[0].Err() == nil {
+			t.Errorf("contexts[0].Err() = nil after unsubscribe, want error")
+		}
+		if doneInUnsubscribe {
+			t.Errorf("context was cancelled before OnUnsubscribe, want it to be cancelled afterwards")
+		}
+		if contexts[1].Err() != nil {
+			t.Errorf("contexts[1].Err() = %v, want nil", contexts[1].Err())
+		}
+		if err := contexts[0].Send([]byte("{}")); err == nil || err.Code != ErrorContextClosed {
+			t.Errorf("contexts[0].Send(...) = %v, want Error{Code: %d}", err, ErrorContextClosed)
+		}
+
+		fakeClient.Disconnect()
+
+		select {
+		case <-client.Done():
+		default:
+			t.Errorf("client.Done() is not closed after disconnect")
+		}
+		select {
+		case <-contexts[1].Done():
+		default:
+			t.Errorf("contexts[1].Done() is not closed after disconnect")
+		}
+	})
+
+	t.Run("Unsubscribe reasons", func(t *testing.T) {
+		channelPath := "example/path/:var"
+		fakeConnector, fakeSocket := NewFakeConnector(func(err *Error) {})
+		tubeSystem := New(fakeConnector)
+
+		reasons := map[string]UnsubscribeReason{}
+
+		channel := tubeSystem.RegisterChannel(channelPath, ChannelHandlers{
+			OnUnsubscribe: func(s *Context) {
+				reasons[s.FullPath] = s.UnsubscribeReason()
+			},
+		})
+
+		fakeClient := fakeSocket.NewClientConnects(func(_ []byte) {})
+		client := fakeConnector.clients.Get(fakeClient.Id)
+		for _, path := range []string{"example/path/a", "example/path/b", "example/path/c"} {
+			fakeClient.Send(SubMessage(path))
+		}
+
+		fakeClient.Send(UnsubMessage("example/path/a"))
+		channel.Unsubscribe(fakeClient.Id, "example/path/b")
+		fakeClient.Disconnect()
+
+		want := map[string]UnsubscribeReason{
+			"example/path/a": UnsubscribeReasonClientRequest,
+			"example/path/b": UnsubscribeReasonServerKick,
+			"example/path/c": UnsubscribeReasonClientDisconnect,
+		}
+		for path, reason := range want {
+			if reasons[path] != reason {
+				t.Errorf("UnsubscribeReason() for %s = %s, want %s", path, reasons[path], reason)
+			}
+		}
+		if client.DisconnectReason() != UnsubscribeReasonClientDisconnect {
+			t.Errorf("client.DisconnectReason() = %s, want %s", client.DisconnectReason(), UnsubscribeReasonClientDisconnect)
+		}
+	})
+
+	t.Run("Unregister channel and shutdown", func(t *testing.T) {
+		fakeConnector, fakeSocket := NewFakeConnector(func(err *Error) {})
+		tubeSystem := New(fakeConnector)
+
+		reasons := map[string]UnsubscribeReason{}
+		handlers := ChannelHandlers{
+			OnUnsubscribe: func(s *Context) {
+				reasons[s.FullPath] = s.UnsubscribeReason()
+			},
+		}
+		tubeSystem.RegisterChannel("example/a", handlers)
+		tubeSystem.RegisterChannel("example/b", handlers)
+
+		fakeClient := fakeSocket.NewClientConnects(func(_ []byte) {})
+		fakeClient.Send(SubMessage("example/a"))
+		fakeClient.Send(SubMessage("example/b"))
+
+		if !tubeSystem.UnregisterChannel("example/a") {
+			t.Errorf("tubeSystem.UnregisterChannel(\"example/a\") = false, want true")
+		}
+		if found, _ := tubeSystem.GetChannel("example/a"); found {
+			t.Errorf("tubeSystem.GetChannel(\"example/a\") = (true, ...), want (false, ...)")
+		}
+
+		tubeSystem.Shutdown()
+
+		if reasons["example/a"] != UnsubscribeReasonChannelUnregistered {
+			t.Errorf("UnsubscribeReason() for example/a = %s, want %s", reasons["example/a"], UnsubscribeReasonChannelUnregistered)
+		}
+		if reasons["example/b"] != UnsubscribeReasonShutdown {
+			t.Errorf("UnsubscribeReason() for example/b = %s, want %s", reasons["example/b"], UnsubscribeReasonShutdown)
+		}
+		if tubeSystem.IsConnected(fakeClient.Id) {
+			t.Errorf("tubeSystem.IsConnected(fakeClient.Id) = true, want false")
+		}
+	})
+
 	t.Run("Handle Sub/Unsub", func(t *testing.T) {
 		channelPath := "example/path/:var"
 		testVar := "test"
@@ -438,6 +656,46 @@ func TestTubeSystemMessaging(t *testing.T) {
 		}
 	})
 
+	t.Run("Panic policy reports and disconnects", func(t *testing.T) {
+		testChannelPath := "example/path/foobar"
+		fakeConnector, fakeSocket := NewFakeConnector(func(err *Error) {})
+		tubeSystem := New(fakeConnector)
+
+		panicCount := 0
+		tubeSystem.SetPanicPolicy(PanicPolicy{
+			ReportToClient:   true,
+			DisconnectClient: true,
+			OnPanic: func(err *Error) {
+				panicCount++
+			},
+		})
+
+		tubeSystem.RegisterChannel(testChannelPath, ChannelHandlers{
+			OnMessage: func(s *Context, message *Message) {
+				panic("handler failed")
+			},
+		})
+
+		var receivedMessage map[string]interface{}
+		fakeClient := fakeSocket.NewClientConnects(func(msg []byte) {
+			_ = json.Unmarshal(msg, &receivedMessage)
+		})
+		fakeClient.Send(SubMessage(testChannelPath))
+		fakeClient.Send(ChannelMessage(testChannelPath, []byte("{}")))
+
+		if panicCount != 1 {
+			t.Errorf("OnPanic was called %d times, want 1", panicCount)
+		}
+		if receivedMessage == nil {
+			t.Errorf("client did not receive an error message, want error message")
+		} else if payload, ok := receivedMessage["payload"].(map[string]interface{}); !ok || ErrorCode(payload["code"].(float64)) != ErrorHandlerPanic {
+			t.Errorf("client received %v, want error with code %d", receivedMessage, ErrorHandlerPanic)
+		}
+		if tubeSystem.IsConnected(fakeClient.Id) {
+			t.Errorf("tubeSystem.IsConnected(fakeClient.Id) = true, want false")
+		}
+	})
+
 	t.Run("Client send errors", func(t *testing.T) {
 		testChannelPath := "example/path/foobar"
 		testPayload := map[string]interface{}{"name": "Jon Doe", "admin": false}